@@ -20,6 +20,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"os"
+	"xelis-pool/config"
 	"xelis-pool/log"
 )
 
@@ -49,6 +50,29 @@ func init() {
 		panic(err)
 	}
 
+	if Cfg.Slave.TrustedProxyUrls == nil {
+		Cfg.Slave.TrustedProxyUrls = []string{
+			"https://www.cloudflare.com/ips-v4",
+			"https://www.cloudflare.com/ips-v6",
+		}
+	}
+	if Cfg.Slave.TrustedProxyRefresh == 0 {
+		Cfg.Slave.TrustedProxyRefresh = 24 * 3600
+	}
+
+	if Cfg.Slave.MaxDifficulty == 0 {
+		Cfg.Slave.MaxDifficulty = config.MAX_DIFFICULTY
+	}
+	if Cfg.Slave.Vardiff.RetargetTime == 0 {
+		Cfg.Slave.Vardiff.RetargetTime = 30
+	}
+	if Cfg.Slave.Vardiff.Variance == 0 {
+		Cfg.Slave.Vardiff.Variance = 0.3
+	}
+	if Cfg.Slave.Vardiff.Window == 0 {
+		Cfg.Slave.Vardiff.Window = 16
+	}
+
 	log.LogLevel = Cfg.LogLevel
 
 	// master password is hashed with sha256 to make it fixed-length (32 bytes long)
@@ -76,14 +100,52 @@ type Config struct {
 type Slave struct {
 	MasterAddress string
 
+	// daemons used by the slave, sorted by priority. If empty, Master.DaemonRpc is used.
+	DaemonRpcs []string
+
+	Name   string // name of the slave, sent to the master
+	Region string
+
 	InitialDifficulty uint64
 	MinDifficulty     uint64
-	ShareTarget       float64
+	MaxDifficulty     uint64  // config.MAX_DIFFICULTY by default
+	ShareTarget       float64 // seconds between shares
+
+	Vardiff Vardiff
 
 	XatumPort   uint16
 	GetworkPort uint16
 	StratumPort uint16
 
+	// Stratum port where all the miners mine solo, disabled if 0. Miners can
+	// also mine solo on the other ports with the "solo" login option.
+	SoloStratumPort uint16
+
+	// Xatum and Stratum connections start with a PROXY protocol header (v1 or v2)
+	// sent by a load balancer. The ports must not be reachable by miners directly.
+	ProxyProtocol bool
+
+	StratumTlsPort uint16 // Stratum over TLS, disabled if 0
+	GetworkTlsPort uint16 // Getwork over TLS (wss), disabled if 0
+
+	// proxies allowed to set the client IP of Getwork connections (CIDRs or
+	// IPs). Localhost is always trusted.
+	TrustedProxies []string
+	// ranges downloaded from TrustedProxyUrls are cached in this file, and used
+	// when the URLs cannot be reached
+	TrustedProxyFile string
+	// lists of CIDRs refreshed in the background. If not set, the Cloudflare
+	// lists are used; set to [] to disable.
+	TrustedProxyUrls    []string
+	TrustedProxyRefresh uint64 // seconds between refreshes, 1 day by default
+
+	// TLS certificate used by Xatum, Stratum and Getwork, reloaded when the
+	// files change. If empty, a self-signed certificate is used.
+	TlsCert string
+	TlsKey  string
+
+	MetricsAddr string // address of the Prometheus metrics endpoint, disabled if empty
+
 	TrustScore         int32
 	TrustedCheckChance float32
 }
@@ -92,8 +154,20 @@ type Master struct {
 	ApiPort      uint16
 	ApiUrlPrefix string
 
-	Port       uint16
-	FeePercent float64
+	MetricsAddr string // address of the Prometheus metrics endpoint, disabled if empty
+
+	// admin API, on its own listener so it can stay private. Disabled if empty.
+	AdminAddr   string
+	AdminTokens []AdminToken
+
+	Port           uint16
+	FeePercent     float64
+	SoloFeePercent float64 // fee of the blocks found by solo miners
+
+	AllowLegacySlaves bool // accept slaves using the v1 protocol, which has no replay protection
+
+	RewardScheme string  // "pplns" (default), "pplns_shares", "pps", "prop" or "solo"
+	PplnsN       float64 // "pplns_shares" window, as a multiple of the network difficulty
 
 	MinWithdrawal float64
 	WithdrawalFee float64
@@ -108,3 +182,22 @@ type Master struct {
 
 	DiscordWebhook string
 }
+
+// Vardiff configures the share difficulty retargeting
+type Vardiff struct {
+	RetargetTime float64 // minimum seconds between retargets, 30 by default
+	// the difficulty is kept while the average share time is within
+	// ShareTarget * (1 ± Variance). 0.3 by default.
+	Variance float64
+	Window   int // number of shares the hashrate is estimated from, 16 by default
+
+	// share target of each protocol ("xatum", "stratum", "getwork"), ShareTarget if not set
+	ShareTargets map[string]float64
+}
+
+// AdminToken is a bearer token accepted by the admin API
+type AdminToken struct {
+	Name string // shown in the audit log
+	Hash string // hex encoded SHA-256 of the token
+	Role string // "read" or "operator"
+}
@@ -0,0 +1,213 @@
+// Copyright (C) 2024 XELIS
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strconv"
+	"xelis-pool/database"
+	"xelis-pool/log"
+	"xelis-pool/util"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+const MAX_ADJUSTMENT = 1_000_000 // in coins
+
+const MAX_ADJUSTMENT_REASON = 500
+
+var errInsufficientBalance = errors.New("the balance is lower than the debit")
+
+type AdjustmentInfo struct {
+	Id      uint64  `json:"id"`
+	Address string  `json:"address"`
+	Amount  float64 `json:"amount"`  // negative for debits
+	Balance float64 `json:"balance"` // confirmed balance after the adjustment
+	Reason  string  `json:"reason"`
+	Admin   string  `json:"admin,omitempty"`
+	Time    uint64  `json:"time"`
+}
+
+func NewAdjustmentInfo(a database.Adjustment) AdjustmentInfo {
+	amount := Round6(float64(a.Amount) / Coin)
+	if a.Debit {
+		amount = -amount
+	}
+
+	return AdjustmentInfo{
+		Id:      a.Id,
+		Address: a.Address,
+		Amount:  amount,
+		Balance: Round6(float64(a.BalanceAfter) / Coin),
+		Reason:  a.Reason,
+		Admin:   a.Admin,
+		Time:    a.Time,
+	}
+}
+
+// adjustBalance credits or debits the confirmed balance of an address through
+// the ledger, and appends the adjustment to the ADJUSTMENTS bucket
+func adjustBalance(addr string, amount uint64, isDebit bool, reason, admin string) (database.Adjustment, error) {
+	adj := database.Adjustment{
+		Address: addr,
+		Amount:  amount,
+		Debit:   isDebit,
+		Reason:  reason,
+		Admin:   admin,
+		Time:    util.Time(),
+	}
+
+	err := DB.Update(func(tx *bolt.Tx) error {
+		id, err := tx.Bucket(database.ADJUSTMENTS).NextSequence()
+		if err != nil {
+			return err
+		}
+		adj.Id = id
+
+		entry := database.LedgerEntry{
+			Kind: database.LEDGER_ADJUSTMENT,
+			Ref:  strconv.FormatUint(adj.Id, 10),
+			Postings: []database.Posting{
+				debit(ACCOUNT_ADJUSTMENTS, amount),
+				credit(addrAccount(ACCOUNT_BALANCE, addr), amount),
+			},
+		}
+		if isDebit {
+			entry.Postings = []database.Posting{
+				debit(addrAccount(ACCOUNT_BALANCE, addr), amount),
+				credit(ACCOUNT_ADJUSTMENTS, amount),
+			}
+		}
+
+		err = postEntry(tx, &entry)
+		if errors.Is(err, errNegativeBalance) {
+			return errInsufficientBalance
+		} else if err != nil {
+			return err
+		}
+
+		addrInfo := database.AddrInfo{}
+		err = addrInfo.Deserialize(tx.Bucket(database.ADDRESS_INFO).Get([]byte(addr)))
+		if err != nil {
+			return err
+		}
+		adj.BalanceAfter = addrInfo.Balance
+
+		return storeAdjustment(tx, adj)
+	})
+
+	return adj, err
+}
+
+// storeAdjustment stores an adjustment. Adjustments are never modified or removed.
+func storeAdjustment(tx *bolt.Tx, adj database.Adjustment) error {
+	buck := tx.Bucket(database.ADJUSTMENTS)
+
+	key := database.AdjustmentKey(adj.Address, adj.Id)
+	if buck.Get(key) != nil {
+		return fmt.Errorf("adjustment %d already exists", adj.Id)
+	}
+
+	err := tx.Bucket(database.ADJUSTMENT_INDEX).Put(binary.BigEndian.AppendUint64(nil, adj.Id), []byte(adj.Address))
+	if err != nil {
+		return err
+	}
+
+	return buck.Put(key, adj.Serialize())
+}
+
+// indexAdjustments fills the ADJUSTMENT_INDEX bucket if it's empty, for the
+// databases created before it existed
+func indexAdjustments(tx *bolt.Tx) error {
+	index := tx.Bucket(database.ADJUSTMENT_INDEX)
+	if k, _ := index.Cursor().First(); k != nil {
+		return nil
+	}
+
+	return tx.Bucket(database.ADJUSTMENTS).ForEach(func(k, v []byte) error {
+		adj := database.Adjustment{}
+		err := adj.Deserialize(v)
+		if err != nil {
+			log.Err("error reading adjustment:", err)
+			return nil
+		}
+
+		return index.Put(binary.BigEndian.AppendUint64(nil, adj.Id), []byte(adj.Address))
+	})
+}
+
+// addressAdjustments returns at most limit adjustments of an address with id
+// lower than before, from the newest to the oldest
+func addressAdjustments(tx *bolt.Tx, addr string, before uint64, limit int) []database.Adjustment {
+	adjs := make([]database.Adjustment, 0, min(limit, 50))
+
+	prefix := append([]byte(addr), 0)
+
+	c := tx.Bucket(database.ADJUSTMENTS).Cursor()
+
+	k, v := c.Seek(database.AdjustmentKey(addr, before))
+	if k == nil {
+		k, v = c.Last()
+	} else {
+		k, v = c.Prev()
+	}
+
+	for ; k != nil && bytes.HasPrefix(k, prefix) && len(adjs) < limit; k, v = c.Prev() {
+		adj := database.Adjustment{}
+		err := adj.Deserialize(v)
+		if err != nil {
+			log.Err("error reading adjustment:", err)
+			continue
+		}
+
+		adjs = append(adjs, adj)
+	}
+
+	return adjs
+}
+
+// listAdjustments returns at most limit adjustments of all the addresses with
+// id lower than before, from the newest to the oldest
+func listAdjustments(tx *bolt.Tx, before uint64, limit int) []database.Adjustment {
+	adjs := make([]database.Adjustment, 0, min(limit, 50))
+
+	buck := tx.Bucket(database.ADJUSTMENTS)
+
+	c := tx.Bucket(database.ADJUSTMENT_INDEX).Cursor()
+
+	k, v := c.Seek(binary.BigEndian.AppendUint64(nil, before))
+	if k == nil {
+		k, v = c.Last()
+	} else {
+		k, v = c.Prev()
+	}
+
+	for ; k != nil && len(adjs) < limit; k, v = c.Prev() {
+		adj := database.Adjustment{}
+		err := adj.Deserialize(buck.Get(database.AdjustmentKey(string(v), binary.BigEndian.Uint64(k))))
+		if err != nil {
+			log.Err("error reading adjustment:", err)
+			continue
+		}
+
+		adjs = append(adjs, adj)
+	}
+
+	return adjs
+}
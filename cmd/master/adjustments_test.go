@@ -0,0 +1,91 @@
+// Copyright (C) 2024 XELIS
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"math"
+	"slices"
+	"testing"
+	"xelis-pool/database"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+func adjustmentIds(adjs []database.Adjustment) []uint64 {
+	ids := make([]uint64, 0, len(adjs))
+	for _, v := range adjs {
+		ids = append(ids, v.Id)
+	}
+	return ids
+}
+
+func TestListAdjustments(t *testing.T) {
+	newTestDB(t)
+
+	for i, addr := range []string{"xel:b", "xel:a", "xel:b", "xel:c", "xel:a"} {
+		_, err := adjustBalance(addr, uint64(i+1), false, "test", "admin")
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		before uint64
+		limit  int
+		ids    []uint64
+	}{
+		{math.MaxUint64, 50, []uint64{5, 4, 3, 2, 1}},
+		{math.MaxUint64, 2, []uint64{5, 4}},
+		{4, 2, []uint64{3, 2}},
+		{2, 50, []uint64{1}},
+		{1, 50, []uint64{}},
+	}
+
+	check := func(name string) {
+		DB.View(func(tx *bolt.Tx) error {
+			for _, test := range tests {
+				ids := adjustmentIds(listAdjustments(tx, test.before, test.limit))
+				if !slices.Equal(ids, test.ids) {
+					t.Errorf("%s: before %d limit %d: got %v, expected %v", name, test.before, test.limit, ids, test.ids)
+				}
+			}
+
+			ids := adjustmentIds(addressAdjustments(tx, "xel:a", math.MaxUint64, 50))
+			if !slices.Equal(ids, []uint64{5, 2}) {
+				t.Errorf("%s: adjustments of xel:a are %v", name, ids)
+			}
+			return nil
+		})
+	}
+	check("indexed")
+
+	// databases created before the index
+	err := DB.Update(func(tx *bolt.Tx) error {
+		err := tx.DeleteBucket(database.ADJUSTMENT_INDEX)
+		if err != nil {
+			return err
+		}
+		_, err = tx.CreateBucket(database.ADJUSTMENT_INDEX)
+		if err != nil {
+			return err
+		}
+		return indexAdjustments(tx)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	check("reindexed")
+}
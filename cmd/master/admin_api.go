@@ -0,0 +1,577 @@
+// Copyright (C) 2024 XELIS
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+	"xelis-pool/address"
+	"xelis-pool/cfg"
+	"xelis-pool/config"
+	"xelis-pool/database"
+	"xelis-pool/log"
+	"xelis-pool/rate_limit"
+	"xelis-pool/util"
+
+	"github.com/gin-gonic/gin"
+	"github.com/xelis-project/xelis-go-sdk/wallet"
+	bolt "go.etcd.io/bbolt"
+)
+
+// admin roles. Operators can do everything readers can.
+const (
+	ROLE_READ     = "read"
+	ROLE_OPERATOR = "operator"
+)
+
+// audit log entries are kept for this duration, in seconds
+const AUDIT_LOG_RETENTION = 90 * 24 * 3600
+
+type adminToken struct {
+	Name string
+	Role string
+	hash [32]byte
+}
+
+var adminTokens []adminToken
+
+type minerLog struct {
+	Hashrate float64
+	Wallet   string
+}
+
+type AuditInfo struct {
+	Id uint64 `json:"id"`
+	database.AuditEntry
+}
+
+func parseAdminTokens(tokens []cfg.AdminToken) ([]adminToken, error) {
+	list := make([]adminToken, 0, len(tokens))
+
+	for _, v := range tokens {
+		if v.Role != ROLE_READ && v.Role != ROLE_OPERATOR {
+			return nil, fmt.Errorf("admin token %s: unknown role %q", v.Name, v.Role)
+		}
+
+		hash, err := hex.DecodeString(v.Hash)
+		if err != nil || len(hash) != 32 {
+			return nil, fmt.Errorf("admin token %s: hash must be a hex encoded SHA-256", v.Name)
+		}
+
+		list = append(list, adminToken{
+			Name: v.Name,
+			Role: v.Role,
+			hash: [32]byte(hash),
+		})
+	}
+
+	return list, nil
+}
+
+// authenticate returns the admin token of an Authorization header, or nil if
+// it isn't valid
+func authenticate(header string) *adminToken {
+	token, ok := strings.CutPrefix(header, "Bearer ")
+	if !ok || token == "" {
+		return nil
+	}
+
+	hash := sha256.Sum256([]byte(token))
+
+	var found *adminToken
+	for i := range adminTokens {
+		// compare all the tokens, so the timing doesn't depend on which one matches
+		if subtle.ConstantTimeCompare(hash[:], adminTokens[i].hash[:]) == 1 {
+			found = &adminTokens[i]
+		}
+	}
+
+	return found
+}
+
+// getAdminToken returns the token of an authenticated admin request, or nil
+func getAdminToken(c *gin.Context) *adminToken {
+	v, ok := c.Get("admin")
+	if !ok {
+		return nil
+	}
+	return v.(*adminToken)
+}
+
+// requireRole aborts the requests which aren't authenticated with a token
+// having the role
+func requireRole(role string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		token := getAdminToken(c)
+		if token == nil {
+			token = authenticate(c.GetHeader("Authorization"))
+			if token == nil {
+				c.Header("WWW-Authenticate", "Bearer")
+				c.AbortWithStatusJSON(401, gin.H{
+					"error": gin.H{
+						"code":    6,
+						"message": "unauthorized",
+					},
+				})
+				return
+			}
+			c.Set("admin", token)
+		}
+
+		if role == ROLE_OPERATOR && token.Role != ROLE_OPERATOR {
+			c.AbortWithStatusJSON(403, gin.H{
+				"error": gin.H{
+					"code":    6,
+					"message": "the token doesn't have the " + role + " role",
+				},
+			})
+			return
+		}
+
+		c.Next()
+	}
+}
+
+// limitFailedAuth rate limits the requests with an invalid token per IP. It's
+// used before auditLog, so that the requests refused by the rate limiter don't
+// write to the database.
+func limitFailedAuth() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		token := authenticate(c.GetHeader("Authorization"))
+		if token != nil {
+			c.Set("admin", token)
+			c.Next()
+			return
+		}
+
+		if !rate_limit.CanDoAction(c.ClientIP(), rate_limit.ACTION_FAILED_ADMIN_AUTH) {
+			log.Warn("admin API: too many failed authentications from", c.ClientIP())
+			tooManyRequests(c)
+			c.Abort()
+			return
+		}
+
+		c.Next()
+	}
+}
+
+// auditLog stores every call to the admin API, including the failed ones,
+// except those refused by limitFailedAuth
+func auditLog() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Next()
+
+		entry := database.AuditEntry{
+			Time:   util.Time(),
+			IP:     c.ClientIP(),
+			Method: c.Request.Method,
+			Path:   c.Request.URL.Path,
+			Status: uint16(c.Writer.Status()),
+		}
+		if token := getAdminToken(c); token != nil {
+			entry.Token = token.Name
+			entry.Role = token.Role
+		}
+
+		log.Infof("admin API: %s %s by %q from %s: %d", entry.Method, entry.Path, entry.Token, entry.IP,
+			entry.Status)
+
+		err := DB.Update(func(tx *bolt.Tx) error {
+			buck := tx.Bucket(database.AUDIT_LOG)
+
+			id, err := buck.NextSequence()
+			if err != nil {
+				return err
+			}
+
+			return buck.Put(binary.BigEndian.AppendUint64(nil, id), entry.Serialize())
+		})
+		if err != nil {
+			log.Err("failed to store audit log entry:", err)
+		}
+	}
+}
+
+// listAuditLog returns at most limit entries with id lower than before, from
+// the newest to the oldest
+func listAuditLog(tx *bolt.Tx, before uint64, limit int) []AuditInfo {
+	entries := make([]AuditInfo, 0, limit)
+
+	c := tx.Bucket(database.AUDIT_LOG).Cursor()
+
+	k, v := c.Seek(binary.BigEndian.AppendUint64(nil, before))
+	if k == nil {
+		k, v = c.Last()
+	} else {
+		k, v = c.Prev()
+	}
+
+	for ; k != nil && len(entries) < limit; k, v = c.Prev() {
+		e := AuditInfo{
+			Id: binary.BigEndian.Uint64(k),
+		}
+		err := e.Deserialize(v)
+		if err != nil {
+			log.Err("error reading audit log entry:", err)
+			continue
+		}
+
+		entries = append(entries, e)
+	}
+
+	return entries
+}
+
+// cleanupAuditLog removes the entries older than AUDIT_LOG_RETENTION
+func cleanupAuditLog(tx *bolt.Tx) (removed int) {
+	buck := tx.Bucket(database.AUDIT_LOG)
+
+	var old [][]byte
+	c := buck.Cursor()
+	for k, v := c.First(); k != nil; k, v = c.Next() {
+		e := database.AuditEntry{}
+		err := e.Deserialize(v)
+		if err == nil && e.Time+AUDIT_LOG_RETENTION > util.Time() {
+			// entries are sorted by time
+			break
+		}
+		old = append(old, bytes.Clone(k))
+	}
+
+	for _, k := range old {
+		buck.Delete(k)
+	}
+
+	return len(old)
+}
+
+// StartAdminApiServer starts the admin API, if enabled. All the routes require
+// a token, sent as "Authorization: Bearer <token>".
+func StartAdminApiServer() {
+	if cfg.Cfg.Master.AdminAddr == "" {
+		log.Info("Admin API disabled")
+		return
+	}
+
+	var err error
+	adminTokens, err = parseAdminTokens(cfg.Cfg.Master.AdminTokens)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if len(adminTokens) == 0 {
+		log.Warn("Admin API enabled, but no admin token is configured")
+	}
+
+	gin.SetMode("release")
+	r := gin.Default()
+
+	r.SetTrustedProxies([]string{
+		"127.0.0.1",
+		"::1",
+	})
+
+	r.Use(limitFailedAuth(), auditLog(), requireRole(ROLE_READ))
+
+	addressRoutes(r)
+
+	r.GET("/summary", func(ctx *gin.Context) {
+		confirmed, pending, err := poolBalances()
+		if err != nil {
+			log.Err(err)
+		}
+
+		rpc := newWalletRPC()
+		balance, err := rpc.GetBalance(wallet.GetBalanceParams{
+			Asset: config.ASSET,
+		})
+
+		if err != nil {
+			log.Warn(err)
+		}
+
+		Stats.Lock()
+		defer Stats.Unlock()
+
+		var miners = make([]minerLog, 0, len(Stats.KnownAddresses))
+
+		for addr, v := range Stats.KnownAddresses {
+			miners = append(miners, minerLog{
+				Hashrate: v.GetHashrate(),
+				Wallet:   addr,
+			})
+		}
+
+		slices.SortFunc(miners, func(a, b minerLog) int {
+			d := b.Hashrate - a.Hashrate
+
+			if d > 0 {
+				return 1
+			} else if d < 0 {
+				return -1
+			}
+			return 0
+		})
+
+		ctx.JSON(200, gin.H{
+			"ok":             true,
+			"bal_confirmed":  float64(confirmed) / Coin,
+			"bal_pending":    float64(pending) / Coin,
+			"bal_total":      float64(confirmed+pending) / Coin,
+			"bal_owned":      float64(balance) / Coin,
+			"debt":           (float64(confirmed+pending) - float64(balance)) / Coin,
+			"debt_confirmed": (float64(confirmed) - float64(balance)) / Coin,
+			"miners":         miners,
+		})
+	})
+
+	r.GET("/slaves", func(ctx *gin.Context) {
+		Stats.Lock()
+		defer Stats.Unlock()
+
+		list := make([]SlaveInfo, 0, len(slaves))
+		for _, v := range slaves {
+			sl := *v
+			sl.Sent, sl.Received = v.conn.Counters()
+			list = append(list, sl)
+		}
+		slices.SortFunc(list, func(a, b SlaveInfo) int {
+			return strings.Compare(a.Name, b.Name)
+		})
+
+		ctx.JSON(200, list)
+	})
+
+	r.GET("/withdrawals", func(ctx *gin.Context) {
+		Stats.Lock()
+		defer Stats.Unlock()
+
+		ctx.JSON(200, Stats.RecentWithdrawals)
+	})
+
+	r.GET("/adjustments", func(ctx *gin.Context) {
+		before, limit, ok := parsePagination(ctx)
+		if !ok {
+			return
+		}
+
+		adjustments := []AdjustmentInfo{}
+
+		DB.View(func(tx *bolt.Tx) error {
+			for _, v := range listAdjustments(tx, before, limit) {
+				adjustments = append(adjustments, NewAdjustmentInfo(v))
+			}
+			return nil
+		})
+
+		ctx.JSON(200, gin.H{
+			"adjustments": adjustments,
+		})
+	})
+
+	r.POST("/adjustments/:addr", requireRole(ROLE_OPERATOR), postAdjustment)
+
+	r.GET("/ledger", func(ctx *gin.Context) {
+		before, limit, ok := parsePagination(ctx)
+		if !ok {
+			return
+		}
+
+		entries := []LedgerEntryInfo{}
+
+		DB.View(func(tx *bolt.Tx) error {
+			for _, v := range listLedger(tx, before, limit) {
+				entries = append(entries, NewLedgerEntryInfo(v, ""))
+			}
+			return nil
+		})
+
+		ctx.JSON(200, gin.H{
+			"entries": entries,
+		})
+	})
+
+	// consistency check of the ledger, the balances and the wallet
+	r.GET("/ledger/check", func(ctx *gin.Context) {
+		report, err := checkLedger()
+		if err != nil {
+			log.Err(err)
+			ctx.JSON(500, gin.H{
+				"error": gin.H{
+					"code":    2,
+					"message": err.Error(),
+				},
+			})
+			return
+		}
+
+		ctx.JSON(200, report)
+	})
+
+	// revenue of the pool between from and to (UNIX timestamps, the last 30
+	// days by default), by periods of interval seconds (1 day by default)
+	r.GET("/revenue", func(ctx *gin.Context) {
+		to := util.Time()
+		from := to - 30*24*3600
+		var interval uint64 = 24 * 3600
+
+		for name, v := range map[string]*uint64{"from": &from, "to": &to, "interval": &interval} {
+			if q := ctx.Query(name); q != "" {
+				n, err := strconv.ParseUint(q, 10, 64)
+				if err != nil {
+					ctx.JSON(400, gin.H{
+						"error": gin.H{
+							"code":    3,
+							"message": "invalid " + name + " parameter",
+						},
+					})
+					return
+				}
+				*v = n
+			}
+		}
+
+		if from >= to || interval == 0 || (to-from)/interval >= MAX_REVENUE_PERIODS {
+			ctx.JSON(400, gin.H{
+				"error": gin.H{
+					"code":    3,
+					"message": fmt.Sprintf("from must be before to, with at most %d intervals", MAX_REVENUE_PERIODS),
+				},
+			})
+			return
+		}
+
+		periods, total := revenueReport(from, to, interval)
+
+		ctx.JSON(200, gin.H{
+			"from":     from,
+			"to":       to,
+			"interval": interval,
+			"periods":  periods,
+			"total":    total,
+		})
+	})
+
+	r.GET("/backup", requireRole(ROLE_OPERATOR), func(ctx *gin.Context) {
+		err := DB.View(func(tx *bolt.Tx) error {
+			ctx.Header("Content-Type", "application/octet-stream")
+			ctx.Header("Content-Disposition", `attachment; filename="my.db"`)
+			ctx.Header("Content-Length", strconv.Itoa(int(tx.Size())))
+			_, err := tx.WriteTo(ctx.Writer)
+			return err
+		})
+		if err != nil {
+			ctx.String(500, "internal server error")
+		}
+	})
+
+	r.GET("/audit", requireRole(ROLE_OPERATOR), func(ctx *gin.Context) {
+		before, limit, ok := parsePagination(ctx)
+		if !ok {
+			return
+		}
+
+		var entries []AuditInfo
+
+		DB.View(func(tx *bolt.Tx) error {
+			entries = listAuditLog(tx, before, limit)
+			return nil
+		})
+
+		ctx.JSON(200, gin.H{
+			"entries": entries,
+		})
+	})
+
+	log.Info("Admin API listening on", cfg.Cfg.Master.AdminAddr)
+
+	err = r.Run(cfg.Cfg.Master.AdminAddr)
+	if err != nil {
+		panic(err)
+	}
+}
+
+// postAdjustment credits (positive amount, in coins) or debits (negative
+// amount) the confirmed balance of an address
+func postAdjustment(ctx *gin.Context) {
+	addr := ctx.Param("addr")
+
+	if !address.IsAddressValid(addr) {
+		ctx.JSON(400, gin.H{
+			"error": gin.H{
+				"code":    3,
+				"message": "invalid address",
+			},
+		})
+		return
+	}
+
+	amount, err := strconv.ParseFloat(ctx.Query("amount"), 64)
+	atomic := uint64(math.Round(math.Abs(amount) * Coin))
+	if err != nil || math.IsNaN(amount) || math.IsInf(amount, 0) || atomic == 0 || math.Abs(amount) > MAX_ADJUSTMENT {
+		ctx.JSON(400, gin.H{
+			"error": gin.H{
+				"code":    3,
+				"message": fmt.Sprintf("amount must be a non-zero number of coins, at most %g", float64(MAX_ADJUSTMENT)),
+			},
+		})
+		return
+	}
+
+	reason := strings.TrimSpace(ctx.Query("reason"))
+	if reason == "" || len(reason) > MAX_ADJUSTMENT_REASON {
+		ctx.JSON(400, gin.H{
+			"error": gin.H{
+				"code":    3,
+				"message": fmt.Sprintf("a reason of at most %d characters is required", MAX_ADJUSTMENT_REASON),
+			},
+		})
+		return
+	}
+
+	adj, err := adjustBalance(addr, atomic, amount < 0, reason, getAdminToken(ctx).Name)
+	if err != nil {
+		if errors.Is(err, errInsufficientBalance) {
+			ctx.JSON(400, gin.H{
+				"error": gin.H{
+					"code":    3,
+					"message": err.Error(),
+				},
+			})
+			return
+		}
+		log.Err(err)
+		ctx.JSON(500, gin.H{
+			"error": gin.H{
+				"code":    2,
+				"message": "internal server error",
+			},
+		})
+		return
+	}
+
+	log.Infof("balance of %s adjusted by %s: %+g (%s)", addr, adj.Admin, amount, reason)
+
+	ctx.JSON(200, NewAdjustmentInfo(adj))
+}
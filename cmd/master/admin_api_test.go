@@ -0,0 +1,100 @@
+// Copyright (C) 2024 XELIS
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"xelis-pool/address"
+	"xelis-pool/cfg"
+	"xelis-pool/database"
+
+	"github.com/gin-gonic/gin"
+	bolt "go.etcd.io/bbolt"
+)
+
+func TestPostAdjustmentInvalidAmount(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	Coin = math.Pow10(cfg.Cfg.Atomic)
+
+	if !address.IsAddressValid(cfg.Cfg.FeeAddress) {
+		t.Fatal("the fee address of the test config is not valid")
+	}
+
+	r := gin.New()
+	r.POST("/adjustments/:addr", postAdjustment)
+
+	// the amount is checked before the database is used, which is not open
+	for _, amount := range []string{"NaN", "nan", "-NaN", "Inf", "+Inf", "-Inf", "0", "-0", "1e-12", ""} {
+		q := url.Values{"amount": {amount}, "reason": {"test"}}
+
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest("POST", "/adjustments/"+cfg.Cfg.FeeAddress+"?"+q.Encode(), nil))
+
+		if w.Code != 400 {
+			t.Errorf("amount %q: status %d, expected 400", amount, w.Code)
+			continue
+		}
+
+		var res struct {
+			Error struct {
+				Code int `json:"code"`
+			} `json:"error"`
+		}
+		err := json.Unmarshal(w.Body.Bytes(), &res)
+		if err != nil || res.Error.Code != 3 {
+			t.Errorf("amount %q: unexpected response %s", amount, w.Body.String())
+		}
+	}
+}
+
+func TestFailedAuthRateLimit(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	newTestDB(t)
+
+	r := gin.New()
+	r.Use(limitFailedAuth(), auditLog(), requireRole(ROLE_READ))
+	r.GET("/summary", func(c *gin.Context) {
+		c.JSON(200, gin.H{})
+	})
+
+	statuses := make(map[int]int)
+	for i := 0; i < 50; i++ {
+		req := httptest.NewRequest("GET", "/summary", nil)
+		req.RemoteAddr = "192.0.2.1:1234"
+		req.Header.Set("Authorization", "Bearer wrong")
+
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		statuses[w.Code]++
+	}
+
+	if statuses[401] == 0 || statuses[401] > 10 || statuses[429] != 50-statuses[401] {
+		t.Errorf("statuses of the failed authentications: %v", statuses)
+	}
+
+	var logged int
+	DB.View(func(tx *bolt.Tx) error {
+		logged = tx.Bucket(database.AUDIT_LOG).Stats().KeyN
+		return nil
+	})
+	if logged != statuses[401] {
+		t.Errorf("%d audit log entries, expected one per 401", logged)
+	}
+}
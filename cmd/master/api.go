@@ -16,15 +16,21 @@
 package main
 
 import (
+	"cmp"
+	"encoding/csv"
+	"encoding/hex"
 	"fmt"
 	"math"
 	"slices"
 	"strconv"
 	"strings"
+	"time"
+	"xelis-pool/address"
 	"xelis-pool/cfg"
 	"xelis-pool/config"
 	"xelis-pool/database"
 	"xelis-pool/log"
+	"xelis-pool/rate_limit"
 
 	"github.com/gin-gonic/gin"
 	"github.com/xelis-project/xelis-go-sdk/wallet"
@@ -44,8 +50,19 @@ type PubWithdraw struct {
 	Destinations int     `json:"destinations"`
 }
 
+type WorkerStats struct {
+	Name      string  `json:"name"`
+	Hashrate  float64 `json:"hashrate"`
+	LastShare int64   `json:"last_share"` // UNIX timestamp
+	Chart     []Hr    `json:"hr_chart"`
+}
+
 var Coin float64
 
+const MAX_PAGE_SIZE = 500
+
+const MAX_PAYOUT_THRESHOLD = 1_000_000 // in coins
+
 func cors() gin.HandlerFunc {
 	return func(c *gin.Context) {
 		c.Writer.Header().Set("Access-Control-Allow-Origin", "*")
@@ -54,8 +71,6 @@ func cors() gin.HandlerFunc {
 }
 
 func StartApiServer() {
-	Coin = math.Pow10(cfg.Cfg.Atomic)
-
 	gin.SetMode("release")
 	r := gin.Default()
 
@@ -125,10 +140,6 @@ func StartApiServer() {
 			netDiff = 1
 		}
 
-		if math.IsInf(Stats.Hashes, 0) {
-			Stats.Hashes = 1
-		}
-
 		x := gin.H{
 			"pool_hr":             Stats.PoolHashrate,
 			"net_hr":              netHr,
@@ -148,9 +159,11 @@ func StartApiServer() {
 
 			"pplns_window_seconds": GetPplnsWindow(),
 			"withdrawals":          ws,
-			"hashes":               Stats.Hashes,
+			"hashes":               Stats.Round.Hashes,
 			"difficulty":           netDiff,
-			"effort":               Stats.Hashes / netDiff * 32,
+			"effort":               NotNan(Stats.Round.Effort),
+			"round_start":          Stats.Round.Start,
+			"round_shares":         Stats.Round.Shares,
 
 			// stats that do not change
 
@@ -162,81 +175,233 @@ func StartApiServer() {
 		c.JSON(200, x)
 	})
 
-	r.GET(prefix+"/stats/:addr", func(c *gin.Context) {
-		c.Header("Cache-Control", "max-age=10")
-
-		addrSpl := strings.Split(c.Param("addr"), "+")
+	addressRoutes(r.Group(prefix))
 
-		if len(addrSpl) == 0 {
+	// requests a custom payout threshold (in coins, 0 for the pool default).
+	// The address must prove its ownership by sending to the pool address a
+	// transfer with the returned code as extra data, then call /threshold/verify.
+	r.POST(prefix+"/stats/:addr/threshold", func(c *gin.Context) {
+		if !rate_limit.CanDoAction(c.ClientIP(), rate_limit.ACTION_THRESHOLD_REQUEST) {
+			tooManyRequests(c)
 			return
 		}
 
-		addr := addrSpl[0]
+		addr := c.Param("addr")
 
-		if (addr == cfg.Cfg.PoolAddress || addr == cfg.Cfg.FeeAddress) &&
-			(len(addrSpl) < 2 || addrSpl[1] != cfg.Cfg.MasterPass) {
+		if !address.IsAddressValid(addr) || addr == cfg.Cfg.PoolAddress || addr == cfg.Cfg.FeeAddress {
+			c.JSON(400, gin.H{
+				"error": gin.H{
+					"code":    3,
+					"message": "invalid address",
+				},
+			})
+			return
+		}
 
-			log.Debug("sending address not found for fee address")
+		threshold, err := strconv.ParseFloat(c.Query("threshold"), 64)
+		if err != nil || math.IsNaN(threshold) || math.IsInf(threshold, 0) || threshold < 0 || threshold > MAX_PAYOUT_THRESHOLD ||
+			(threshold != 0 && threshold < cfg.Cfg.Master.MinWithdrawal) {
 
-			c.JSON(404, gin.H{
+			c.JSON(400, gin.H{
 				"error": gin.H{
-					"code":    1, // address not found
-					"message": "address not found",
+					"code":    3,
+					"message": fmt.Sprintf("threshold must be 0 or between %g and %g", cfg.Cfg.Master.MinWithdrawal, float64(MAX_PAYOUT_THRESHOLD)),
 				},
 			})
+			return
+		}
 
+		req, err := requestThreshold(addr, uint64(threshold*Coin))
+		if err != nil {
+			log.Err(err)
+			c.JSON(500, gin.H{
+				"error": gin.H{
+					"code":    2,
+					"message": "internal server error",
+				},
+			})
 			return
 		}
 
-		addrInfo := database.AddrInfo{}
+		c.JSON(200, gin.H{
+			"threshold":    threshold,
+			"code":         req.Code,
+			"pool_address": cfg.Cfg.PoolAddress,
+			"expires":      req.Expires,
+		})
+	})
 
-		DB.Update(func(tx *bolt.Tx) error {
-			buck := tx.Bucket(database.ADDRESS_INFO)
+	r.POST(prefix+"/stats/:addr/threshold/verify", func(c *gin.Context) {
+		if !rate_limit.CanDoAction(c.ClientIP(), rate_limit.ACTION_THRESHOLD_REQUEST) {
+			tooManyRequests(c)
+			return
+		}
 
-			addrData := buck.Get([]byte(addr))
-			if addrData == nil {
-				return fmt.Errorf("unknown address %s", addr)
-			}
+		addr := c.Param("addr")
 
-			err := addrInfo.Deserialize(addrData)
-			if err != nil {
-				return err
+		threshold, err := verifyThreshold(addr)
+		if err != nil {
+			switch err {
+			case errNoThresholdRequest, errProofNotFound:
+				c.JSON(404, gin.H{
+					"error": gin.H{
+						"code":    5,
+						"message": err.Error(),
+					},
+				})
+			default:
+				log.Err(err)
+				c.JSON(500, gin.H{
+					"error": gin.H{
+						"code":    2,
+						"message": "internal server error",
+					},
+				})
 			}
+			return
+		}
+
+		c.JSON(200, gin.H{
+			"payout_threshold": Round6(float64(threshold) / Coin),
+		})
+	})
+
+	r.GET(prefix+"/blocks", func(c *gin.Context) {
+		c.Header("Cache-Control", "max-age=10")
+
+		before, limit, ok := parsePagination(c)
+		if !ok {
+			return
+		}
+
+		var blocks []BlockInfo
+		var total int
+
+		err := DB.View(func(tx *bolt.Tx) error {
+			total = tx.Bucket(database.BLOCKS).Stats().KeyN
 
-			if addrInfo.Balance > math.MaxUint64/2 {
-				log.Err("addrInfo.Balance is HUGE! address:", addr)
-				addrInfo.Balance = 0
-				return buck.Put([]byte(addr), addrInfo.Serialize())
+			for _, bl := range listBlocks(tx, before, limit) {
+				blocks = append(blocks, NewBlockInfo(bl))
 			}
+			return nil
+		})
+		if err != nil {
+			log.Err(err)
+			c.JSON(500, gin.H{
+				"error": gin.H{
+					"code":    2,
+					"message": "internal server error",
+				},
+			})
+			return
+		}
+
+		c.JSON(200, gin.H{
+			"total":  total,
+			"blocks": blocks,
+		})
+	})
+
+	r.GET(prefix+"/luck", func(c *gin.Context) {
+		c.Header("Cache-Control", "max-age=60")
+
+		var windows map[int]*Luck
+		var daily []DailyLuck
 
+		DB.View(func(tx *bolt.Tx) error {
+			windows, daily = poolLuck(tx, false)
 			return nil
 		})
 
+		res := gin.H{
+			"daily": daily,
+		}
+		for w, l := range windows {
+			res["last_"+strconv.Itoa(w)] = l
+		}
+
 		Stats.RLock()
-		defer Stats.RUnlock()
+		res["round_effort"] = NotNan(Stats.Round.Effort)
+		Stats.RUnlock()
 
-		uw := []UserWithdrawal{}
+		c.JSON(200, res)
+	})
 
-		for _, v := range Stats.RecentWithdrawals {
-			for _, v2 := range v.Destinations {
-				if v2.Destination == addr {
-					uw = append(uw, UserWithdrawal{
-						Amount: float64(v2.Amount) / Coin,
-						Txid:   v.Txid,
-						Time:   v.Timestamp,
-					})
-				}
+	r.GET(prefix+"/solo", func(c *gin.Context) {
+		c.Header("Cache-Control", "max-age=10")
+
+		var windows map[int]*Luck
+
+		DB.View(func(tx *bolt.Tx) error {
+			windows, _ = poolLuck(tx, true)
+			return nil
+		})
+
+		Stats.RLock()
+		res := gin.H{
+			"hashrate":            Stats.Solo.Hashrate,
+			"miners":              len(Stats.Solo.Miners),
+			"fee":                 cfg.Cfg.Master.SoloFeePercent,
+			"num_blocks_found":    Stats.Solo.NumFound,
+			"recent_blocks_found": Stats.Solo.BlocksFound,
+		}
+		Stats.RUnlock()
+
+		for w, l := range windows {
+			res["last_"+strconv.Itoa(w)] = l
+		}
+
+		c.JSON(200, res)
+	})
+
+	// what each address earned from a block
+	r.GET(prefix+"/blocks/:hash/rewards", func(c *gin.Context) {
+		c.Header("Cache-Control", "max-age=10")
+
+		var hash [32]byte
+		hashBin, err := hex.DecodeString(c.Param("hash"))
+		if err != nil || len(hashBin) != 32 {
+			c.JSON(400, gin.H{
+				"error": gin.H{
+					"code":    3,
+					"message": "invalid block hash",
+				},
+			})
+			return
+		}
+		copy(hash[:], hashBin)
+
+		var block *BlockInfo
+		rewards := []RewardInfo{}
+
+		DB.View(func(tx *bolt.Tx) error {
+			if _, bl, ok := findBlock(tx, hash); ok {
+				info := NewBlockInfo(bl)
+				block = &info
 			}
+			for _, v := range blockRewards(tx, hash) {
+				rewards = append(rewards, NewRewardInfo(v))
+			}
+			return nil
+		})
+
+		if block == nil && len(rewards) == 0 {
+			c.JSON(404, gin.H{
+				"error": gin.H{
+					"code":    4,
+					"message": "block not found",
+				},
+			})
+			return
 		}
 
+		slices.SortFunc(rewards, func(a, b RewardInfo) int {
+			return cmp.Compare(b.Amount, a.Amount)
+		})
+
 		c.JSON(200, gin.H{
-			"hashrate":        NotNan(Round0(Stats.GetHashrate(addr))),
-			"balance":         NotNan(Round6(float64(addrInfo.Balance) / Coin)),
-			"balance_pending": NotNan(Round6(float64(addrInfo.BalancePending) / Coin)),
-			"paid":            NotNan(Round6(float64(addrInfo.Paid) / Coin)),
-			"est_pending":     NotNan(Round6(GetEstPendingBalance(addr))),
-			"hr_chart":        Stats.HashrateCharts[addr],
-			"withdrawals":     uw,
+			"block":   block,
+			"rewards": rewards,
 		})
 	})
 
@@ -244,132 +409,321 @@ func StartApiServer() {
 		c.Header("Cache-Control", "max-age=3600")
 		c.JSON(200, gin.H{
 			"pool_fee_percent":  cfg.Cfg.Master.FeePercent,
+			"solo_fee_percent":  cfg.Cfg.Master.SoloFeePercent,
 			"payment_threshold": cfg.Cfg.Master.MinWithdrawal,
 		})
 	})
 
-	r.GET(prefix+"/admin/:pass/backup", func(ctx *gin.Context) {
-		pass := ctx.Param("pass")
-		if pass != cfg.Cfg.MasterPass {
-			ctx.String(404, "404")
+	err := r.Run("0.0.0.0:" + strconv.FormatInt(int64(cfg.Cfg.Master.ApiPort), 10))
+	if err != nil {
+		panic(err)
+	}
+}
+
+// addressRoutes registers the stats routes of an address. They are available
+// on the public API and on the admin API.
+func addressRoutes(r gin.IRoutes) {
+	r.GET("/stats/:addr", func(c *gin.Context) {
+		c.Header("Cache-Control", "max-age=10")
+
+		addr, ok := statsAddress(c)
+		if !ok {
 			return
 		}
 
-		err := DB.View(func(tx *bolt.Tx) error {
-			ctx.Header("Content-Type", "application/octet-stream")
-			ctx.Header("Content-Disposition", `attachment; filename="my.db"`)
-			ctx.Header("Content-Length", strconv.Itoa(int(tx.Size())))
-			_, err := tx.WriteTo(ctx.Writer)
-			return err
+		addrInfo := database.AddrInfo{}
+
+		DB.View(func(tx *bolt.Tx) error {
+			addrData := tx.Bucket(database.ADDRESS_INFO).Get([]byte(addr))
+			if addrData == nil {
+				return fmt.Errorf("unknown address %s", addr)
+			}
+
+			return addrInfo.Deserialize(addrData)
 		})
-		if err != nil {
-			ctx.String(500, "internal server error")
+
+		uw := []UserWithdrawal{}
+
+		DB.View(func(tx *bolt.Tx) error {
+			for _, v := range listPayouts(tx, addr, math.MaxUint64, 50) {
+				uw = append(uw, UserWithdrawal{
+					Amount: v.Amount,
+					Txid:   v.Txid,
+					Time:   v.Time,
+				})
+			}
+			return nil
+		})
+
+		Stats.RLock()
+		defer Stats.RUnlock()
+
+		var solo gin.H
+		if m, ok := Stats.Solo.Miners[addr]; ok {
+			solo = gin.H{
+				"hashrate":    NotNan(Round0(m.GetHashrate())),
+				"effort":      NotNan(m.Round.Effort),
+				"round_start": m.Round.Start,
+			}
 		}
+
+		c.JSON(200, gin.H{
+			"hashrate":         NotNan(Round0(Stats.GetHashrate(addr))),
+			"balance":          NotNan(Round6(float64(addrInfo.Balance) / Coin)),
+			"balance_pending":  NotNan(Round6(float64(addrInfo.BalancePending) / Coin)),
+			"paid":             NotNan(Round6(float64(addrInfo.Paid) / Coin)),
+			"payout_threshold": Round6(float64(payoutThreshold(addrInfo)) / Coin),
+			"est_pending":      NotNan(Round6(GetEstPendingBalance(addr))),
+			"hr_chart":         Stats.HashrateCharts[addr],
+			"num_workers":      len(Stats.KnownWorkers[addr]),
+			"withdrawals":      uw,
+			"solo":             solo,
+		})
 	})
 
-	r.GET(prefix+"/admin/:pass/withdrawals", func(ctx *gin.Context) {
-		pass := ctx.Param("pass")
-		if pass != cfg.Cfg.MasterPass {
-			ctx.String(404, "404")
+	// payouts of an address, as JSON or as CSV with format=csv
+	r.GET("/stats/:addr/payouts", func(c *gin.Context) {
+		c.Header("Cache-Control", "max-age=10")
+
+		addr, ok := statsAddress(c)
+		if !ok {
+			return
+		}
+
+		before, limit, ok := parsePagination(c)
+		if !ok {
 			return
 		}
 
-		Stats.Lock()
-		defer Stats.Unlock()
+		var payouts []PayoutInfo
+
+		DB.View(func(tx *bolt.Tx) error {
+			payouts = listPayouts(tx, addr, before, limit)
+			return nil
+		})
+
+		if c.Query("format") == "csv" {
+			c.Header("Content-Type", "text/csv")
+			c.Header("Content-Disposition", "attachment; filename=\"payouts.csv\"")
+			c.Status(200)
+
+			w := csv.NewWriter(c.Writer)
+
+			w.Write([]string{"time", "txid", "amount", "fee", "status"})
+			for _, v := range payouts {
+				w.Write([]string{
+					time.Unix(int64(v.Time), 0).UTC().Format(time.RFC3339),
+					v.Txid,
+					strconv.FormatFloat(v.Amount, 'f', -1, 64),
+					strconv.FormatFloat(v.Fee, 'f', -1, 64),
+					v.Status,
+				})
+			}
+			w.Flush()
+			if err := w.Error(); err != nil {
+				log.Warn("payouts csv:", err)
+			}
+			return
+		}
 
-		ctx.JSON(200, Stats.RecentWithdrawals)
+		c.JSON(200, gin.H{
+			"payouts": payouts,
+		})
 	})
 
-	r.GET(prefix+"/admin/:pass/", func(ctx *gin.Context) {
-		pass := ctx.Param("pass")
-		if pass != cfg.Cfg.MasterPass {
-			ctx.String(404, "404")
+	// block credits of an address
+	r.GET("/stats/:addr/rewards", func(c *gin.Context) {
+		c.Header("Cache-Control", "max-age=10")
+
+		addr, ok := statsAddress(c)
+		if !ok {
+			return
+		}
+
+		before, limit, ok := parsePagination(c)
+		if !ok {
 			return
 		}
 
-		var confirmed uint64 = 0
-		var pending uint64 = 0
+		rewards := []RewardInfo{}
 
 		DB.View(func(tx *bolt.Tx) error {
-			buck := tx.Bucket(database.ADDRESS_INFO)
+			for _, v := range addressRewards(tx, addr, before, limit) {
+				rewards = append(rewards, NewRewardInfo(v))
+			}
+			return nil
+		})
 
-			err := buck.ForEach(func(k, v []byte) error {
-				ai := database.AddrInfo{}
-				err := ai.Deserialize(v)
+		c.JSON(200, gin.H{
+			"rewards": rewards,
+		})
+	})
 
-				if err != nil {
-					log.Warn(err)
-					return err
-				}
+	// ledger entries which explain the balances of an address
+	r.GET("/stats/:addr/ledger", func(c *gin.Context) {
+		c.Header("Cache-Control", "max-age=10")
 
-				confirmed += ai.Balance
-				pending += ai.BalancePending
+		addr, ok := statsAddress(c)
+		if !ok {
+			return
+		}
 
-				return nil
-			})
-			if err != nil {
-				log.Err(err)
-			}
+		before, limit, ok := parsePagination(c)
+		if !ok {
+			return
+		}
 
-			return err
+		entries := []LedgerEntryInfo{}
+
+		DB.View(func(tx *bolt.Tx) error {
+			for _, v := range addressLedger(tx, addr, before, limit) {
+				entries = append(entries, NewLedgerEntryInfo(v, addr))
+			}
+			return nil
 		})
 
-		rpc := newWalletRPC()
-		balance, err := rpc.GetBalance(wallet.GetBalanceParams{
-			Asset: config.ASSET,
+		c.JSON(200, gin.H{
+			"entries": entries,
 		})
+	})
 
-		if err != nil {
-			log.Warn(err)
+	// manual balance adjustments of an address
+	r.GET("/stats/:addr/adjustments", func(c *gin.Context) {
+		c.Header("Cache-Control", "max-age=10")
+
+		addr, ok := statsAddress(c)
+		if !ok {
+			return
 		}
 
-		Stats.Lock()
-		defer Stats.Unlock()
+		before, limit, ok := parsePagination(c)
+		if !ok {
+			return
+		}
+
+		adjustments := []AdjustmentInfo{}
+
+		DB.View(func(tx *bolt.Tx) error {
+			for _, v := range addressAdjustments(tx, addr, before, limit) {
+				info := NewAdjustmentInfo(v)
+				if getAdminToken(c) == nil {
+					info.Admin = ""
+				}
+				adjustments = append(adjustments, info)
+			}
+			return nil
+		})
+
+		c.JSON(200, gin.H{
+			"adjustments": adjustments,
+		})
+	})
+
+	r.GET("/stats/:addr/workers", func(c *gin.Context) {
+		c.Header("Cache-Control", "max-age=10")
+
+		addr := c.Param("addr")
+
+		Stats.RLock()
+		defer Stats.RUnlock()
+
+		workers := make([]WorkerStats, 0, len(Stats.KnownWorkers[addr]))
 
-		var miners = make([]minerLog, 0, len(Stats.KnownAddresses))
+		for name, w := range Stats.KnownWorkers[addr] {
+			// GetHashrate resets LastShare of offline workers
+			lastShare := int64(w.LastShare)
 
-		for addr, v := range Stats.KnownAddresses {
-			miners = append(miners, minerLog{
-				Hashrate: v.GetHashrate(),
-				Wallet:   addr,
+			workers = append(workers, WorkerStats{
+				Name:      name,
+				Hashrate:  NotNan(Round0(w.GetHashrate())),
+				LastShare: lastShare,
+				Chart:     Stats.WorkerCharts[addr][name],
 			})
 		}
 
-		slices.SortFunc(miners, func(a, b minerLog) int {
-			d := b.Hashrate - a.Hashrate
+		slices.SortFunc(workers, func(a, b WorkerStats) int {
+			return strings.Compare(a.Name, b.Name)
+		})
 
-			if d > 0 {
-				return 1
-			} else if d < 0 {
-				return -1
-			}
-			return 0
+		c.JSON(200, gin.H{
+			"workers": workers,
 		})
+	})
+}
+
+// statsAddress returns the address of a stats request. The pool and fee
+// addresses are only visible on the admin API.
+func statsAddress(c *gin.Context) (string, bool) {
+	addr := c.Param("addr")
+
+	if (addr == cfg.Cfg.PoolAddress || addr == cfg.Cfg.FeeAddress) && getAdminToken(c) == nil {
+
+		log.Debug("sending address not found for fee address")
 
-		ctx.JSON(200, gin.H{
-			"ok":             true,
-			"bal_confirmed":  float64(confirmed) / Coin,
-			"bal_pending":    float64(pending) / Coin,
-			"bal_total":      float64(confirmed+pending) / Coin,
-			"bal_owned":      float64(balance) / Coin,
-			"debt":           (float64(confirmed+pending) - float64(balance)) / Coin,
-			"debt_confirmed": (float64(confirmed) - float64(balance)) / Coin,
-			"miners":         miners,
+		c.JSON(404, gin.H{
+			"error": gin.H{
+				"code":    1, // address not found
+				"message": "address not found",
+			},
 		})
+
+		return "", false
+	}
+
+	return addr, true
+}
+
+// tooManyRequests responds to a request refused by the rate limiter
+func tooManyRequests(c *gin.Context) {
+	c.JSON(429, gin.H{
+		"error": gin.H{
+			"code":    7,
+			"message": "too many requests",
+		},
 	})
+}
 
-	err := r.Run("0.0.0.0:" + strconv.FormatInt(int64(cfg.Cfg.Master.ApiPort), 10))
-	if err != nil {
-		panic(err)
+// parsePagination reads the "before" and "limit" query parameters. If they are
+// not valid, it sends an error response and returns ok = false.
+func parsePagination(c *gin.Context) (before uint64, limit int, ok bool) {
+	before = math.MaxUint64
+	limit = 50
+
+	var err error
+	if s := c.Query("before"); s != "" {
+		before, err = strconv.ParseUint(s, 10, 64)
+		if err != nil {
+			c.JSON(400, gin.H{
+				"error": gin.H{
+					"code":    3,
+					"message": "invalid before parameter",
+				},
+			})
+			return 0, 0, false
+		}
 	}
+	if s := c.Query("limit"); s != "" {
+		limit, err = strconv.Atoi(s)
+		if err != nil || limit <= 0 {
+			c.JSON(400, gin.H{
+				"error": gin.H{
+					"code":    3,
+					"message": "invalid limit parameter",
+				},
+			})
+			return 0, 0, false
+		}
+	}
+
+	return before, min(limit, MAX_PAGE_SIZE), true
 }
 
-func GetDebt() float64 {
-	var confirmed, pending uint64
-	err := DB.View(func(tx *bolt.Tx) error {
+// poolBalances returns the sum of the confirmed and pending balances of all the addresses
+func poolBalances() (confirmed, pending uint64, err error) {
+	err = DB.View(func(tx *bolt.Tx) error {
 		buck := tx.Bucket(database.ADDRESS_INFO)
 
-		err := buck.ForEach(func(k, v []byte) error {
+		return buck.ForEach(func(k, v []byte) error {
 			ai := database.AddrInfo{}
 			err := ai.Deserialize(v)
 
@@ -383,12 +737,13 @@ func GetDebt() float64 {
 
 			return nil
 		})
-		if err != nil {
-			log.Err(err)
-		}
-
-		return err
 	})
+
+	return
+}
+
+func GetDebt() float64 {
+	confirmed, pending, err := poolBalances()
 	if err != nil {
 		log.Err(err)
 		return 0
@@ -403,6 +758,12 @@ func GetDebt() float64 {
 		return 0
 	}
 
+	return debt(balance, confirmed, pending)
+}
+
+// debt returns the difference between the wallet balance and the balances of
+// the miners, in coins
+func debt(balance, confirmed, pending uint64) float64 {
 	if float64(balance) < 1 {
 		return 0
 	}
@@ -412,11 +773,6 @@ func GetDebt() float64 {
 	return debt / Coin
 }
 
-type minerLog struct {
-	Hashrate float64
-	Wallet   string
-}
-
 func NotNan(n float64) float64 {
 	if math.IsNaN(n) {
 		return 0
@@ -424,6 +780,13 @@ func NotNan(n float64) float64 {
 	return n
 }
 
+func NotInf(n float64) float64 {
+	if math.IsInf(n, 0) {
+		return 0
+	}
+	return n
+}
+
 func Round0(n float64) float64 {
 	return math.Round(n)
 }
@@ -0,0 +1,151 @@
+// Copyright (C) 2024 XELIS
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"xelis-pool/database"
+	"xelis-pool/link"
+	"xelis-pool/log"
+	"xelis-pool/serializer"
+	"xelis-pool/util"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// bans received from slaves are capped to this duration, in seconds
+const MAX_BAN_DURATION = 24 * 3600
+
+// OnBan stores a ban received from a slave and sends it to all the other slaves.
+// Stats must not be locked.
+func OnBan(connId uint64, ip string, ends uint64) {
+	ends = min(ends, util.Time()+MAX_BAN_DURATION)
+	if ends <= util.Time() || ip == "" {
+		return
+	}
+
+	Stats.RLock()
+	var slaveName string
+	if sl := slaves[connId]; sl != nil {
+		slaveName = sl.Name
+	}
+	conns := make([]*link.Conn, 0, len(slaves))
+	for id, v := range slaves {
+		// the slave which sent the ban has already applied it
+		if id != connId {
+			conns = append(conns, v.conn)
+		}
+	}
+	Stats.RUnlock()
+
+	log.Infof("slave %s banned %s until %d", slaveName, ip, ends)
+
+	err := DB.Update(func(tx *bolt.Tx) error {
+		buck := tx.Bucket(database.BANS)
+
+		ban := database.Ban{}
+		if banBin := buck.Get([]byte(ip)); banBin != nil {
+			err := ban.Deserialize(banBin)
+			if err != nil {
+				return err
+			}
+		}
+		if ban.Ends >= ends {
+			return nil
+		}
+
+		ban.Ends = ends
+		ban.Slave = slaveName
+
+		return buck.Put([]byte(ip), ban.Serialize())
+	})
+	if err != nil {
+		log.Err("failed to store ban:", err)
+	}
+
+	packet := banM2S{
+		Ip:      ip,
+		BanEnds: ends,
+	}.Serialize()
+	for _, c := range conns {
+		SendToConn(c, packet)
+	}
+}
+
+// sendBans sends the active bans to a slave which has just connected
+func sendBans(conn *link.Conn) {
+	var packets [][]byte
+
+	DB.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(database.BANS).ForEach(func(k, v []byte) error {
+			ban := database.Ban{}
+			err := ban.Deserialize(v)
+			if err != nil || ban.Ends <= util.Time() {
+				return nil
+			}
+
+			packets = append(packets, banM2S{
+				Ip:      string(k),
+				BanEnds: ban.Ends,
+			}.Serialize())
+			return nil
+		})
+	})
+
+	log.Debug("sending", len(packets), "bans to slave")
+
+	for _, v := range packets {
+		SendToConn(conn, v)
+	}
+}
+
+// cleanupBans removes the expired bans
+func cleanupBans(tx *bolt.Tx) (removed int) {
+	buck := tx.Bucket(database.BANS)
+
+	var expired [][]byte
+	buck.ForEach(func(k, v []byte) error {
+		ban := database.Ban{}
+		err := ban.Deserialize(v)
+		if err != nil || ban.Ends <= util.Time() {
+			expired = append(expired, bytes.Clone(k))
+		}
+		return nil
+	})
+
+	for _, k := range expired {
+		buck.Delete(k)
+	}
+
+	return len(expired)
+}
+
+// ban master to server packet
+type banM2S struct {
+	Ip      string
+	BanEnds uint64
+}
+
+func (b banM2S) Serialize() []byte {
+	s := serializer.Serializer{
+		Data: []byte{0}, // packet MasterToSlave id 0
+	}
+
+	s.AddString(b.Ip)
+	s.AddUint64(b.BanEnds)
+
+	return s.Data
+}
@@ -16,16 +16,21 @@
 package main
 
 import (
+	"encoding/hex"
 	"strings"
 	"time"
 	"xelis-pool/cfg"
+	"xelis-pool/database"
 	"xelis-pool/log"
+	"xelis-pool/util"
 
 	"github.com/disgoorg/disgo/discord"
 	"github.com/xelis-project/xelis-go-sdk/daemon"
+	bolt "go.etcd.io/bbolt"
 )
 
-func OnBlockFound(hash string) {
+// OnBlockFound adds a block found by the pool, or by a solo miner if solo is true
+func OnBlockFound(hash string, finder string, solo bool) {
 	bl, err := newDaemonRPC().GetBlockByHash(daemon.GetBlockByHashParams{
 		Hash:       hash,
 		IncludeTxs: false,
@@ -40,33 +45,81 @@ func OnBlockFound(hash string) {
 	}
 
 	Stats.Lock()
-	defer Stats.Unlock()
 
 	if bl.Height == 0 {
 		bl.Height = Stats.LastBlock.Height + 1
 	}
 
-	Stats.LastBlock = LastBlock{
-		Height:    bl.Height,
-		Timestamp: time.Now().Unix(),
-		Reward:    *bl.MinerReward,
-		Hash:      hash,
-	}
-	effort := Stats.Hashes / Stats.Difficulty * 32
-	Stats.BlocksFound = append([]FoundInfo{{
+	var round Round
+	foundInfo := FoundInfo{
 		Height: bl.Height,
 		Hash:   hash,
-		Effort: float32(effort),
 		Time:   uint64(time.Now().Unix()),
-	}}, Stats.BlocksFound...)
-	Stats.NumFound++
-	Stats.Hashes = 0
+	}
+
+	if solo {
+		round = Stats.endSoloRound(finder)
+		foundInfo.Effort = float32(round.Effort)
+
+		Stats.Solo.BlocksFound = append([]FoundInfo{foundInfo}, Stats.Solo.BlocksFound...)
+		Stats.Solo.NumFound++
+	} else {
+		Stats.LastBlock = LastBlock{
+			Height:    bl.Height,
+			Timestamp: time.Now().Unix(),
+			Reward:    *bl.MinerReward,
+			Hash:      hash,
+		}
+
+		round = Stats.Round
+		foundInfo.Effort = float32(round.Effort)
+
+		Stats.BlocksFound = append([]FoundInfo{foundInfo}, Stats.BlocksFound...)
+		Stats.NumFound++
+		Stats.Round = Round{
+			Start: util.Time(),
+		}
+	}
+	effort := round.Effort
 
 	Stats.Cleanup()
+	Stats.Unlock()
+
+	// Stats must be unlocked before updating the database
+	hashBin, hexErr := hex.DecodeString(hash)
+	if hexErr != nil || len(hashBin) != 32 {
+		log.Err("invalid block hash", hash)
+	} else {
+		err := DB.Update(func(tx *bolt.Tx) error {
+			return storeFoundBlock(tx, database.Block{
+				Height: bl.Height,
+				Hash:   [32]byte(hashBin),
+				Finder: finder,
+				Effort: float32(effort),
+				Reward: *bl.MinerReward,
+				Type:   bl.BlockType,
+				Status: database.BLOCK_PENDING,
+				Time:   uint64(time.Now().Unix()),
+
+				RoundStart:  round.Start,
+				RoundShares: round.Shares,
+				RoundHashes: uint64(round.Hashes),
+
+				Solo: solo,
+			})
+		})
+		if err != nil {
+			log.Err(err)
+		}
+	}
 
 	if discordWebhook != nil {
+		kind := ""
+		if solo {
+			kind = "solo "
+		}
 		_, err = discordWebhook.CreateEmbeds([]discord.Embed{discord.NewEmbedBuilder().
-			SetTitlef("%s block found at height %d", strings.ToUpper(cfg.Cfg.AddressPrefix), bl.Height).
+			SetTitlef("%s %sblock found at height %d", strings.ToUpper(cfg.Cfg.AddressPrefix), kind, bl.Height).
 			SetDescriptionf("Hash: %s\nEffort: %f %%", hash, effort*100).
 			Build(),
 		})
@@ -0,0 +1,351 @@
+// Copyright (C) 2024 XELIS
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"xelis-pool/database"
+	"xelis-pool/log"
+	"xelis-pool/util"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+type BlockInfo struct {
+	Height uint64  `json:"height"`
+	Hash   string  `json:"hash"`
+	Finder string  `json:"finder"`
+	Effort float32 `json:"effort"` // 1 = 100% effort
+	Reward float64 `json:"reward"`
+	Type   string  `json:"type"`
+	Status string  `json:"status"`
+	Time   uint64  `json:"time"` // UNIX timestamp
+	Solo   bool    `json:"solo"`
+
+	RoundShares   uint64 `json:"round_shares,omitempty"`
+	RoundHashes   uint64 `json:"round_hashes,omitempty"`
+	RoundDuration uint64 `json:"round_duration,omitempty"` // seconds
+}
+
+func NewBlockInfo(b database.Block) BlockInfo {
+	return BlockInfo{
+		Height: b.Height,
+		Hash:   hex.EncodeToString(b.Hash[:]),
+		Finder: b.Finder,
+		Effort: b.Effort,
+		Reward: Round6(float64(b.Reward) / Coin),
+		Type:   b.Type,
+		Status: b.Status.String(),
+		Time:   b.Time,
+		Solo:   b.Solo,
+
+		RoundShares:   b.RoundShares,
+		RoundHashes:   b.RoundHashes,
+		RoundDuration: roundDuration(b),
+	}
+}
+
+func roundDuration(b database.Block) uint64 {
+	if b.RoundStart == 0 || b.RoundStart > b.Time {
+		return 0
+	}
+	return b.Time - b.RoundStart
+}
+
+// findBlock returns the key and the data of the block with the given hash
+func findBlock(tx *bolt.Tx, hash [32]byte) ([]byte, database.Block, bool) {
+	key := tx.Bucket(database.BLOCK_INDEX).Get(hash[:])
+	if key == nil {
+		return nil, database.Block{}, false
+	}
+
+	v := tx.Bucket(database.BLOCKS).Get(key)
+	if v == nil {
+		log.Errf("block %x is in the index, but not in the blocks history", hash)
+		return nil, database.Block{}, false
+	}
+
+	bl := database.Block{}
+	err := bl.Deserialize(v)
+	if err != nil {
+		log.Err("error reading block:", err)
+		return nil, bl, false
+	}
+
+	return bytes.Clone(key), bl, true
+}
+
+// storeBlock adds or replaces a block in the BLOCKS bucket
+func storeBlock(tx *bolt.Tx, bl database.Block) error {
+	buck := tx.Bucket(database.BLOCKS)
+	index := tx.Bucket(database.BLOCK_INDEX)
+
+	// the height may have changed, remove the old entry
+	if oldKey := index.Get(bl.Hash[:]); oldKey != nil {
+		err := buck.Delete(oldKey)
+		if err != nil {
+			return err
+		}
+	}
+
+	key := database.BlockKey(bl.Height, bl.Hash)
+	err := index.Put(bl.Hash[:], key)
+	if err != nil {
+		return err
+	}
+
+	return buck.Put(key, bl.Serialize())
+}
+
+// storeFoundBlock stores a block reported by a slave. The wallet may have
+// received its reward first, in which case the status and the pool fee set by
+// UpdatePendingBals are kept.
+func storeFoundBlock(tx *bolt.Tx, bl database.Block) error {
+	if _, old, ok := findBlock(tx, bl.Hash); ok {
+		bl.Status = old.Status
+		bl.PoolFee = old.PoolFee
+	}
+
+	return storeBlock(tx, bl)
+}
+
+// indexBlocks fills the BLOCK_INDEX bucket if it's empty, for the databases
+// created before it existed
+func indexBlocks(tx *bolt.Tx) error {
+	index := tx.Bucket(database.BLOCK_INDEX)
+	if k, _ := index.Cursor().First(); k != nil {
+		return nil
+	}
+
+	n := 0
+	err := tx.Bucket(database.BLOCKS).ForEach(func(k, v []byte) error {
+		n++
+		return index.Put(bytes.Clone(k[8:]), bytes.Clone(k))
+	})
+	if n != 0 {
+		log.Info("indexed", n, "blocks")
+	}
+
+	return err
+}
+
+// updateBlockStatus updates the status of a block. If the block is not in the
+// BLOCKS bucket (e.g. it was found while the master was offline), it's added.
+// The finder of an orphaned block is forgotten, as it will never be paid.
+func updateBlockStatus(tx *bolt.Tx, hash [32]byte, status database.BlockStatus, update func(bl *database.Block)) error {
+	_, bl, ok := findBlock(tx, hash)
+	if !ok {
+		log.Warnf("block %x is not in the blocks history, adding it", hash)
+		bl.Hash = hash
+	}
+
+	if status == database.BLOCK_ORPHANED {
+		err := tx.Bucket(database.FOUND_BY).Delete(hash[:])
+		if err != nil {
+			return err
+		}
+		err = tx.Bucket(database.SOLO_FOUND).Delete(hash[:])
+		if err != nil {
+			return err
+		}
+	}
+
+	bl.Status = status
+	if update != nil {
+		update(&bl)
+	}
+
+	return storeBlock(tx, bl)
+}
+
+// A block whose reward hasn't been received by the wallet after this many
+// seconds is orphaned
+const BLOCK_UNREPORTED_EXPIRY = 24 * 3600
+
+// cleanupFoundBy marks as orphaned the blocks whose reward has never been
+// received by the wallet, and removes their finder. It returns the number of
+// blocks orphaned.
+func cleanupFoundBy(tx *bolt.Tx) int {
+	var hashes [][32]byte
+	tx.Bucket(database.FOUND_BY).ForEach(func(k, v []byte) error {
+		if len(k) == 32 {
+			hashes = append(hashes, [32]byte(k))
+		}
+		return nil
+	})
+
+	n := 0
+	for _, hash := range hashes {
+		_, bl, ok := findBlock(tx, hash)
+		if ok && bl.Time+BLOCK_UNREPORTED_EXPIRY > util.Time() {
+			continue
+		}
+
+		log.Warnf("the reward of block %x has never been received, accounting it as orphaned", hash)
+		err := updateBlockStatus(tx, hash, database.BLOCK_ORPHANED, nil)
+		if err != nil {
+			log.Err(err)
+			continue
+		}
+		n++
+	}
+
+	return n
+}
+
+// listBlocks returns at most limit blocks with height lower than before,
+// from the newest to the oldest
+func listBlocks(tx *bolt.Tx, before uint64, limit int) []database.Block {
+	blocks := make([]database.Block, 0, limit)
+
+	c := tx.Bucket(database.BLOCKS).Cursor()
+
+	k, v := c.Seek(database.BlockKey(before, [32]byte{}))
+	if k == nil {
+		k, v = c.Last()
+	} else {
+		k, v = c.Prev()
+	}
+
+	for ; k != nil && len(blocks) < limit; k, v = c.Prev() {
+		bl := database.Block{}
+		err := bl.Deserialize(v)
+		if err != nil {
+			log.Err("error reading block:", err)
+			continue
+		}
+
+		blocks = append(blocks, bl)
+	}
+
+	return blocks
+}
+
+type RewardInfo struct {
+	Hash       string  `json:"hash"`
+	Height     uint64  `json:"height"`
+	Address    string  `json:"address"`
+	Amount     float64 `json:"amount"`     // amount assigned by the reward scheme
+	Multiplier float64 `json:"multiplier"` // applied when the block matured
+	Credited   float64 `json:"credited"`   // amount added to the balance
+	Time       uint64  `json:"time"`       // UNIX timestamp, 0 if not credited yet
+}
+
+func NewRewardInfo(r database.BlockReward) RewardInfo {
+	return RewardInfo{
+		Hash:       hex.EncodeToString(r.Hash[:]),
+		Height:     r.Height,
+		Address:    r.Address,
+		Amount:     Round6(float64(r.Amount) / Coin),
+		Multiplier: r.Multiplier,
+		Credited:   Round6(float64(r.Credited) / Coin),
+		Time:       r.Time,
+	}
+}
+
+// storeBlockReward stores the credit of an address, indexed both by block and by address
+func storeBlockReward(tx *bolt.Tx, r database.BlockReward) error {
+	data := r.Serialize()
+
+	err := tx.Bucket(database.BLOCK_REWARDS).Put(database.BlockRewardKey(r.Hash, r.Address), data)
+	if err != nil {
+		return err
+	}
+
+	return tx.Bucket(database.ADDRESS_REWARDS).Put(database.AddressRewardKey(r.Address, r.Time, r.Hash), data)
+}
+
+// blockRewards returns the credits of a block. If the block hasn't matured
+// yet, the pending balances are returned with no credit.
+func blockRewards(tx *bolt.Tx, hash [32]byte) []database.BlockReward {
+	var rewards []database.BlockReward
+
+	c := tx.Bucket(database.BLOCK_REWARDS).Cursor()
+	for k, v := c.Seek(hash[:]); k != nil && bytes.HasPrefix(k, hash[:]); k, v = c.Next() {
+		r := database.BlockReward{}
+		err := r.Deserialize(v)
+		if err != nil {
+			log.Err("error reading block reward:", err)
+			continue
+		}
+		rewards = append(rewards, r)
+	}
+
+	if len(rewards) != 0 {
+		return rewards
+	}
+
+	pendingBin := tx.Bucket(database.PENDING).Get([]byte("pending"))
+	if pendingBin == nil {
+		return rewards
+	}
+
+	pending := database.PendingBals{}
+	err := pending.Deserialize(pendingBin)
+	if err != nil {
+		log.Err("error reading pending balances:", err)
+		return rewards
+	}
+
+	for _, v := range pending.UnconfirmedTxs {
+		if v.TxnBlockHash != hash {
+			continue
+		}
+
+		_, bl, _ := findBlock(tx, hash)
+		for addr, amount := range v.Bals {
+			rewards = append(rewards, database.BlockReward{
+				Hash:    hash,
+				Height:  bl.Height,
+				Address: addr,
+				Amount:  amount,
+			})
+		}
+	}
+
+	return rewards
+}
+
+// addressRewards returns at most limit credits of an address older than before,
+// from the newest to the oldest
+func addressRewards(tx *bolt.Tx, address string, before uint64, limit int) []database.BlockReward {
+	rewards := make([]database.BlockReward, 0, min(limit, 50))
+
+	prefix := append([]byte(address), 0)
+
+	c := tx.Bucket(database.ADDRESS_REWARDS).Cursor()
+
+	k, v := c.Seek(database.AddressRewardKey(address, before, [32]byte{}))
+	if k == nil {
+		k, v = c.Last()
+	} else {
+		k, v = c.Prev()
+	}
+
+	for ; k != nil && bytes.HasPrefix(k, prefix) && len(rewards) < limit; k, v = c.Prev() {
+		r := database.BlockReward{}
+		err := r.Deserialize(v)
+		if err != nil {
+			log.Err("error reading block reward:", err)
+			continue
+		}
+
+		rewards = append(rewards, r)
+	}
+
+	return rewards
+}
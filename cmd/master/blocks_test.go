@@ -0,0 +1,93 @@
+// Copyright (C) 2024 XELIS
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"testing"
+	"xelis-pool/database"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+func TestStoreFoundBlock(t *testing.T) {
+	var hash [32]byte
+	hash[0] = 1
+
+	found := database.Block{
+		Height: 10,
+		Hash:   hash,
+		Finder: "xel:miner",
+		Effort: 1.5,
+		Reward: 1000,
+		Type:   "normal",
+		Status: database.BLOCK_PENDING,
+		Time:   1000,
+	}
+
+	tests := []struct {
+		name    string
+		before  func(tx *bolt.Tx) error // run before the slave reports the block
+		status  database.BlockStatus
+		poolFee uint64
+	}{
+		{"reported first", nil, database.BLOCK_PENDING, 0},
+		{"reward received first", func(tx *bolt.Tx) error {
+			return updateBlockStatus(tx, hash, database.BLOCK_PENDING, func(bl *database.Block) {
+				bl.PoolFee = 10
+			})
+		}, database.BLOCK_PENDING, 10},
+		{"orphaned first", func(tx *bolt.Tx) error {
+			return updateBlockStatus(tx, hash, database.BLOCK_ORPHANED, nil)
+		}, database.BLOCK_ORPHANED, 0},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			newTestDB(t)
+
+			err := DB.Update(func(tx *bolt.Tx) error {
+				if test.before != nil {
+					err := test.before(tx)
+					if err != nil {
+						return err
+					}
+				}
+				return storeFoundBlock(tx, found)
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			DB.View(func(tx *bolt.Tx) error {
+				if n := tx.Bucket(database.BLOCKS).Stats().KeyN; n != 1 {
+					t.Errorf("%d blocks stored", n)
+				}
+
+				_, bl, ok := findBlock(tx, hash)
+				if !ok {
+					t.Fatal("block not found")
+				}
+				if bl.Status != test.status || bl.PoolFee != test.poolFee {
+					t.Errorf("status %s pool fee %d, expected %s %d", bl.Status, bl.PoolFee, test.status, test.poolFee)
+				}
+				if bl.Height != found.Height || bl.Finder != found.Finder || bl.Effort != found.Effort || bl.Time != found.Time {
+					t.Errorf("block is %+v, expected the reported block", bl)
+				}
+				return nil
+			})
+		})
+	}
+}
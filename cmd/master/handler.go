@@ -16,64 +16,76 @@
 package main
 
 import (
-	"encoding/binary"
 	"encoding/hex"
-	"io"
 	"net"
+	"slices"
 	"time"
+	"xelis-pool/address"
+	"xelis-pool/cfg"
+	"xelis-pool/config"
+	"xelis-pool/database"
+	"xelis-pool/link"
 	"xelis-pool/log"
 	"xelis-pool/serializer"
 	"xelis-pool/util"
+
+	bolt "go.etcd.io/bbolt"
 )
 
-const Overhead = 40
+type SlaveInfo struct {
+	Name      string `json:"name"`
+	Region    string `json:"region"`
+	Addr      string `json:"addr"`
+	Legacy    bool   `json:"legacy"`    // slave uses the v1 protocol
+	Connected uint64 `json:"connected"` // UNIX timestamp
+	Miners    uint32 `json:"miners"`
+	Sent      uint64 `json:"sent"`     // messages sent to the slave
+	Received  uint64 `json:"received"` // messages received from the slave
+
+	conn *link.Conn
+}
 
-// numConns is locked by the mutex of Stats
-var numConns = make(map[uint64]uint32)
+// slaves is locked by the mutex of Stats
+var slaves = make(map[uint64]*SlaveInfo)
 
-func HandleSlave(conn net.Conn) {
+func HandleSlave(c net.Conn) {
 	var connId uint64 = util.RandomUint64()
 
-	for {
-		lenBuf := make([]byte, 2+Overhead)
-		_, err := io.ReadFull(conn, lenBuf)
-		if err != nil {
-			log.Warn(err)
-			conn.Close()
-			Stats.Lock()
-			delete(numConns, connId)
-			Stats.Unlock()
-			return
-		}
-		lenBuf, err = Decrypt(lenBuf)
-		if err != nil {
-			log.Warn(err)
-			conn.Close()
-			Stats.Lock()
-			delete(numConns, connId)
-			Stats.Unlock()
-			return
-		}
-		len := int(lenBuf[0]) | (int(lenBuf[1]) << 8)
+	conn, hello, err := link.Server(c, cfg.MasterPass, cfg.Cfg.Master.AllowLegacySlaves)
+	if err != nil {
+		log.Warn("slave", c.RemoteAddr().String(), "handshake failed:", err)
+		c.Close()
+		return
+	}
 
-		// read the actual message
+	if conn.Legacy() {
+		log.Warn("slave", c.RemoteAddr().String(), "is using the legacy v1 protocol")
+	}
+	if hello.Name == "" {
+		hello.Name = c.RemoteAddr().String()
+	}
+	log.Info("slave", hello.Name, "region", hello.Region, "connected from", c.RemoteAddr().String())
 
-		buf := make([]byte, len+Overhead)
-		_, err = io.ReadFull(conn, buf)
-		if err != nil {
-			log.Warn(err)
-			conn.Close()
-			Stats.Lock()
-			delete(numConns, connId)
-			Stats.Unlock()
-			return
-		}
-		buf, err = Decrypt(buf)
+	Stats.Lock()
+	slaves[connId] = &SlaveInfo{
+		Name:      hello.Name,
+		Region:    hello.Region,
+		Addr:      c.RemoteAddr().String(),
+		Legacy:    conn.Legacy(),
+		Connected: util.Time(),
+		conn:      conn,
+	}
+	Stats.Unlock()
+
+	sendBans(conn)
+
+	for {
+		buf, err := conn.Read()
 		if err != nil {
-			log.Warn(err)
+			log.Warn("slave", hello.Name, "disconnected:", err)
 			conn.Close()
 			Stats.Lock()
-			delete(numConns, connId)
+			delete(slaves, connId)
 			Stats.Unlock()
 			return
 		}
@@ -82,15 +94,15 @@ func HandleSlave(conn net.Conn) {
 	}
 }
 
-func SendToConn(conn net.Conn, data []byte) {
-	var dataLenBin = make([]byte, 0, 2)
-	dataLenBin = binary.LittleEndian.AppendUint16(dataLenBin, uint16(len(data)))
-	conn.Write(Encrypt(dataLenBin))
-	conn.Write(Encrypt(data))
+func SendToConn(conn *link.Conn, data []byte) {
+	err := conn.Write(data)
+	if err != nil {
+		log.Warn("failed to send message to slave:", err)
+	}
 }
 
 // Stats MUST NOT be locked before calling this
-func OnMessage(msg []byte, connId uint64, conn net.Conn) {
+func OnMessage(msg []byte, connId uint64, conn *link.Conn) {
 	d := serializer.Deserializer{
 		Data: msg,
 	}
@@ -107,24 +119,70 @@ func OnMessage(msg []byte, connId uint64, conn net.Conn) {
 		wallet := d.ReadString()
 		diff := d.ReadUvarint()
 
+		// older slaves don't send the worker name
+		worker := "x"
+		if len(d.Data) > 0 {
+			worker = d.ReadString()
+		}
+
 		if d.Error != nil {
 			log.Err(d.Error)
 			return
 		}
 
-		OnShareFound(conn.RemoteAddr().String(), wallet, diff, numShares)
+		OnShareFound(conn.RemoteAddr().String(), wallet, worker, diff, numShares)
 	case 1: // Block Found packet
-		hash := hex.EncodeToString(d.ReadFixedByteArray(32))
+		hashBin := d.ReadFixedByteArray(32)
+
+		// older slaves don't send the finder address and the solo flag
+		var finder string
+		if len(d.Data) > 0 {
+			finder = d.ReadString()
+		}
+		var solo bool
+		if len(d.Data) > 0 {
+			solo = d.ReadBool()
+		}
 
 		if d.Error != nil {
 			log.Err(d.Error)
 			return
 		}
 
-		log.Info("Found block with hash", hash)
+		hash := hex.EncodeToString(hashBin)
+
+		log.Info("Found block with hash", hash, "finder", finder, "solo", solo)
+
+		// the slave only checks the address format, a wrong finder would lock
+		// the reward of the block
+		if finder != "" && (!address.IsAddressValid(finder) || slices.Contains(config.BANNED_ADDRESSES, finder)) {
+			log.Err("finder", finder, "of block", hash, "is not valid or banned, ignoring it")
+			finder = ""
+		}
+
+		if solo && finder == "" {
+			log.Err("solo block", hash, "has no finder, paying it to the pool")
+			solo = false
+		}
+
+		if finder != "" {
+			err := DB.Update(func(tx *bolt.Tx) error {
+				if solo {
+					err := tx.Bucket(database.SOLO_FOUND).Put(hashBin, []byte(finder))
+					if err != nil {
+						return err
+					}
+				}
+				return tx.Bucket(database.FOUND_BY).Put(hashBin, []byte(finder))
+			})
+			if err != nil {
+				log.Err(err)
+			}
+		}
+
 		go func() {
 			time.Sleep(10 * time.Second) // add delay to allow daemon to process the block
-			OnBlockFound(hash)
+			OnBlockFound(hash, finder, solo)
 		}()
 	case 2: // Stats packet
 		conns := uint32(d.ReadUvarint())
@@ -135,42 +193,74 @@ func OnMessage(msg []byte, connId uint64, conn net.Conn) {
 		}
 
 		Stats.Lock()
-		numConns[connId] = conns
+		if sl := slaves[connId]; sl != nil {
+			sl.Miners = conns
+		}
 		Stats.Workers = 0
-		for _, v := range numConns {
-			Stats.Workers += v
+		for _, v := range slaves {
+			Stats.Workers += v.Miners
 		}
 		Stats.Unlock()
+	case 5: // Share Batch packet
+		spoolId := d.ReadUint64()
+		batchId := d.ReadUvarint()
+		batchTime := d.ReadUvarint()
+		numEntries := d.ReadUvarint()
+
+		if d.Error != nil {
+			log.Err(d.Error)
+			return
+		}
+
+		shares := make([]BatchShare, 0, min(numEntries, 1000))
+		shares = readBatchShares(&d, shares, numEntries, false)
+
+		// older slaves don't send solo shares
+		if len(d.Data) > 0 && d.Error == nil {
+			numSolo := d.ReadUvarint()
+			shares = readBatchShares(&d, shares, numSolo, true)
+		}
+
+		if d.Error != nil {
+			log.Err(d.Error)
+			return
+		}
+
+		err := OnShareBatch(conn.RemoteAddr().String(), spoolId, batchId, batchTime, shares)
+		if err != nil {
+			log.Err("failed to store share batch:", err)
+			return
+		}
+
+		SendToConn(conn, batchAckM2S{
+			SpoolId: spoolId,
+			BatchId: batchId,
+		}.Serialize())
 	case 4: // Ban
 		bannedIp := d.ReadString()
 		banEnds := d.ReadUint64()
 
-		Stats.Lock()
+		if d.Error != nil {
+			log.Warn(d.Error)
+			return
+		}
 
-		SendToConn(conn, banM2S{
-			Ip:      bannedIp,
-			BanEnds: banEnds,
-		}.Serialize())
-		Stats.Unlock()
+		OnBan(connId, bannedIp, banEnds)
 	default:
 		log.Err("unknown packet type", packet)
 		return
 	}
 }
 
-// ban master to server packet
-type banM2S struct {
-	Ip      string
-	BanEnds uint64
-}
-
-func (b banM2S) Serialize() []byte {
-	s := serializer.Serializer{
-		Data: []byte{0}, // packet MasterToSlave id 0
+func readBatchShares(d *serializer.Deserializer, shares []BatchShare, n uint64, solo bool) []BatchShare {
+	for i := uint64(0); i < n && d.Error == nil; i++ {
+		shares = append(shares, BatchShare{
+			Wallet:    d.ReadString(),
+			Worker:    d.ReadString(),
+			NumShares: uint32(d.ReadUvarint()),
+			Diff:      d.ReadUvarint(),
+			Solo:      solo,
+		})
 	}
-
-	s.AddString(b.Ip)
-	s.AddUint64(b.BanEnds)
-
-	return s.Data
+	return shares
 }
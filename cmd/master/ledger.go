@@ -0,0 +1,583 @@
+// Copyright (C) 2024 XELIS
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+	"xelis-pool/cfg"
+	"xelis-pool/config"
+	"xelis-pool/database"
+	"xelis-pool/log"
+	"xelis-pool/util"
+
+	"github.com/xelis-project/xelis-go-sdk/wallet"
+	bolt "go.etcd.io/bbolt"
+)
+
+// Every balance movement is a ledger entry whose debits and credits are equal:
+// the amounts move from the debited accounts to the credited ones. The
+// balances of an address are accounts named "<type>:<address>", and
+// AddrInfo.Balance, BalancePending and Paid are the sums of their postings
+// (credits minus debits). They are only changed by postEntry.
+
+// account types of an address
+const (
+	ACCOUNT_BALANCE = "balance" // AddrInfo.Balance
+	ACCOUNT_PENDING = "pending" // AddrInfo.BalancePending
+	ACCOUNT_PAID    = "paid"    // AddrInfo.Paid
+)
+
+// accounts of the pool
+const (
+	ACCOUNT_BLOCKS          = "blocks"          // rewards of the blocks found
+	ACCOUNT_POOL            = "pool"            // funds owned by the pool
+	ACCOUNT_NETWORK_FEES    = "network_fees"    // transaction fees of the withdrawals
+	ACCOUNT_WITHDRAWAL_FEES = "withdrawal_fees" // withdrawal fees paid by the miners
+	ACCOUNT_ADJUSTMENTS     = "adjustments"
+	ACCOUNT_DEPOSITS        = "deposits"
+	ACCOUNT_OPENING         = "opening" // balances which existed before the ledger
+	ACCOUNT_PPS             = "pps"     // shares paid from the reserve of the pool
+)
+
+var errNegativeBalance = errors.New("balance would become negative")
+
+type PostingInfo struct {
+	Account string  `json:"account"`
+	Amount  float64 `json:"amount"` // negative for debits
+}
+
+type LedgerEntryInfo struct {
+	Id       uint64        `json:"id"`
+	Kind     string        `json:"kind"`
+	Ref      string        `json:"ref"`
+	Time     uint64        `json:"time"`
+	Postings []PostingInfo `json:"postings"`
+}
+
+// NewLedgerEntryInfo returns the API representation of an entry. If addr isn't
+// empty, only the postings of its accounts are included.
+func NewLedgerEntryInfo(e database.LedgerEntry, addr string) LedgerEntryInfo {
+	info := LedgerEntryInfo{
+		Id:       e.Id,
+		Kind:     e.Kind.String(),
+		Ref:      e.Ref,
+		Time:     e.Time,
+		Postings: make([]PostingInfo, 0, len(e.Postings)),
+	}
+
+	for _, p := range e.Postings {
+		if _, a, _ := strings.Cut(p.Account, ":"); addr != "" && a != addr {
+			continue
+		}
+
+		amount := Round6(float64(p.Amount) / Coin)
+		if p.Debit {
+			amount = -amount
+		}
+		info.Postings = append(info.Postings, PostingInfo{
+			Account: p.Account,
+			Amount:  amount,
+		})
+	}
+
+	return info
+}
+
+func addrAccount(typ, addr string) string {
+	return typ + ":" + addr
+}
+
+func credit(account string, amount uint64) database.Posting {
+	return database.Posting{
+		Account: account,
+		Amount:  amount,
+	}
+}
+
+func debit(account string, amount uint64) database.Posting {
+	return database.Posting{
+		Account: account,
+		Amount:  amount,
+		Debit:   true,
+	}
+}
+
+// postEntry stores a ledger entry and applies it to the balances of the
+// addresses. Postings of 0 are removed, and nothing is stored if none is
+// left. It fails if the entry is unbalanced or if a balance would become
+// negative.
+func postEntry(tx *bolt.Tx, e *database.LedgerEntry) error {
+	var debits, credits uint64
+	postings := make([]database.Posting, 0, len(e.Postings))
+	for _, p := range e.Postings {
+		if p.Amount == 0 {
+			continue
+		}
+		if p.Debit {
+			debits += p.Amount
+		} else {
+			credits += p.Amount
+		}
+		postings = append(postings, p)
+	}
+	e.Postings = postings
+
+	if debits != credits {
+		return fmt.Errorf("unbalanced %s ledger entry %s: debits %d, credits %d", e.Kind, e.Ref, debits, credits)
+	}
+	if len(e.Postings) == 0 {
+		return nil
+	}
+
+	buck := tx.Bucket(database.LEDGER)
+
+	id, err := buck.NextSequence()
+	if err != nil {
+		return err
+	}
+	e.Id = id
+	if e.Time == 0 {
+		e.Time = util.Time()
+	}
+
+	infoBuck := tx.Bucket(database.ADDRESS_INFO)
+	indexBuck := tx.Bucket(database.LEDGER_INDEX)
+
+	infos := make(map[string]*database.AddrInfo)
+	for _, p := range e.Postings {
+		typ, addr, ok := strings.Cut(p.Account, ":")
+		if !ok {
+			continue
+		}
+
+		addrInfo := infos[addr]
+		if addrInfo == nil {
+			addrInfo = &database.AddrInfo{}
+			if infoBin := infoBuck.Get([]byte(addr)); infoBin != nil {
+				err := addrInfo.Deserialize(infoBin)
+				if err != nil {
+					return err
+				}
+			}
+			infos[addr] = addrInfo
+		}
+
+		var bal *uint64
+		switch typ {
+		case ACCOUNT_BALANCE:
+			bal = &addrInfo.Balance
+		case ACCOUNT_PENDING:
+			bal = &addrInfo.BalancePending
+		case ACCOUNT_PAID:
+			bal = &addrInfo.Paid
+		default:
+			return fmt.Errorf("unknown account %s", p.Account)
+		}
+
+		if !p.Debit {
+			*bal += p.Amount
+		} else if *bal >= p.Amount {
+			*bal -= p.Amount
+		} else {
+			return fmt.Errorf("%s ledger entry %s: %s: %w", e.Kind, e.Ref, p.Account, errNegativeBalance)
+		}
+	}
+
+	for addr, addrInfo := range infos {
+		err := infoBuck.Put([]byte(addr), addrInfo.Serialize())
+		if err != nil {
+			return err
+		}
+		err = indexBuck.Put(database.LedgerIndexKey(addr, id), []byte{})
+		if err != nil {
+			return err
+		}
+	}
+
+	return buck.Put(binary.BigEndian.AppendUint64(nil, id), e.Serialize())
+}
+
+// sortedPostings returns the postings of a balance map, sorted by address
+func sortedPostings(typ string, bals map[string]uint64, isDebit bool) []database.Posting {
+	postings := make([]database.Posting, 0, len(bals)+1)
+	for addr, v := range bals {
+		p := credit(addrAccount(typ, addr), v)
+		p.Debit = isDebit
+		postings = append(postings, p)
+	}
+	slices.SortFunc(postings, func(a, b database.Posting) int {
+		return strings.Compare(a.Account, b.Account)
+	})
+	return postings
+}
+
+func sum(bals map[string]uint64) (total uint64) {
+	for _, v := range bals {
+		total += v
+	}
+	return
+}
+
+// creditBlock credits the pending balances of a found block. fee is the part
+// of the fee address which is the pool fee.
+func creditBlock(tx *bolt.Tx, hash [32]byte, bals map[string]uint64, fee uint64) error {
+	ref := fmt.Sprintf("%x", hash)
+
+	miners := make(map[string]uint64, len(bals))
+	for addr, v := range bals {
+		miners[addr] = v
+	}
+	miners[cfg.Cfg.FeeAddress] -= fee
+
+	err := postEntry(tx, &database.LedgerEntry{
+		Kind:     database.LEDGER_BLOCK_CREDIT,
+		Ref:      ref,
+		Postings: append(sortedPostings(ACCOUNT_PENDING, miners, false), debit(ACCOUNT_BLOCKS, sum(miners))),
+	})
+	if err != nil {
+		return err
+	}
+
+	return postEntry(tx, &database.LedgerEntry{
+		Kind: database.LEDGER_POOL_FEE,
+		Ref:  ref,
+		Postings: []database.Posting{
+			debit(ACCOUNT_BLOCKS, fee),
+			credit(addrAccount(ACCOUNT_PENDING, cfg.Cfg.FeeAddress), fee),
+		},
+	})
+}
+
+// orphanBlock reverses the pending balances of an orphaned block
+func orphanBlock(tx *bolt.Tx, hash [32]byte, bals map[string]uint64) error {
+	return postEntry(tx, &database.LedgerEntry{
+		Kind:     database.LEDGER_ORPHAN,
+		Ref:      fmt.Sprintf("%x", hash),
+		Postings: append(sortedPostings(ACCOUNT_PENDING, bals, true), credit(ACCOUNT_BLOCKS, sum(bals))),
+	})
+}
+
+// creditPPS credits the confirmed balances of the miners with the value of
+// their shares, at the given height
+func creditPPS(tx *bolt.Tx, height uint64, bals map[string]uint64) error {
+	return postEntry(tx, &database.LedgerEntry{
+		Kind:     database.LEDGER_PPS,
+		Ref:      strconv.FormatUint(height, 10),
+		Postings: append(sortedPostings(ACCOUNT_BALANCE, bals, false), debit(ACCOUNT_PPS, sum(bals))),
+	})
+}
+
+// listLedger returns at most limit entries with id lower than before, from the
+// newest to the oldest
+func listLedger(tx *bolt.Tx, before uint64, limit int) []database.LedgerEntry {
+	entries := make([]database.LedgerEntry, 0, min(limit, 50))
+
+	c := tx.Bucket(database.LEDGER).Cursor()
+
+	k, v := c.Seek(binary.BigEndian.AppendUint64(nil, before))
+	if k == nil {
+		k, v = c.Last()
+	} else {
+		k, v = c.Prev()
+	}
+
+	for ; k != nil && len(entries) < limit; k, v = c.Prev() {
+		e := database.LedgerEntry{}
+		err := e.Deserialize(v)
+		if err != nil {
+			log.Err("error reading ledger entry:", err)
+			continue
+		}
+
+		entries = append(entries, e)
+	}
+
+	return entries
+}
+
+// addressLedger returns at most limit entries of an address with id lower than
+// before, from the newest to the oldest
+func addressLedger(tx *bolt.Tx, addr string, before uint64, limit int) []database.LedgerEntry {
+	entries := make([]database.LedgerEntry, 0, min(limit, 50))
+
+	prefix := append([]byte(addr), 0)
+	ledger := tx.Bucket(database.LEDGER)
+
+	c := tx.Bucket(database.LEDGER_INDEX).Cursor()
+
+	k, _ := c.Seek(database.LedgerIndexKey(addr, before))
+	if k == nil {
+		k, _ = c.Last()
+	} else {
+		k, _ = c.Prev()
+	}
+
+	for ; k != nil && bytes.HasPrefix(k, prefix) && len(entries) < limit; k, _ = c.Prev() {
+		e := database.LedgerEntry{}
+		err := e.Deserialize(ledger.Get(k[len(prefix):]))
+		if err != nil {
+			log.Err("error reading ledger entry:", err)
+			continue
+		}
+
+		entries = append(entries, e)
+	}
+
+	return entries
+}
+
+// openLedger moves the balances which existed before the ledger into an
+// opening entry. It does nothing if the ledger has already been started.
+func openLedger(tx *bolt.Tx) error {
+	if tx.Bucket(database.LEDGER).Sequence() != 0 {
+		return nil
+	}
+
+	// the stored pending balances are not reliable, use the blocks waiting for confirmations
+	pendingBals := make(map[string]uint64)
+	if pendingBin := tx.Bucket(database.PENDING).Get([]byte("pending")); pendingBin != nil {
+		pending := database.PendingBals{}
+		err := pending.Deserialize(pendingBin)
+		if err != nil {
+			return err
+		}
+		for _, v := range pending.UnconfirmedTxs {
+			for addr, bal := range v.Bals {
+				pendingBals[addr] += bal
+			}
+		}
+	}
+
+	entry := database.LedgerEntry{
+		Kind: database.LEDGER_OPENING,
+	}
+	var total uint64
+
+	infoBuck := tx.Bucket(database.ADDRESS_INFO)
+	var addrs [][]byte
+	infoBuck.ForEach(func(k, v []byte) error {
+		addrs = append(addrs, bytes.Clone(k))
+		return nil
+	})
+
+	for _, k := range addrs {
+		addr := string(k)
+
+		addrInfo := database.AddrInfo{}
+		err := addrInfo.Deserialize(infoBuck.Get(k))
+		if err != nil {
+			return err
+		}
+
+		entry.Postings = append(entry.Postings,
+			credit(addrAccount(ACCOUNT_BALANCE, addr), addrInfo.Balance),
+			credit(addrAccount(ACCOUNT_PENDING, addr), pendingBals[addr]),
+			credit(addrAccount(ACCOUNT_PAID, addr), addrInfo.Paid),
+		)
+		total += addrInfo.Balance + pendingBals[addr] + addrInfo.Paid
+		delete(pendingBals, addr)
+
+		// the balances are added back by the opening entry
+		addrInfo.Balance = 0
+		addrInfo.BalancePending = 0
+		addrInfo.Paid = 0
+		err = infoBuck.Put(k, addrInfo.Serialize())
+		if err != nil {
+			return err
+		}
+	}
+	for addr, bal := range pendingBals {
+		entry.Postings = append(entry.Postings, credit(addrAccount(ACCOUNT_PENDING, addr), bal))
+		total += bal
+	}
+
+	entry.Postings = append(entry.Postings, debit(ACCOUNT_OPENING, total))
+
+	err := postEntry(tx, &entry)
+	if err != nil {
+		return err
+	}
+	if entry.Id != 0 {
+		log.Info("ledger opened with the existing balances of", len(addrs), "addresses")
+	}
+
+	return nil
+}
+
+type LedgerMismatch struct {
+	Account string  `json:"account"`
+	Stored  float64 `json:"stored"` // value of AddrInfo
+	Ledger  float64 `json:"ledger"`
+}
+
+// LedgerReport is the result of the consistency check of the ledger
+type LedgerReport struct {
+	Ok         bool             `json:"ok"`
+	Entries    int              `json:"entries"`
+	Unbalanced []uint64         `json:"unbalanced"` // ids of the entries whose debits and credits differ
+	Mismatches []LedgerMismatch `json:"mismatches"` // balances which differ from the ledger
+
+	Accounts map[string]float64 `json:"accounts"` // pool accounts, credits minus debits
+
+	// confirmed and pending balances of the miners
+	Liabilities   float64 `json:"liabilities"`
+	WalletBalance float64 `json:"wallet_balance"`
+	Surplus       float64 `json:"surplus"` // wallet balance minus the liabilities
+}
+
+// checkLedger checks that every entry is balanced, that the balances of the
+// addresses match the ledger, and compares the balances owed to the miners to
+// the wallet balance
+func checkLedger() (LedgerReport, error) {
+	var report LedgerReport
+	var liabilities int64
+
+	err := DB.View(func(tx *bolt.Tx) error {
+		var err error
+		report, liabilities, err = auditLedger(tx)
+		return err
+	})
+	if err != nil {
+		return report, err
+	}
+
+	balance, err := newWalletRPC().GetBalance(wallet.GetBalanceParams{
+		Asset: config.ASSET,
+	})
+	if err != nil {
+		return report, fmt.Errorf("failed to get the wallet balance: %w", err)
+	}
+	report.WalletBalance = float64(balance) / Coin
+	report.Surplus = float64(int64(balance)-liabilities) / Coin
+
+	report.Ok = len(report.Unbalanced) == 0 && len(report.Mismatches) == 0 && balance >= uint64(liabilities)
+
+	return report, nil
+}
+
+// auditLedger checks the entries and the balances of the addresses, and returns
+// the sum of the confirmed and pending balances
+func auditLedger(tx *bolt.Tx) (LedgerReport, int64, error) {
+	report := LedgerReport{
+		Unbalanced: []uint64{},
+		Mismatches: []LedgerMismatch{},
+		Accounts:   make(map[string]float64),
+	}
+
+	sums := make(map[string]int64)
+	var liabilities int64
+
+	err := tx.Bucket(database.LEDGER).ForEach(func(k, v []byte) error {
+		e := database.LedgerEntry{}
+		err := e.Deserialize(v)
+		if err != nil {
+			return fmt.Errorf("ledger entry %d: %w", binary.BigEndian.Uint64(k), err)
+		}
+		report.Entries++
+
+		var balance int64
+		for _, p := range e.Postings {
+			amount := int64(p.Amount)
+			if p.Debit {
+				amount = -amount
+			}
+			sums[p.Account] += amount
+			balance += amount
+		}
+		if balance != 0 {
+			report.Unbalanced = append(report.Unbalanced, e.Id)
+		}
+		return nil
+	})
+	if err != nil {
+		return report, 0, err
+	}
+
+	stored := make(map[string]int64)
+	err = tx.Bucket(database.ADDRESS_INFO).ForEach(func(k, v []byte) error {
+		addrInfo := database.AddrInfo{}
+		err := addrInfo.Deserialize(v)
+		if err != nil {
+			return fmt.Errorf("address %s: %w", k, err)
+		}
+		stored[addrAccount(ACCOUNT_BALANCE, string(k))] = int64(addrInfo.Balance)
+		stored[addrAccount(ACCOUNT_PENDING, string(k))] = int64(addrInfo.BalancePending)
+		stored[addrAccount(ACCOUNT_PAID, string(k))] = int64(addrInfo.Paid)
+		return nil
+	})
+	if err != nil {
+		return report, 0, err
+	}
+
+	for account, v := range sums {
+		typ, _, isAddr := strings.Cut(account, ":")
+		if !isAddr {
+			report.Accounts[account] = Round6(float64(v) / Coin)
+			continue
+		}
+		if typ != ACCOUNT_PAID {
+			liabilities += v
+		}
+		if _, ok := stored[account]; !ok {
+			stored[account] = 0
+		}
+	}
+	for account, v := range stored {
+		if sums[account] != v {
+			report.Mismatches = append(report.Mismatches, LedgerMismatch{
+				Account: account,
+				Stored:  float64(v) / Coin,
+				Ledger:  float64(sums[account]) / Coin,
+			})
+		}
+	}
+
+	slices.SortFunc(report.Mismatches, func(a, b LedgerMismatch) int {
+		return strings.Compare(a.Account, b.Account)
+	})
+
+	report.Liabilities = float64(liabilities) / Coin
+
+	return report, liabilities, nil
+}
+
+// CheckLedger logs the result of the consistency check
+func CheckLedger() {
+	report, err := checkLedger()
+	if err != nil {
+		log.Err("ledger check:", err)
+		return
+	}
+
+	if len(report.Unbalanced) != 0 {
+		log.Err("ledger check:", len(report.Unbalanced), "unbalanced entries:", report.Unbalanced)
+	}
+	for _, v := range report.Mismatches {
+		log.Errf("ledger check: %s is %f, expected %f", v.Account, v.Stored, v.Ledger)
+	}
+	if report.Surplus < 0 {
+		log.Err("ledger check: the balances of the miners exceed the wallet balance by", -report.Surplus)
+	}
+	if report.Ok {
+		log.Infof("ledger check OK: %d entries, wallet surplus %f", report.Entries, report.Surplus)
+	}
+}
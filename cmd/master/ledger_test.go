@@ -0,0 +1,198 @@
+// Copyright (C) 2024 XELIS
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"testing"
+	"xelis-pool/database"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+func TestPostEntry(t *testing.T) {
+	const addr = "xel:miner"
+
+	tests := []struct {
+		name     string
+		postings []database.Posting
+		err      error // nil if the entry is accepted
+		balance  uint64
+	}{
+		{"balanced credit", []database.Posting{
+			debit(ACCOUNT_ADJUSTMENTS, 30),
+			credit(addrAccount(ACCOUNT_BALANCE, addr), 30),
+		}, nil, 130},
+		{"balanced debit", []database.Posting{
+			debit(addrAccount(ACCOUNT_BALANCE, addr), 100),
+			credit(ACCOUNT_ADJUSTMENTS, 100),
+		}, nil, 0},
+		{"unbalanced", []database.Posting{
+			debit(ACCOUNT_ADJUSTMENTS, 30),
+			credit(addrAccount(ACCOUNT_BALANCE, addr), 31),
+		}, errors.New("unbalanced"), 100},
+		{"only a credit", []database.Posting{
+			credit(addrAccount(ACCOUNT_BALANCE, addr), 1),
+		}, errors.New("unbalanced"), 100},
+		{"overdraft", []database.Posting{
+			debit(addrAccount(ACCOUNT_BALANCE, addr), 101),
+			credit(ACCOUNT_ADJUSTMENTS, 101),
+		}, errNegativeBalance, 100},
+		{"overdraft of another account", []database.Posting{
+			debit(addrAccount(ACCOUNT_PAID, addr), 1),
+			credit(addrAccount(ACCOUNT_BALANCE, addr), 1),
+		}, errNegativeBalance, 100},
+		{"unknown account", []database.Posting{
+			debit(ACCOUNT_ADJUSTMENTS, 1),
+			credit("bonus:"+addr, 1),
+		}, errors.New("unknown account"), 100},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			newTestDB(t)
+
+			err := DB.Update(func(tx *bolt.Tx) error {
+				return postEntry(tx, &database.LedgerEntry{
+					Kind: database.LEDGER_OPENING,
+					Postings: []database.Posting{
+						debit(ACCOUNT_OPENING, 100),
+						credit(addrAccount(ACCOUNT_BALANCE, addr), 100),
+					},
+				})
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			err = DB.Update(func(tx *bolt.Tx) error {
+				return postEntry(tx, &database.LedgerEntry{
+					Kind:     database.LEDGER_ADJUSTMENT,
+					Postings: test.postings,
+				})
+			})
+			if test.err == nil && err != nil {
+				t.Fatal(err)
+			}
+			if test.err != nil {
+				if err == nil {
+					t.Fatal("entry accepted")
+				}
+				if errors.Is(test.err, errNegativeBalance) && !errors.Is(err, errNegativeBalance) {
+					t.Errorf("got %v, expected %v", err, test.err)
+				}
+			}
+
+			entries := 2
+			if test.err != nil {
+				entries = 1
+			}
+
+			DB.View(func(tx *bolt.Tx) error {
+				report, _, err := auditLedger(tx)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if report.Entries != entries || len(report.Unbalanced) != 0 || len(report.Mismatches) != 0 {
+					t.Errorf("ledger report %+v", report)
+				}
+
+				addrInfo := database.AddrInfo{}
+				addrInfo.Deserialize(tx.Bucket(database.ADDRESS_INFO).Get([]byte(addr)))
+				if addrInfo.Balance != test.balance || addrInfo.Paid != 0 {
+					t.Errorf("balance %d paid %d, expected balance %d", addrInfo.Balance, addrInfo.Paid, test.balance)
+				}
+				return nil
+			})
+		})
+	}
+}
+
+func TestAuditLedger(t *testing.T) {
+	newTestDB(t)
+	const addr = "xel:miner"
+
+	err := DB.Update(func(tx *bolt.Tx) error {
+		return postEntry(tx, &database.LedgerEntry{
+			Kind: database.LEDGER_OPENING,
+			Postings: []database.Posting{
+				debit(ACCOUNT_OPENING, 300),
+				credit(addrAccount(ACCOUNT_BALANCE, addr), 100),
+				credit(addrAccount(ACCOUNT_PENDING, addr), 150),
+				credit(addrAccount(ACCOUNT_PAID, addr), 50),
+			},
+		})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var report LedgerReport
+	var liabilities int64
+	DB.View(func(tx *bolt.Tx) error {
+		report, liabilities, err = auditLedger(tx)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Unbalanced) != 0 || len(report.Mismatches) != 0 || liabilities != 250 {
+		t.Errorf("consistent ledger: report %+v, liabilities %d", report, liabilities)
+	}
+
+	// entries and balances changed without postEntry
+	err = DB.Update(func(tx *bolt.Tx) error {
+		e := database.LedgerEntry{
+			Id:   2,
+			Kind: database.LEDGER_ADJUSTMENT,
+			Postings: []database.Posting{
+				debit(ACCOUNT_ADJUSTMENTS, 10),
+				credit(addrAccount(ACCOUNT_BALANCE, addr), 20),
+			},
+		}
+		err := tx.Bucket(database.LEDGER).Put(binary.BigEndian.AppendUint64(nil, e.Id), e.Serialize())
+		if err != nil {
+			return err
+		}
+
+		addrInfo := database.AddrInfo{}
+		err = addrInfo.Deserialize(tx.Bucket(database.ADDRESS_INFO).Get([]byte(addr)))
+		if err != nil {
+			return err
+		}
+		addrInfo.Balance += 20
+		addrInfo.Paid = 0
+		return tx.Bucket(database.ADDRESS_INFO).Put([]byte(addr), addrInfo.Serialize())
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	DB.View(func(tx *bolt.Tx) error {
+		report, _, err = auditLedger(tx)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Unbalanced) != 1 || report.Unbalanced[0] != 2 {
+		t.Errorf("unbalanced entries are %v, expected [2]", report.Unbalanced)
+	}
+	if len(report.Mismatches) != 1 || report.Mismatches[0].Account != addrAccount(ACCOUNT_PAID, addr) {
+		t.Errorf("mismatches are %+v, expected %s", report.Mismatches, addrAccount(ACCOUNT_PAID, addr))
+	}
+}
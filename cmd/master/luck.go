@@ -0,0 +1,129 @@
+// Copyright (C) 2024 XELIS
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"math"
+	"xelis-pool/database"
+	"xelis-pool/log"
+	"xelis-pool/util"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// number of days of the daily luck history
+const LUCK_DAYS = 30
+
+// block windows of the luck statistics
+var luckWindows = []int{10, 50, 100}
+
+// Luck is the effort statistics of a group of blocks.
+// Luck is the inverse of the average effort: above 1, the pool found more
+// blocks than expected.
+type Luck struct {
+	Blocks int     `json:"blocks"`
+	Effort float64 `json:"effort"`  // average effort, 1 = 100%
+	StdDev float64 `json:"std_dev"` // standard deviation of the effort
+	Luck   float64 `json:"luck"`
+
+	sum   float64
+	sumSq float64
+}
+
+func (l *Luck) add(effort float64) {
+	l.Blocks++
+	l.sum += effort
+	l.sumSq += effort * effort
+}
+
+func (l *Luck) finish() {
+	if l.Blocks == 0 {
+		return
+	}
+	n := float64(l.Blocks)
+	l.Effort = l.sum / n
+	l.StdDev = math.Sqrt(max(l.sumSq/n-l.Effort*l.Effort, 0))
+	if l.sum > 0 {
+		l.Luck = n / l.sum
+	}
+
+	l.Effort = Round6(l.Effort)
+	l.StdDev = Round6(l.StdDev)
+	l.Luck = Round6(l.Luck)
+}
+
+type DailyLuck struct {
+	Day uint64 `json:"day"` // UNIX timestamp of the start of the day (UTC)
+	Luck
+}
+
+// poolLuck returns the luck of the last 10, 50 and 100 blocks found by the
+// pool (or by the solo miners if solo is true) in the last LUCK_DAYS days, and
+// the luck of each of these days from the newest to the oldest
+func poolLuck(tx *bolt.Tx, solo bool) (windows map[int]*Luck, daily []DailyLuck) {
+	windows = make(map[int]*Luck, len(luckWindows))
+	for _, w := range luckWindows {
+		windows[w] = &Luck{}
+	}
+
+	today := util.Time() / 86400 * 86400
+	daily = make([]DailyLuck, LUCK_DAYS)
+	for i := range daily {
+		daily[i].Day = today - uint64(i)*86400
+	}
+	oldestDay := daily[LUCK_DAYS-1].Day
+
+	c := tx.Bucket(database.BLOCKS).Cursor()
+
+	// the blocks are sorted by height, which is also the order they are found
+	n := 0
+	for k, v := c.Last(); k != nil; k, v = c.Prev() {
+		bl := database.Block{}
+		err := bl.Deserialize(v)
+		if err != nil {
+			log.Err("error reading block:", err)
+			continue
+		}
+		// blocks older than the daily history are not read, even if the windows
+		// are not full, so that a rare kind of block doesn't scan the whole bucket
+		if bl.Time < oldestDay {
+			break
+		}
+		if bl.Solo != solo {
+			continue
+		}
+
+		n++
+
+		for w, l := range windows {
+			if n <= w {
+				l.add(float64(bl.Effort))
+			}
+		}
+		if bl.Time < today+86400 {
+			daily[(today-bl.Time/86400*86400)/86400].add(float64(bl.Effort))
+		}
+	}
+
+	for _, l := range windows {
+		l.finish()
+	}
+	for i := range daily {
+		daily[i].finish()
+	}
+
+	return
+}
@@ -0,0 +1,132 @@
+// Copyright (C) 2024 XELIS
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"testing"
+	"xelis-pool/database"
+	"xelis-pool/util"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+func TestRoundAddShare(t *testing.T) {
+	r := Round{}
+	r.AddShare(100, 2, 1000)
+	r.AddShare(300, 1, 2000)
+	r.AddShare(50, 1, 0) // unknown network difficulty
+
+	if r.Start == 0 || r.Shares != 4 || r.Hashes != 450 || Round6(r.Effort) != 0.25 {
+		t.Errorf("round is %+v", r)
+	}
+}
+
+func TestLuck(t *testing.T) {
+	tests := []struct {
+		efforts []float64
+		effort  float64
+		stdDev  float64
+		luck    float64
+	}{
+		{nil, 0, 0, 0},
+		{[]float64{0}, 0, 0, 0},
+		{[]float64{1, 1, 1, 1}, 1, 0, 1},
+		{[]float64{0.5, 1.5}, 1, 0.5, 1},
+		{[]float64{0.25, 0.75}, 0.5, 0.25, 2},
+		{[]float64{1, 2, 3}, 2, 0.816497, 0.5},
+	}
+
+	for _, test := range tests {
+		l := Luck{}
+		for _, e := range test.efforts {
+			l.add(e)
+		}
+		l.finish()
+
+		if l.Blocks != len(test.efforts) || l.Effort != test.effort || l.StdDev != test.stdDev || l.Luck != test.luck {
+			t.Errorf("efforts %v: got %+v, expected effort %v std dev %v luck %v",
+				test.efforts, l, test.effort, test.stdDev, test.luck)
+		}
+	}
+}
+
+func TestPoolLuck(t *testing.T) {
+	newTestDB(t)
+	today := util.Time() / 86400 * 86400
+
+	var blocks []database.Block
+	add := func(time uint64, effort float32, solo bool) {
+		bl := database.Block{
+			Height: uint64(len(blocks) + 1),
+			Effort: effort,
+			Time:   time,
+			Solo:   solo,
+		}
+		bl.Hash[0] = byte(bl.Height)
+		blocks = append(blocks, bl)
+	}
+
+	add(today-LUCK_DAYS*86400, 9, false) // older than the daily history
+	add(today-LUCK_DAYS*86400, 9, true)
+	for i := range 60 {
+		add(today-2*86400+uint64(i), 1, false)
+	}
+	for i := range 10 {
+		add(today+uint64(i), 3, false)
+	}
+	add(today+10, 0.5, true)
+
+	err := DB.Update(func(tx *bolt.Tx) error {
+		for _, bl := range blocks {
+			err := storeBlock(tx, bl)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	check := func(name string, l Luck, blocks int, effort float64) {
+		t.Helper()
+		if l.Blocks != blocks || l.Effort != Round6(effort) {
+			t.Errorf("%s: %d blocks with effort %v, expected %d blocks with effort %v", name, l.Blocks, l.Effort, blocks, Round6(effort))
+		}
+	}
+
+	DB.View(func(tx *bolt.Tx) error {
+		windows, daily := poolLuck(tx, false)
+
+		check("last 10 blocks", *windows[10], 10, 3)
+		check("last 50 blocks", *windows[50], 50, (10*3+40*1)/50.0)
+		check("last 100 blocks", *windows[100], 70, (10*3+60*1)/70.0)
+
+		if len(daily) != LUCK_DAYS || daily[0].Day != today || daily[2].Day != today-2*86400 {
+			t.Fatalf("daily luck days are wrong: %+v", daily)
+		}
+		check("today", daily[0].Luck, 10, 3)
+		check("yesterday", daily[1].Luck, 0, 0)
+		check("2 days ago", daily[2].Luck, 60, 1)
+
+		windows, daily = poolLuck(tx, true)
+
+		check("last 100 solo blocks", *windows[100], 1, 0.5)
+		check("solo today", daily[0].Luck, 1, 0.5)
+		return nil
+	})
+}
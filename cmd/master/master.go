@@ -19,6 +19,7 @@ import (
 	"context"
 	"math"
 	"net"
+	"slices"
 	"strconv"
 	"sync"
 	"xelis-pool/address"
@@ -26,6 +27,7 @@ import (
 	"xelis-pool/config"
 	"xelis-pool/database"
 	"xelis-pool/log"
+	"xelis-pool/metrics"
 	"xelis-pool/util"
 
 	"github.com/xelis-project/xelis-go-sdk/daemon"
@@ -67,7 +69,14 @@ func main() {
 	if !address.IsAddressValid(cfg.Cfg.FeeAddress) {
 		log.Fatal("Fee address is not valid")
 	}
+	Coin = math.Pow10(cfg.Cfg.Atomic)
+
 	var err error
+	rewardScheme, err = NewRewardScheme(cfg.Cfg.Master.RewardScheme)
+	if err != nil {
+		log.Fatal(err)
+	}
+
 	DB, err = bolt.Open("pool.db", 0o600, bolt.DefaultOptions)
 
 	if err != nil {
@@ -85,6 +94,74 @@ func main() {
 		if err != nil {
 			return err
 		}
+		_, err = tx.CreateBucketIfNotExists(database.FOUND_BY)
+		if err != nil {
+			return err
+		}
+		_, err = tx.CreateBucketIfNotExists(database.BLOCKS)
+		if err != nil {
+			return err
+		}
+		_, err = tx.CreateBucketIfNotExists(database.BLOCK_INDEX)
+		if err != nil {
+			return err
+		}
+		_, err = tx.CreateBucketIfNotExists(database.WITHDRAWALS)
+		if err != nil {
+			return err
+		}
+		_, err = tx.CreateBucketIfNotExists(database.PAYOUTS)
+		if err != nil {
+			return err
+		}
+		_, err = tx.CreateBucketIfNotExists(database.BLOCK_REWARDS)
+		if err != nil {
+			return err
+		}
+		_, err = tx.CreateBucketIfNotExists(database.ADDRESS_REWARDS)
+		if err != nil {
+			return err
+		}
+		_, err = tx.CreateBucketIfNotExists(database.THRESHOLD_REQUESTS)
+		if err != nil {
+			return err
+		}
+		_, err = tx.CreateBucketIfNotExists(database.SHARE_BATCHES)
+		if err != nil {
+			return err
+		}
+		_, err = tx.CreateBucketIfNotExists(database.BANS)
+		if err != nil {
+			return err
+		}
+		_, err = tx.CreateBucketIfNotExists(database.AUDIT_LOG)
+		if err != nil {
+			return err
+		}
+		_, err = tx.CreateBucketIfNotExists(database.ADJUSTMENTS)
+		if err != nil {
+			return err
+		}
+		_, err = tx.CreateBucketIfNotExists(database.ADJUSTMENT_INDEX)
+		if err != nil {
+			return err
+		}
+		_, err = tx.CreateBucketIfNotExists(database.LEDGER)
+		if err != nil {
+			return err
+		}
+		_, err = tx.CreateBucketIfNotExists(database.LEDGER_INDEX)
+		if err != nil {
+			return err
+		}
+		_, err = tx.CreateBucketIfNotExists(database.REVENUE)
+		if err != nil {
+			return err
+		}
+		_, err = tx.CreateBucketIfNotExists(database.SOLO_FOUND)
+		if err != nil {
+			return err
+		}
 		_, err = tx.CreateBucketIfNotExists(database.SHARES)
 
 		return err
@@ -93,10 +170,32 @@ func main() {
 		log.Fatal(err)
 	}
 
+	err = DB.Update(indexBlocks)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	err = DB.Update(indexAdjustments)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	err = DB.Update(openLedger)
+	if err != nil {
+		log.Fatal(err)
+	}
+
 	DatabaseCleanup()
 
 	StartWallet()
 
+	// withdrawals interrupted by a restart must be reconciled before paying again
+	if !ReconcileWithdrawals() {
+		log.Warn("some withdrawals are not reconciled yet, they will be checked again before the next payout")
+	}
+
+	go CheckLedger()
+
 	srv, err := net.Listen("tcp", config.MASTER_SERVER_HOST+":"+strconv.FormatUint(uint64(cfg.Cfg.Master.Port), 10))
 	if err != nil {
 		panic(err)
@@ -106,7 +205,9 @@ func main() {
 	log.Info("Using daemon RPC " + cfg.Cfg.Master.DaemonRpc)
 
 	go StartApiServer()
+	go StartAdminApiServer()
 	go StatsServer()
+	go metrics.Serve(cfg.Cfg.Master.MetricsAddr)
 
 	go Updater()
 
@@ -122,85 +223,100 @@ func main() {
 func DatabaseCleanup() {
 	log.Info("Starting database cleanup")
 
-	var sharesRemoved = 0
-	var sharesKept = 0
+	var sharesRemoved, sharesKept, requestsRemoved, batchesRemoved, bansRemoved, auditRemoved, blocksOrphaned int
 
 	err := DB.Update(func(tx *bolt.Tx) error {
-		buck := tx.Bucket(database.SHARES)
-
-		cursor := buck.Cursor()
+		sharesRemoved, sharesKept = rewardScheme.Prune(tx)
+		requestsRemoved = cleanupThresholdRequests(tx)
+		batchesRemoved = cleanupShareBatches(tx)
+		bansRemoved = cleanupBans(tx)
+		auditRemoved = cleanupAuditLog(tx)
+		blocksOrphaned = cleanupFoundBy(tx)
 
-		for k, v := cursor.First(); k != nil; k, v = cursor.Next() {
-			sh := database.Share{}
-
-			err := sh.Deserialize(v)
-
-			if err != nil {
-				log.Warn("error reading share:", err)
-				buck.Delete(k)
-				sharesRemoved++
-				continue
-			}
+		return nil
+	})
+	if err != nil {
+		log.Err(err)
+	}
 
-			// delete outdated shares
-			if sh.Time+GetPplnsWindow() < util.Time() {
-				buck.Delete(k)
-				sharesRemoved++
-				continue
-			}
+	log.Info("Database cleanup OK,", sharesRemoved, "outdated shares removed,", sharesKept, "maintained,",
+		requestsRemoved, "expired threshold requests removed,", batchesRemoved, "old share batches removed,",
+		bansRemoved, "expired bans removed,", auditRemoved, "old audit log entries removed,",
+		blocksOrphaned, "unreported blocks orphaned")
+}
 
-			sharesKept++
-		}
+func OnShareFound(ip string, wallet, worker string, diff uint64, numShares uint32) {
+	share, ok := newShare(ip, wallet, diff)
+	if !ok {
+		return
+	}
 
-		return nil
+	err := DB.Update(func(tx *bolt.Tx) error {
+		return storeShare(tx, share)
 	})
 	if err != nil {
 		log.Err(err)
+		return
 	}
 
-	log.Info("Database cleanup OK,", sharesRemoved, "outdated shares removed,", sharesKept, "maintained")
+	addShareStats(ip, share, worker, numShares)
 }
 
-func OnShareFound(ip string, wallet string, diff uint64, numShares uint32) {
+// newShare validates a share and returns it, or false if it must be ignored.
+// Stats must not be locked.
+func newShare(ip string, wallet string, diff uint64) (database.Share, bool) {
 	if !address.IsAddressValid(wallet) {
 		log.Warn("Wallet", wallet, "is not valid. Replacing it with fee address.")
 		wallet = cfg.Cfg.FeeAddress
 	}
-	for _, v := range config.BANNED_ADDRESSES {
-		if wallet == v {
-			log.Warn("slave "+ip+": wallet", wallet, "is banned, ignoring the share")
-			return
-		}
+	if slices.Contains(config.BANNED_ADDRESSES, wallet) {
+		log.Warn("slave "+ip+": wallet", wallet, "is banned, ignoring the share")
+		return database.Share{}, false
 	}
 
+	Stats.RLock()
+	netDiff := Stats.Difficulty
+	Stats.RUnlock()
+
+	return database.Share{
+		Wallet:  wallet,
+		Diff:    diff,
+		Time:    util.Time(),
+		NetDiff: uint64(netDiff),
+	}, true
+}
+
+// addShareStats adds a share to the stats, once it has been stored.
+// Stats must not be locked.
+func addShareStats(ip string, share database.Share, worker string, numShares uint32) {
+	wallet := share.Wallet
+	diff := share.Diff
+
 	Stats.Lock()
 	kwall := Stats.KnownAddresses[wallet]
 
 	kwall.AddShare(float64(diff), util.TimePrecise())
 
-	log.Info("slave "+ip+": Wallet", wallet, "found", numShares, "shares with diff", float64(diff/100)/10, "k HR:", Stats.GetHashrate(wallet))
+	log.Info("slave "+ip+": Wallet", wallet, "worker", worker, "found", numShares, "shares with diff", float64(diff/100)/10, "k HR:", Stats.GetHashrate(wallet))
 
 	Stats.KnownAddresses[wallet] = kwall
 
-	Stats.Hashes += float64(diff)
+	Stats.AddWorkerShare(wallet, worker, float64(diff))
+
+	Stats.Round.AddShare(float64(diff), numShares, Stats.Difficulty)
 	Stats.Cleanup()
 	Stats.Unlock()
+}
 
-	DB.Update(func(tx *bolt.Tx) error {
-		buck := tx.Bucket(database.SHARES)
-
-		shareId, _ := buck.NextSequence()
-
-		shareData := database.Share{
-			Wallet: wallet,
-			Diff:   diff,
-			Time:   util.Time(),
-		}
+func storeShare(tx *bolt.Tx, share database.Share) error {
+	buck := tx.Bucket(database.SHARES)
 
-		buck.Put(util.Itob(shareId), shareData.Serialize())
+	shareId, err := buck.NextSequence()
+	if err != nil {
+		return err
+	}
 
-		return nil
-	})
+	return buck.Put(util.Itob(shareId), share.Serialize())
 }
 
 // Important: Stats must be locked and MasterInfo must not be locked
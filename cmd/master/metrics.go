@@ -0,0 +1,95 @@
+// Copyright (C) 2024 XELIS
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"xelis-pool/config"
+	"xelis-pool/database"
+	"xelis-pool/log"
+	"xelis-pool/metrics"
+
+	"github.com/xelis-project/xelis-go-sdk/wallet"
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	poolHashrateMetric = metrics.NewGauge("xelis_master_pool_hashrate", "Pool hashrate in H/s.")
+	netHashrateMetric  = metrics.NewGauge("xelis_master_net_hashrate", "Network hashrate in H/s.")
+	workersMetric      = metrics.NewGauge("xelis_master_workers", "Number of connected workers.")
+	addressesMetric    = metrics.NewGauge("xelis_master_addresses", "Number of connected addresses.")
+	blocksFoundMetric  = metrics.NewGauge("xelis_master_blocks_found", "Number of blocks found by the pool.")
+
+	slavesMetric      = metrics.NewGauge("xelis_master_slaves", "Number of connected slaves.")
+	slaveMinersMetric = metrics.NewGauge("xelis_master_slave_miners", "Number of miners connected to each slave.",
+		"slave", "region", "addr")
+
+	balanceMetric       = metrics.NewGauge("xelis_master_balance", "Sum of the balances of the miners, in coins.", "state")
+	walletBalanceMetric = metrics.NewGauge("xelis_master_wallet_balance", "Balance of the pool wallet, in coins.")
+	debtMetric          = metrics.NewGauge("xelis_master_debt",
+		"Wallet balance minus the balances of the miners, in coins. Negative if the pool owes more than it has.")
+
+	withdrawalsMetric = metrics.NewGauge("xelis_master_withdrawals", "Number of withdrawals in the journal.", "status")
+)
+
+func init() {
+	metrics.OnScrape(updateMetrics)
+}
+
+// updateMetrics is called on every scrape
+func updateMetrics() {
+	Stats.RLock()
+	poolHashrateMetric.Set(Stats.PoolHashrate)
+	netHashrateMetric.Set(NotInf(Stats.NetHashrate))
+	workersMetric.Set(float64(Stats.Workers))
+	addressesMetric.Set(float64(len(Stats.KnownAddresses)))
+	blocksFoundMetric.Set(float64(Stats.NumFound))
+
+	slavesMetric.Set(float64(len(slaves)))
+	slaveMinersMetric.Reset()
+	for _, v := range slaves {
+		slaveMinersMetric.Set(float64(v.Miners), v.Name, v.Region, v.Addr)
+	}
+	Stats.RUnlock()
+
+	confirmed, pending, err := poolBalances()
+	if err != nil {
+		log.Err("metrics:", err)
+		return
+	}
+	balanceMetric.Set(float64(confirmed)/Coin, "confirmed")
+	balanceMetric.Set(float64(pending)/Coin, "pending")
+
+	withdrawalsMetric.Reset()
+	DB.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(database.WITHDRAWALS).ForEach(func(k, v []byte) error {
+			w := database.Withdrawal{}
+			if w.Deserialize(v) == nil {
+				withdrawalsMetric.Add(1, w.Status.String())
+			}
+			return nil
+		})
+	})
+
+	balance, err := newWalletRPC().GetBalance(wallet.GetBalanceParams{
+		Asset: config.ASSET,
+	})
+	if err != nil {
+		log.Warn("metrics: failed to get wallet balance:", err)
+		return
+	}
+	walletBalanceMetric.Set(float64(balance) / Coin)
+	debtMetric.Set(debt(balance, confirmed, pending))
+}
@@ -0,0 +1,106 @@
+// Copyright (C) 2024 XELIS
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"xelis-pool/database"
+	"xelis-pool/log"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+type PayoutInfo struct {
+	Txid   string  `json:"txid"` // empty if the transaction never reached the network
+	Amount float64 `json:"amount"`
+	Fee    float64 `json:"fee"`
+	Status string  `json:"status"`
+	Time   uint64  `json:"time"` // UNIX timestamp
+}
+
+// storePayouts adds the destinations of a withdrawal to the payout history
+func storePayouts(tx *bolt.Tx, w database.Withdrawal) error {
+	buck := tx.Bucket(database.PAYOUTS)
+
+	for _, d := range w.Destinations {
+		p := database.Payout{
+			WithdrawalId: w.Id,
+			Address:      d.Address,
+			Amount:       d.Amount,
+			Fee:          d.Fee,
+			Time:         w.Time,
+		}
+
+		err := buck.Put(database.PayoutKey(d.Account, w.Time, w.Id), p.Serialize())
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// listPayouts returns at most limit payouts of an address older than before,
+// from the newest to the oldest. Txid and status are taken from the withdrawal journal.
+func listPayouts(tx *bolt.Tx, address string, before uint64, limit int) []PayoutInfo {
+	payouts := make([]PayoutInfo, 0, min(limit, 50))
+
+	prefix := append([]byte(address), 0)
+	withdrawals := tx.Bucket(database.WITHDRAWALS)
+
+	c := tx.Bucket(database.PAYOUTS).Cursor()
+
+	k, v := c.Seek(database.PayoutKey(address, before, 0))
+	if k == nil {
+		k, v = c.Last()
+	} else {
+		k, v = c.Prev()
+	}
+
+	for ; k != nil && bytes.HasPrefix(k, prefix) && len(payouts) < limit; k, v = c.Prev() {
+		p := database.Payout{}
+		err := p.Deserialize(v)
+		if err != nil {
+			log.Err("error reading payout:", err)
+			continue
+		}
+
+		info := PayoutInfo{
+			Amount: Round6(float64(p.Amount) / Coin),
+			Fee:    Round6(float64(p.Fee) / Coin),
+			Status: "unknown",
+			Time:   p.Time,
+		}
+
+		if wBin := withdrawals.Get(withdrawalKey(p.WithdrawalId)); wBin != nil {
+			w := database.Withdrawal{}
+			err := w.Deserialize(wBin)
+			if err != nil {
+				log.Err("error reading withdrawal", p.WithdrawalId, ":", err)
+			} else {
+				info.Status = w.Status.String()
+				if w.Status != database.WITHDRAWAL_FAILED {
+					info.Txid = hex.EncodeToString(w.Txid[:])
+				}
+			}
+		}
+
+		payouts = append(payouts, info)
+	}
+
+	return payouts
+}
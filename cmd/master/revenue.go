@@ -0,0 +1,176 @@
+// Copyright (C) 2024 XELIS
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strconv"
+	"xelis-pool/cfg"
+	"xelis-pool/database"
+	"xelis-pool/log"
+	"xelis-pool/util"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// maximum number of periods of a revenue report
+const MAX_REVENUE_PERIODS = 1000
+
+type RevenuePeriod struct {
+	Start          uint64  `json:"start"` // UNIX timestamp
+	Blocks         int     `json:"blocks"`
+	BlockFees      float64 `json:"block_fees"`
+	Withdrawals    int     `json:"withdrawals"`
+	WithdrawalFees float64 `json:"withdrawal_fees"`
+	NetworkFees    float64 `json:"network_fees"`
+	Profit         float64 `json:"profit"` // block fees + withdrawal fees - network fees
+}
+
+func (p *RevenuePeriod) add(r database.Revenue) {
+	amount := float64(r.Amount) / Coin
+	cost := float64(r.Cost) / Coin
+
+	switch r.Kind {
+	case database.REVENUE_BLOCK_FEE:
+		p.Blocks++
+		p.BlockFees += amount
+	case database.REVENUE_WITHDRAWAL_FEE:
+		p.Withdrawals++
+		p.WithdrawalFees += amount
+	}
+	p.NetworkFees += cost
+	p.Profit += amount - cost
+}
+
+func (p *RevenuePeriod) round() {
+	p.BlockFees = Round6(p.BlockFees)
+	p.WithdrawalFees = Round6(p.WithdrawalFees)
+	p.NetworkFees = Round6(p.NetworkFees)
+	p.Profit = Round6(p.Profit)
+}
+
+func storeRevenue(tx *bolt.Tx, r database.Revenue) error {
+	buck := tx.Bucket(database.REVENUE)
+
+	id, err := buck.NextSequence()
+	if err != nil {
+		return err
+	}
+	r.Id = id
+	if r.Time == 0 {
+		r.Time = util.Time()
+	}
+
+	return buck.Put(binary.BigEndian.AppendUint64(nil, id), r.Serialize())
+}
+
+// storeBlockFee records the pool fee of a matured block as revenue. Like the
+// balances of the miners, the fee of side blocks is reduced by the multiplier.
+func storeBlockFee(tx *bolt.Tx, hash [32]byte, multiplier float64) error {
+	_, bl, _ := findBlock(tx, hash)
+
+	fee := min(uint64(float64(bl.PoolFee)*multiplier), bl.PoolFee)
+	if fee == 0 {
+		return nil
+	}
+
+	return storeRevenue(tx, database.Revenue{
+		Kind:   database.REVENUE_BLOCK_FEE,
+		Ref:    fmt.Sprintf("%x", hash),
+		Amount: fee,
+	})
+}
+
+// postWithdrawalFees credits the fee address with the withdrawal fees paid by
+// the miners, minus the transaction fee. If the transaction fee is higher,
+// the difference is paid by the pool.
+func postWithdrawalFees(tx *bolt.Tx, w database.Withdrawal) error {
+	var fees uint64
+	for _, d := range w.Destinations {
+		fees += d.Fee
+	}
+
+	postings := []database.Posting{
+		debit(ACCOUNT_WITHDRAWAL_FEES, fees),
+		credit(ACCOUNT_NETWORK_FEES, w.TxFee),
+	}
+	if fees >= w.TxFee {
+		postings = append(postings, credit(addrAccount(ACCOUNT_BALANCE, cfg.Cfg.FeeAddress), fees-w.TxFee))
+	} else {
+		log.Warn("Payout txs total fee is bigger than the revenue fee. Consider increasing withdrawal_fee.")
+		postings = append(postings, debit(ACCOUNT_POOL, w.TxFee-fees))
+	}
+
+	err := postEntry(tx, &database.LedgerEntry{
+		Kind:     database.LEDGER_WITHDRAWAL_FEE,
+		Ref:      strconv.FormatUint(w.Id, 10),
+		Postings: postings,
+	})
+	if err != nil {
+		return err
+	}
+
+	return storeRevenue(tx, database.Revenue{
+		Kind:   database.REVENUE_WITHDRAWAL_FEE,
+		Ref:    strconv.FormatUint(w.Id, 10),
+		Amount: fees,
+		Cost:   w.TxFee,
+	})
+}
+
+// revenueReport returns the revenue between from (included) and to (excluded),
+// grouped by periods of interval seconds, and the total
+func revenueReport(from, to, interval uint64) (periods []RevenuePeriod, total RevenuePeriod) {
+	numPeriods := (to - from + interval - 1) / interval
+	periods = make([]RevenuePeriod, numPeriods)
+	for i := range periods {
+		periods[i].Start = from + uint64(i)*interval
+	}
+	total.Start = from
+
+	DB.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(database.REVENUE).Cursor()
+
+		// revenues are stored in chronological order
+		for k, v := c.Last(); k != nil; k, v = c.Prev() {
+			r := database.Revenue{}
+			err := r.Deserialize(v)
+			if err != nil {
+				log.Err("error reading revenue:", err)
+				continue
+			}
+
+			if r.Time < from {
+				break
+			}
+			if r.Time >= to {
+				continue
+			}
+
+			periods[(r.Time-from)/interval].add(r)
+			total.add(r)
+		}
+		return nil
+	})
+
+	for i := range periods {
+		periods[i].round()
+	}
+	total.round()
+
+	return
+}
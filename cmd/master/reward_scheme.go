@@ -0,0 +1,356 @@
+// Copyright (C) 2024 XELIS
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"math/bits"
+	"sort"
+	"strings"
+	"xelis-pool/cfg"
+	"xelis-pool/database"
+	"xelis-pool/log"
+	"xelis-pool/util"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// RewardScheme decides how the reward of a block is split between miners
+type RewardScheme interface {
+	// Distribute splits reward (the block reward after the pool fee) between
+	// miners using the SHARES bucket. It is called inside a database update,
+	// and it can remove the shares it has consumed.
+	Distribute(tx *bolt.Tx, blockHash [32]byte, reward uint64) (map[string]uint64, error)
+
+	// Prune removes the shares that cannot earn any future reward
+	Prune(tx *bolt.Tx) (removed int, kept int)
+}
+
+// ShareCreditor is implemented by the reward schemes which pay the shares as
+// they are found, from the reserve of the pool, instead of splitting the block
+// rewards. The rewards of the blocks they find are kept by the pool.
+type ShareCreditor interface {
+	// CreditShares returns the amounts earned by the stored shares, at most
+	// reserve in total, and removes the shares it has paid. reward is the
+	// expected block reward after the pool fee.
+	CreditShares(tx *bolt.Tx, reward, reserve uint64) map[string]uint64
+}
+
+var rewardScheme RewardScheme
+
+func NewRewardScheme(name string) (RewardScheme, error) {
+	switch strings.ToLower(name) {
+	case "", "pplns":
+		return PplnsTime{}, nil
+	case "pplns_shares":
+		n := cfg.Cfg.Master.PplnsN
+		if n <= 0 {
+			n = 2
+		}
+		return PplnsShares{N: n}, nil
+	case "pps":
+		return PPS{}, nil
+	case "prop":
+		return PROP{}, nil
+	case "solo":
+		return SOLO{}, nil
+	default:
+		return nil, fmt.Errorf("unknown reward scheme %s", name)
+	}
+}
+
+type storedShare struct {
+	Key []byte
+	database.Share
+}
+
+// loadShares returns the shares in the SHARES bucket from the oldest to the newest.
+// Shares that cannot be read are removed.
+func loadShares(buck *bolt.Bucket) []storedShare {
+	shares := make([]storedShare, 0, buck.Stats().KeyN)
+	var invalid [][]byte
+
+	buck.ForEach(func(k, v []byte) error {
+		sh := database.Share{}
+
+		err := sh.Deserialize(v)
+		if err != nil {
+			log.Warn("error reading share:", err)
+			invalid = append(invalid, k)
+			return nil
+		}
+
+		shares = append(shares, storedShare{
+			Key:   bytes.Clone(k),
+			Share: sh,
+		})
+		return nil
+	})
+
+	for _, k := range invalid {
+		buck.Delete(k)
+	}
+
+	// share ids are stored as little endian, so the bucket isn't sorted by id
+	sort.Slice(shares, func(i, j int) bool {
+		return binary.LittleEndian.Uint64(shares[i].Key) < binary.LittleEndian.Uint64(shares[j].Key)
+	})
+
+	return shares
+}
+
+// splitReward splits reward proportionally to the weight of each address
+func splitReward(weights map[string]float64, reward uint64) map[string]uint64 {
+	var total float64
+	for _, v := range weights {
+		total += v
+	}
+
+	bals := make(map[string]uint64, len(weights))
+	if total == 0 {
+		return bals
+	}
+
+	for addr, v := range weights {
+		bals[addr] = uint64(v * float64(reward) / total)
+	}
+
+	return bals
+}
+
+// pruneOutdated removes the shares older than the PPLNS window
+func pruneOutdated(tx *bolt.Tx) (removed int, kept int) {
+	buck := tx.Bucket(database.SHARES)
+
+	Stats.RLock()
+	window := GetPplnsWindow()
+	Stats.RUnlock()
+
+	for _, sh := range loadShares(buck) {
+		if sh.Time+window < util.Time() {
+			buck.Delete(sh.Key)
+			removed++
+			continue
+		}
+		kept++
+	}
+
+	return
+}
+
+// removeAll removes all the shares, once they have been paid
+func removeAll(buck *bolt.Bucket, shares []storedShare) {
+	for _, sh := range shares {
+		buck.Delete(sh.Key)
+	}
+}
+
+// PplnsTime pays the shares found in the last GetPplnsWindow() seconds
+type PplnsTime struct{}
+
+func (PplnsTime) Distribute(tx *bolt.Tx, _ [32]byte, reward uint64) (map[string]uint64, error) {
+	pruneOutdated(tx)
+
+	weights := make(map[string]float64, 10)
+	for _, sh := range loadShares(tx.Bucket(database.SHARES)) {
+		weights[sh.Wallet] += float64(sh.Diff)
+	}
+
+	log.Dev("total hashes", util.DumpJson(weights))
+
+	return splitReward(weights, reward), nil
+}
+func (PplnsTime) Prune(tx *bolt.Tx) (int, int) {
+	return pruneOutdated(tx)
+}
+
+// PplnsShares pays the last shares whose total difficulty is N times the
+// network difficulty
+type PplnsShares struct {
+	N float64
+}
+
+// Stats must not be locked
+func (p PplnsShares) window() float64 {
+	Stats.RLock()
+	defer Stats.RUnlock()
+
+	return p.N * Stats.Difficulty
+}
+
+func (p PplnsShares) Distribute(tx *bolt.Tx, _ [32]byte, reward uint64) (map[string]uint64, error) {
+	shares := loadShares(tx.Bucket(database.SHARES))
+
+	remaining := p.window()
+	if remaining <= 0 {
+		log.Warn("network difficulty is unknown, PPLNS window includes all the shares")
+		remaining = math.MaxFloat64
+	}
+
+	weights := make(map[string]float64, 10)
+	for i := len(shares) - 1; i >= 0 && remaining > 0; i-- {
+		diff := min(float64(shares[i].Diff), remaining)
+
+		weights[shares[i].Wallet] += diff
+		remaining -= diff
+	}
+
+	log.Dev("total hashes", util.DumpJson(weights))
+
+	return splitReward(weights, reward), nil
+}
+
+// Prune keeps twice the window of shares, so that the window can grow if the
+// network difficulty increases
+func (p PplnsShares) Prune(tx *bolt.Tx) (removed int, kept int) {
+	buck := tx.Bucket(database.SHARES)
+	shares := loadShares(buck)
+
+	remaining := p.window() * 2
+	if remaining <= 0 {
+		return 0, len(shares)
+	}
+
+	for i := len(shares) - 1; i >= 0; i-- {
+		if remaining <= 0 {
+			buck.Delete(shares[i].Key)
+			removed++
+			continue
+		}
+		remaining -= float64(shares[i].Diff)
+		kept++
+	}
+
+	return
+}
+
+// PROP pays all the shares found since the last block
+type PROP struct{}
+
+func (PROP) Distribute(tx *bolt.Tx, _ [32]byte, reward uint64) (map[string]uint64, error) {
+	buck := tx.Bucket(database.SHARES)
+	shares := loadShares(buck)
+
+	weights := make(map[string]float64, 10)
+	for _, sh := range shares {
+		weights[sh.Wallet] += float64(sh.Diff)
+	}
+	removeAll(buck, shares)
+
+	log.Dev("total hashes", util.DumpJson(weights))
+
+	return splitReward(weights, reward), nil
+}
+func (PROP) Prune(tx *bolt.Tx) (int, int) {
+	return 0, len(loadShares(tx.Bucket(database.SHARES)))
+}
+
+// PPS pays every share its expected value, diff / network diff * reward,
+// regardless of the pool luck. Shares are credited by CreditShares as long as
+// the reserve of the pool allows it, and the block rewards are kept by the pool.
+type PPS struct{}
+
+func (PPS) Distribute(*bolt.Tx, [32]byte, uint64) (map[string]uint64, error) {
+	return map[string]uint64{}, nil
+}
+func (PPS) CreditShares(tx *bolt.Tx, reward, reserve uint64) map[string]uint64 {
+	buck := tx.Bucket(database.SHARES)
+	shares := loadShares(buck)
+
+	Stats.RLock()
+	curNetDiff := Stats.Difficulty
+	Stats.RUnlock()
+
+	bals, paid := ppsCredits(shares, curNetDiff, reward, reserve)
+	removeAll(buck, shares[:paid])
+	if paid < len(shares) {
+		log.Warn("PPS:", len(shares)-paid, "shares are waiting for the reserve of the pool")
+	}
+
+	return bals
+}
+func (PPS) Prune(tx *bolt.Tx) (int, int) {
+	return 0, len(loadShares(tx.Bucket(database.SHARES)))
+}
+
+// ppsCredits returns the value of the shares, from the oldest, until the total
+// would exceed reserve, and the number of shares paid. curNetDiff is used for
+// the shares stored without network difficulty.
+func ppsCredits(shares []storedShare, curNetDiff float64, reward, reserve uint64) (map[string]uint64, int) {
+	bals := make(map[string]uint64, 10)
+
+	var total uint64
+	for i, sh := range shares {
+		netDiff := float64(sh.NetDiff)
+		if netDiff == 0 {
+			netDiff = curNetDiff
+		}
+		if netDiff == 0 {
+			log.Warn("PPS: network difficulty is unknown, shares are not credited")
+			return bals, i
+		}
+
+		v := uint64(float64(sh.Diff) / netDiff * float64(reward))
+		if total+v > reserve {
+			return bals, i
+		}
+		total += v
+		if v != 0 {
+			bals[sh.Wallet] += v
+		}
+	}
+
+	return bals, len(shares)
+}
+
+// capRewards scales down the rewards if their sum exceeds limit, and returns
+// their sum
+func capRewards(bals map[string]uint64, limit uint64) uint64 {
+	total := sum(bals)
+	if total <= limit {
+		return total
+	}
+
+	for addr, v := range bals {
+		// v * limit / total, rounded down so that the sum never exceeds limit
+		hi, lo := bits.Mul64(v, limit)
+		bals[addr], _ = bits.Div64(hi, lo, total)
+	}
+	return sum(bals)
+}
+
+// SOLO pays the whole reward to the miner who found the block. If the finder
+// is unknown, the block is paid as PPLNS.
+type SOLO struct{}
+
+func (SOLO) Distribute(tx *bolt.Tx, blockHash [32]byte, reward uint64) (map[string]uint64, error) {
+	finder := tx.Bucket(database.FOUND_BY).Get(blockHash[:])
+
+	if finder == nil {
+		log.Warnf("SOLO: finder of block %x is unknown, paying it as PPLNS", blockHash)
+		return PplnsTime{}.Distribute(tx, blockHash, reward)
+	}
+
+	return map[string]uint64{
+		string(finder): reward,
+	}, nil
+}
+func (SOLO) Prune(tx *bolt.Tx) (int, int) {
+	return pruneOutdated(tx)
+}
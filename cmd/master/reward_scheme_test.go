@@ -0,0 +1,256 @@
+// Copyright (C) 2024 XELIS
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"maps"
+	"math"
+	"path/filepath"
+	"testing"
+	"xelis-pool/cfg"
+	"xelis-pool/database"
+	"xelis-pool/util"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// newTestDB opens an empty database with all the buckets as DB
+func newTestDB(t *testing.T) {
+	t.Helper()
+	Coin = math.Pow10(cfg.Cfg.Atomic)
+
+	db, err := bolt.Open(filepath.Join(t.TempDir(), "pool.db"), 0o600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{database.ADDRESS_INFO, database.SHARES, database.PENDING,
+			database.FOUND_BY, database.SOLO_FOUND, database.BLOCKS, database.BLOCK_INDEX,
+			database.WITHDRAWALS, database.PAYOUTS, database.BLOCK_REWARDS, database.ADDRESS_REWARDS,
+			database.THRESHOLD_REQUESTS, database.SHARE_BATCHES, database.BANS, database.AUDIT_LOG,
+			database.ADJUSTMENTS, database.ADJUSTMENT_INDEX, database.LEDGER, database.LEDGER_INDEX, database.REVENUE} {
+			_, err := tx.CreateBucket(name)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	DB = db
+	t.Cleanup(func() {
+		DB = nil
+		db.Close()
+	})
+}
+
+// setNetwork sets the network difficulty, and a pool hashrate giving a PPLNS
+// window of one hour
+func setNetwork(t *testing.T, difficulty float64) {
+	Stats.Lock()
+	oldDiff, oldNet, oldPool := Stats.Difficulty, Stats.NetHashrate, Stats.PoolHashrate
+	Stats.Difficulty = difficulty
+	Stats.NetHashrate = 1000
+	Stats.PoolHashrate = 1
+	Stats.Unlock()
+
+	t.Cleanup(func() {
+		Stats.Lock()
+		Stats.Difficulty, Stats.NetHashrate, Stats.PoolHashrate = oldDiff, oldNet, oldPool
+		Stats.Unlock()
+	})
+}
+
+func countShares() (n int) {
+	DB.View(func(tx *bolt.Tx) error {
+		n = tx.Bucket(database.SHARES).Stats().KeyN
+		return nil
+	})
+	return
+}
+
+func TestDistribute(t *testing.T) {
+	const reward = 1000_000
+	now := util.Time()
+
+	var hash [32]byte
+	hash[0] = 1
+
+	tests := []struct {
+		name   string
+		scheme RewardScheme
+		shares []database.Share
+		finder string // FOUND_BY entry of the block
+		bals   map[string]uint64
+		kept   int // shares left in the database
+	}{
+		{"pplns", PplnsTime{}, []database.Share{
+			{Wallet: "a", Diff: 100, Time: now - 2*3600}, // out of the window
+			{Wallet: "a", Diff: 100, Time: now - 60},
+			{Wallet: "b", Diff: 300, Time: now - 30},
+		}, "", map[string]uint64{"a": 250_000, "b": 750_000}, 2},
+		{"pplns without shares", PplnsTime{}, nil, "", map[string]uint64{}, 0},
+		{"pplns_shares", PplnsShares{N: 1}, []database.Share{
+			{Wallet: "a", Diff: 600, Time: now - 90}, // only 200 in the window
+			{Wallet: "b", Diff: 600, Time: now - 60},
+			{Wallet: "c", Diff: 200, Time: now - 30},
+		}, "", map[string]uint64{"a": 200_000, "b": 600_000, "c": 200_000}, 3},
+		{"prop", PROP{}, []database.Share{
+			{Wallet: "a", Diff: 1, Time: now - 2*3600},
+			{Wallet: "b", Diff: 1, Time: now - 60},
+			{Wallet: "b", Diff: 1, Time: now - 30},
+		}, "", map[string]uint64{"a": 333_333, "b": 666_666}, 0},
+		{"pps", PPS{}, []database.Share{
+			{Wallet: "a", Diff: 100, Time: now - 60},
+		}, "", map[string]uint64{}, 1},
+		{"solo", SOLO{}, []database.Share{
+			{Wallet: "a", Diff: 100, Time: now - 60},
+		}, "b", map[string]uint64{"b": reward}, 1},
+		{"solo with unknown finder", SOLO{}, []database.Share{
+			{Wallet: "a", Diff: 100, Time: now - 60},
+			{Wallet: "b", Diff: 300, Time: now - 30},
+		}, "", map[string]uint64{"a": 250_000, "b": 750_000}, 2},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			newTestDB(t)
+			setNetwork(t, 1000)
+
+			var bals map[string]uint64
+			err := DB.Update(func(tx *bolt.Tx) error {
+				for _, sh := range test.shares {
+					err := storeShare(tx, sh)
+					if err != nil {
+						return err
+					}
+				}
+				if test.finder != "" {
+					err := tx.Bucket(database.FOUND_BY).Put(hash[:], []byte(test.finder))
+					if err != nil {
+						return err
+					}
+				}
+
+				var err error
+				bals, err = test.scheme.Distribute(tx, hash, reward)
+				return err
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !maps.Equal(bals, test.bals) {
+				t.Errorf("got %v, expected %v", bals, test.bals)
+			}
+			if total := sum(bals); total > reward {
+				t.Errorf("distributed %d, more than the reward %d", total, reward)
+			}
+			if n := countShares(); n != test.kept {
+				t.Errorf("%d shares left, expected %d", n, test.kept)
+			}
+		})
+	}
+}
+
+func TestPPSCreditShares(t *testing.T) {
+	const reward = 1000_000
+	now := util.Time()
+
+	shares := []database.Share{
+		{Wallet: "a", Diff: 10, Time: now - 60, NetDiff: 1000},
+		{Wallet: "b", Diff: 20, Time: now - 50, NetDiff: 2000},
+		{Wallet: "a", Diff: 10, Time: now - 40}, // current difficulty
+		{Wallet: "b", Diff: 50, Time: now - 30, NetDiff: 1000},
+	}
+
+	tests := []struct {
+		name    string
+		reserve uint64
+		bals    map[string]uint64
+		kept    int
+	}{
+		{"large reserve", 1000_000, map[string]uint64{"a": 30_000, "b": 60_000}, 0},
+		{"reserve for the 3 oldest shares", 89_999, map[string]uint64{"a": 30_000, "b": 10_000}, 1},
+		{"reserve smaller than the oldest share", 9_999, map[string]uint64{}, 4},
+		{"no reserve", 0, map[string]uint64{}, 4},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			newTestDB(t)
+			setNetwork(t, 500)
+
+			var bals map[string]uint64
+			err := DB.Update(func(tx *bolt.Tx) error {
+				for _, sh := range shares {
+					err := storeShare(tx, sh)
+					if err != nil {
+						return err
+					}
+				}
+
+				bals = PPS{}.CreditShares(tx, reward, test.reserve)
+				return nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !maps.Equal(bals, test.bals) {
+				t.Errorf("got %v, expected %v", bals, test.bals)
+			}
+			if total := sum(bals); total > test.reserve {
+				t.Errorf("credited %d, more than the reserve %d", total, test.reserve)
+			}
+			if n := countShares(); n != test.kept {
+				t.Errorf("%d shares left, expected %d", n, test.kept)
+			}
+		})
+	}
+}
+
+func TestCapRewards(t *testing.T) {
+	tests := []struct {
+		bals  map[string]uint64
+		limit uint64
+		total uint64
+	}{
+		{map[string]uint64{"a": 10, "b": 20}, 30, 30},
+		{map[string]uint64{"a": 10, "b": 20}, 100, 30},
+		{map[string]uint64{"a": 10, "b": 20}, 15, 15},
+		{map[string]uint64{"a": 1, "b": 1, "c": 1}, 2, 0},
+		{map[string]uint64{"a": math.MaxUint64 / 2, "b": math.MaxUint64 / 2}, 1000_000, 1000_000},
+		{map[string]uint64{}, 0, 0},
+	}
+
+	for _, test := range tests {
+		bals := maps.Clone(test.bals)
+		total := capRewards(bals, test.limit)
+
+		if total != test.total || total != sum(bals) || total > test.limit {
+			t.Errorf("%v capped to %d: got %v (total %d), expected a total of %d", test.bals, test.limit, bals, total, test.total)
+		}
+		for addr, v := range bals {
+			if v > test.bals[addr] {
+				t.Errorf("%v capped to %d: %s was increased to %d", test.bals, test.limit, addr, v)
+			}
+		}
+	}
+}
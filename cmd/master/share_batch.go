@@ -0,0 +1,154 @@
+// Copyright (C) 2024 XELIS
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"sync"
+	"xelis-pool/database"
+	"xelis-pool/log"
+	"xelis-pool/serializer"
+	"xelis-pool/util"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// received batch ids are kept for this many seconds, slaves must not replay
+// older batches
+const SHARE_BATCH_RETENTION = 7 * 24 * 3600
+
+// batchMut serializes share batches, so a batch received twice (for example
+// after a reconnection) is only counted once
+var batchMut sync.Mutex
+
+type BatchShare struct {
+	Wallet    string
+	Worker    string
+	NumShares uint32
+	Diff      uint64
+	Solo      bool
+}
+
+// OnShareBatch adds the shares of a batch, unless it has already been received.
+// Returns an error if the batch must not be acknowledged.
+// Stats must not be locked.
+func OnShareBatch(ip string, spoolId, batchId, batchTime uint64, shares []BatchShare) error {
+	batchMut.Lock()
+	defer batchMut.Unlock()
+
+	key := database.ShareBatchKey(spoolId, batchId)
+
+	var duplicate bool
+	DB.View(func(tx *bolt.Tx) error {
+		duplicate = tx.Bucket(database.SHARE_BATCHES).Get(key) != nil
+		return nil
+	})
+	if duplicate {
+		log.Debugf("slave %s: batch %x/%d already received", ip, spoolId, batchId)
+		return nil
+	}
+
+	type storedBatchShare struct {
+		BatchShare
+		share database.Share
+	}
+
+	toStore := make([]storedBatchShare, 0, len(shares))
+	for _, v := range shares {
+		if v.Solo {
+			toStore = append(toStore, storedBatchShare{BatchShare: v})
+			continue
+		}
+
+		share, ok := newShare(ip, v.Wallet, v.Diff)
+		if !ok {
+			continue
+		}
+
+		// replayed batches keep the time they were found at
+		share.Time = min(share.Time, batchTime)
+
+		toStore = append(toStore, storedBatchShare{v, share})
+	}
+
+	err := DB.Update(func(tx *bolt.Tx) error {
+		for _, v := range toStore {
+			if v.Solo {
+				continue
+			}
+			err := storeShare(tx, v.share)
+			if err != nil {
+				return err
+			}
+		}
+
+		return tx.Bucket(database.SHARE_BATCHES).Put(key, util.Itob(util.Time()))
+	})
+	if err != nil {
+		return err
+	}
+
+	// the stats are only updated once the batch is stored, so that a batch sent
+	// again after a failure isn't counted twice
+	for _, v := range toStore {
+		if v.Solo {
+			addSoloShare(ip, v.Wallet, v.Worker, v.Diff, v.NumShares)
+		} else {
+			addShareStats(ip, v.share, v.Worker, v.NumShares)
+		}
+	}
+
+	return nil
+}
+
+// cleanupShareBatches removes the batch ids older than SHARE_BATCH_RETENTION
+func cleanupShareBatches(tx *bolt.Tx) (removed int) {
+	buck := tx.Bucket(database.SHARE_BATCHES)
+
+	var old [][]byte
+	buck.ForEach(func(k, v []byte) error {
+		d := serializer.Deserializer{
+			Data: v,
+		}
+		if d.ReadUint64()+SHARE_BATCH_RETENTION < util.Time() {
+			old = append(old, bytes.Clone(k))
+		}
+		return nil
+	})
+
+	for _, k := range old {
+		buck.Delete(k)
+	}
+
+	return len(old)
+}
+
+// batch acknowledgement master to slave packet
+type batchAckM2S struct {
+	SpoolId uint64
+	BatchId uint64
+}
+
+func (b batchAckM2S) Serialize() []byte {
+	s := serializer.Serializer{
+		Data: []byte{1}, // packet MasterToSlave id 1
+	}
+
+	s.AddUint64(b.SpoolId)
+	s.AddUvarint(b.BatchId)
+
+	return s.Data
+}
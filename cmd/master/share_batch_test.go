@@ -0,0 +1,89 @@
+// Copyright (C) 2024 XELIS
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"testing"
+	"xelis-pool/cfg"
+	"xelis-pool/util"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+func TestShareBatchReplayAfterFailure(t *testing.T) {
+	newTestDB(t)
+	t.Chdir(t.TempDir()) // the stats are saved to stats.json
+
+	Stats.Lock()
+	oldRound := Stats.Round
+	Stats.Round = Round{}
+	Stats.Unlock()
+	t.Cleanup(func() {
+		Stats.Lock()
+		Stats.Round = oldRound
+		Stats.Unlock()
+	})
+
+	roundShares := func() uint64 {
+		Stats.RLock()
+		defer Stats.RUnlock()
+		return Stats.Round.Shares
+	}
+
+	batch := []BatchShare{
+		{Wallet: cfg.Cfg.FeeAddress, Worker: "x", NumShares: 2, Diff: 100},
+		{Wallet: cfg.Cfg.FeeAddress, Worker: "y", NumShares: 3, Diff: 100},
+	}
+
+	// the database can't be updated, the batch must not be counted
+	path := DB.Path()
+	DB.Close()
+	ro, err := bolt.Open(path, 0o600, &bolt.Options{ReadOnly: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	DB = ro
+
+	err = OnShareBatch("test", 1, 1, util.Time(), batch)
+	if err == nil {
+		t.Fatal("batch acknowledged by a read-only database")
+	}
+	if n := roundShares(); n != 0 {
+		t.Errorf("failed batch added %d shares to the round", n)
+	}
+	ro.Close()
+
+	// the slave sends it again
+	rw, err := bolt.Open(path, 0o600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	DB = rw
+	t.Cleanup(func() { rw.Close() })
+
+	for i := 0; i < 2; i++ {
+		err = OnShareBatch("test", 1, 1, util.Time(), batch)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n := roundShares(); n != 5 {
+			t.Errorf("attempt %d: round has %d shares, expected 5", i+1, n)
+		}
+	}
+	if n := countShares(); n != 2 {
+		t.Errorf("%d shares stored, expected 2", n)
+	}
+}
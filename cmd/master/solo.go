@@ -0,0 +1,110 @@
+// Copyright (C) 2024 XELIS
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"math"
+	"slices"
+	"xelis-pool/address"
+	"xelis-pool/config"
+	"xelis-pool/log"
+	"xelis-pool/util"
+)
+
+// Solo miners use the pool infrastructure, but their shares are not part of the
+// pool rounds and the blocks they find are paid to them only.
+
+type SoloStats struct {
+	Hashrate float64
+
+	Miners map[string]SoloMiner // address -> solo miner
+
+	BlocksFound []FoundInfo
+	NumFound    int32
+}
+
+type SoloMiner struct {
+	KnownAddress
+	Round Round // work since the last block found by the miner
+}
+
+// addSoloShare adds the shares of a solo miner to the stats. Solo shares are not
+// stored, as they are never paid.
+// Stats must not be locked.
+func addSoloShare(ip string, wallet, worker string, diff uint64, numShares uint32) {
+	if !address.IsAddressValid(wallet) {
+		log.Warn("slave "+ip+": solo wallet", wallet, "is not valid, ignoring the share")
+		return
+	}
+	if slices.Contains(config.BANNED_ADDRESSES, wallet) {
+		log.Warn("slave "+ip+": wallet", wallet, "is banned, ignoring the share")
+		return
+	}
+
+	Stats.Lock()
+	defer Stats.Unlock()
+
+	if Stats.Solo.Miners == nil {
+		Stats.Solo.Miners = make(map[string]SoloMiner)
+	}
+
+	m := Stats.Solo.Miners[wallet]
+	m.AddShare(float64(diff), util.TimePrecise())
+	m.Round.AddShare(float64(diff), numShares, Stats.Difficulty)
+	Stats.Solo.Miners[wallet] = m
+
+	log.Info("slave "+ip+": Solo wallet", wallet, "worker", worker, "found", numShares, "shares with diff", float64(diff/100)/10, "k HR:", m.AvgHashrate)
+}
+
+// endSoloRound resets the round of a solo miner who found a block, and returns it.
+// Stats must be locked.
+func (s *Statistics) endSoloRound(finder string) Round {
+	m := s.Solo.Miners[finder]
+	round := m.Round
+
+	m.Round = Round{
+		Start: util.Time(),
+	}
+	if s.Solo.Miners != nil {
+		s.Solo.Miners[finder] = m
+	}
+
+	return round
+}
+
+// cleanupSolo removes the solo miners without shares in the last 24 hours, and
+// updates the solo hashrate. The round of a removed miner is lost: their solo
+// effort starts from zero when they mine again.
+// Stats must be locked.
+func (s *Statistics) cleanupSolo() {
+	var totalHr float64
+
+	for addr, m := range s.Solo.Miners {
+		if m.LastShare+3600*24 <= util.TimePrecise() {
+			delete(s.Solo.Miners, addr)
+			continue
+		}
+
+		totalHr += m.GetHashrate()
+		s.Solo.Miners[addr] = m
+	}
+
+	s.Solo.Hashrate = math.Round(totalHr)
+
+	for len(s.Solo.BlocksFound) > 100 {
+		s.Solo.BlocksFound = s.Solo.BlocksFound[:len(s.Solo.BlocksFound)-1]
+	}
+}
@@ -51,18 +51,23 @@ type Statistics struct {
 	PoolHashrateChart []Hr
 	HashrateCharts    map[string][]Hr
 
-	Hashes float64
+	Round Round
 
 	LastBlock LastBlock
 
 	BlocksFound []FoundInfo
 	NumFound    int32
 
+	Solo SoloStats
+
 	NetHashrate float64
 	Difficulty  float64
 
 	KnownAddresses map[string]KnownAddress
 
+	KnownWorkers map[string]map[string]KnownAddress // address -> worker name -> worker stats
+	WorkerCharts map[string]map[string][]Hr         // address -> worker name -> hashrate chart
+
 	RecentWithdrawals []Withdrawal
 
 	Workers        uint32 // the current number of miners
@@ -72,6 +77,27 @@ type Statistics struct {
 	sync.RWMutex
 }
 
+// Round is the work submitted since the last block found
+type Round struct {
+	Start  uint64  // UNIX timestamp
+	Shares uint64  // number of shares
+	Hashes float64 // sum of the share difficulties
+	Effort float64 // sum of share difficulty / network difficulty at the time of the share
+}
+
+// AddShare adds shares with a total difficulty of diff, found when the network
+// difficulty was netDiff
+func (r *Round) AddShare(diff float64, count uint32, netDiff float64) {
+	if r.Start == 0 {
+		r.Start = util.Time()
+	}
+	r.Shares += uint64(count)
+	r.Hashes += diff
+	if netDiff > 0 {
+		r.Effort += diff / netDiff
+	}
+}
+
 type Withdrawal struct {
 	Txid         string `json:"txid"`
 	Timestamp    uint64 `json:"time"`
@@ -93,6 +119,8 @@ type FoundInfo struct {
 var Stats = Statistics{
 	HashrateCharts: make(map[string][]Hr),
 	KnownAddresses: make(map[string]KnownAddress, NUM_CHART_DATA),
+	KnownWorkers:   make(map[string]map[string]KnownAddress),
+	WorkerCharts:   make(map[string]map[string][]Hr),
 }
 
 type KnownAddress struct {
@@ -200,9 +228,13 @@ func StatsServer() {
 				if !didFind {
 					delete(Stats.KnownAddresses, i)
 					delete(Stats.HashrateCharts, i)
+					delete(Stats.KnownWorkers, i)
+					delete(Stats.WorkerCharts, i)
 				}
 			}
 
+			Stats.updateWorkerCharts()
+
 			Stats.WorkersChart = append(Stats.WorkersChart, Stats.Workers)
 			Stats.AddressesChart = append(Stats.AddressesChart, uint32(len(Stats.KnownAddresses)))
 			Stats.PoolHashrateChart = append(Stats.PoolHashrateChart, Hr{
@@ -222,6 +254,68 @@ func StatsServer() {
 	}
 }
 
+// Stats MUST be locked
+func (s *Statistics) AddWorkerShare(wallet, worker string, diff float64) {
+	if s.KnownWorkers == nil {
+		s.KnownWorkers = make(map[string]map[string]KnownAddress)
+	}
+
+	workers := s.KnownWorkers[wallet]
+	if workers == nil {
+		workers = make(map[string]KnownAddress, 1)
+		s.KnownWorkers[wallet] = workers
+	}
+
+	kworker := workers[worker]
+	kworker.AddShare(diff, util.TimePrecise())
+	workers[worker] = kworker
+}
+
+// Adds a data point to the hashrate chart of each worker, and removes the
+// workers that have been offline for the whole chart.
+// Stats MUST be locked
+func (s *Statistics) updateWorkerCharts() {
+	if s.WorkerCharts == nil {
+		s.WorkerCharts = make(map[string]map[string][]Hr)
+	}
+
+	for addr, workers := range s.KnownWorkers {
+		charts := s.WorkerCharts[addr]
+		if charts == nil {
+			charts = make(map[string][]Hr, len(workers))
+			s.WorkerCharts[addr] = charts
+		}
+
+		for name, w := range workers {
+			hr := w.GetHashrate()
+
+			charts[name] = append(charts[name], Hr{
+				Time:     s.LastUpdate,
+				Hashrate: math.Round(hr),
+			})
+			for len(charts[name]) > NUM_CHART_DATA {
+				charts[name] = charts[name][1:]
+			}
+
+			didFind := false
+			for _, v := range charts[name] {
+				if v.Hashrate != 0 {
+					didFind = true
+				}
+			}
+			if !didFind {
+				delete(workers, name)
+				delete(charts, name)
+			}
+		}
+
+		if len(workers) == 0 {
+			delete(s.KnownWorkers, addr)
+			delete(s.WorkerCharts, addr)
+		}
+	}
+}
+
 // Stats MUST be at least RLocked
 func (s *Statistics) GetHashrate(wallet string) float64 {
 	kaddr := s.KnownAddresses[wallet]
@@ -246,7 +340,24 @@ func (s *Statistics) Cleanup() {
 
 	s.KnownAddresses = kaddr
 
+	// clean up known workers
+	for addr, workers := range s.KnownWorkers {
+		if _, ok := kaddr[addr]; !ok {
+			delete(s.KnownWorkers, addr)
+			delete(s.WorkerCharts, addr)
+			continue
+		}
+
+		for name, w := range workers {
+			if w.LastShare+3600*24 <= util.TimePrecise() {
+				delete(workers, name)
+				delete(s.WorkerCharts[addr], name)
+			}
+		}
+	}
+
 	s.PoolHashrate = math.Round(totalHr)
+	s.cleanupSolo()
 
 	data, err := json.Marshal(s)
 	if err != nil {
@@ -0,0 +1,266 @@
+// Copyright (C) 2024 XELIS
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"math"
+	"slices"
+	"strings"
+	"xelis-pool/cfg"
+	"xelis-pool/config"
+	"xelis-pool/database"
+	"xelis-pool/log"
+	"xelis-pool/util"
+
+	"github.com/xelis-project/xelis-go-sdk/wallet"
+	bolt "go.etcd.io/bbolt"
+)
+
+// a threshold request must be proven within this many seconds
+const THRESHOLD_REQUEST_EXPIRY = 24 * 3600
+
+// maximum number of pending threshold requests of an address. When it's
+// reached, the oldest request is replaced.
+const MAX_THRESHOLD_REQUESTS = 20
+
+var errNoThresholdRequest = errors.New("no pending threshold request")
+var errProofNotFound = errors.New("proof of ownership not found")
+
+// payoutThreshold returns the minimum balance for the address to be paid
+func payoutThreshold(addrInfo database.AddrInfo) uint64 {
+	return max(uint64(cfg.Cfg.Master.MinWithdrawal*math.Pow10(cfg.Cfg.Atomic)), addrInfo.PayoutThreshold)
+}
+
+// requestThreshold stores a threshold change for the address. The change is
+// applied by verifyThreshold once the address has sent to the pool wallet a
+// transfer with the returned code as extra data.
+// Anyone can request a threshold for any address, so an address can have
+// several pending requests, and the proof transfer chooses which one applies.
+func requestThreshold(addr string, threshold uint64) (database.ThresholdRequest, error) {
+	topo, err := newWalletRPC().GetTopoheight()
+	if err != nil {
+		return database.ThresholdRequest{}, err
+	}
+
+	var code [8]byte
+	_, err = rand.Read(code[:])
+	if err != nil {
+		return database.ThresholdRequest{}, err
+	}
+
+	req := database.ThresholdRequest{
+		Threshold:  threshold,
+		Code:       hex.EncodeToString(code[:]),
+		Topoheight: topo,
+		Expires:    util.Time() + THRESHOLD_REQUEST_EXPIRY,
+	}
+
+	err = DB.Update(func(tx *bolt.Tx) error {
+		buck := tx.Bucket(database.THRESHOLD_REQUESTS)
+
+		pending := pendingThresholdRequests(tx, addr)
+		for len(pending) >= MAX_THRESHOLD_REQUESTS {
+			oldest := slices.MinFunc(pending, func(a, b database.ThresholdRequest) int {
+				return cmp.Compare(a.Expires, b.Expires)
+			})
+			err := buck.Delete(database.ThresholdRequestKey(addr, oldest.Code))
+			if err != nil {
+				return err
+			}
+			pending = slices.DeleteFunc(pending, func(r database.ThresholdRequest) bool {
+				return r.Code == oldest.Code
+			})
+		}
+
+		return buck.Put(database.ThresholdRequestKey(addr, req.Code), req.Serialize())
+	})
+
+	return req, err
+}
+
+// pendingThresholdRequests returns the unexpired threshold requests of the address
+func pendingThresholdRequests(tx *bolt.Tx, addr string) []database.ThresholdRequest {
+	var reqs []database.ThresholdRequest
+
+	prefix := append([]byte(addr), 0)
+	c := tx.Bucket(database.THRESHOLD_REQUESTS).Cursor()
+	for k, v := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = c.Next() {
+		req := database.ThresholdRequest{}
+		err := req.Deserialize(v)
+		if err != nil {
+			log.Err("error reading threshold request:", err)
+			continue
+		}
+		if req.Expires >= util.Time() {
+			reqs = append(reqs, req)
+		}
+	}
+
+	return reqs
+}
+
+// findThresholdProof returns the request whose code is in the extra data of
+// the most recent transfer sent by the address to the pool wallet after the
+// request was made, and the amount of the transfer
+func findThresholdProof(txs []wallet.TransactionEntry, addr string, reqs []database.ThresholdRequest) (req database.ThresholdRequest, amount uint64, found bool) {
+	var proofTopo uint64
+	for _, v := range txs {
+		if v.Incoming == nil || v.Incoming.From != addr || (found && v.Topoheight <= proofTopo) {
+			continue
+		}
+
+		for _, t := range v.Incoming.Transfers {
+			if t.ExtraData == nil || t.Asset != config.ASSET {
+				continue
+			}
+
+			// the shape of extra data depends on the wallet, just look for the code
+			extra, err := json.Marshal(t.ExtraData)
+			if err != nil {
+				continue
+			}
+
+			i := slices.IndexFunc(reqs, func(r database.ThresholdRequest) bool {
+				return v.Topoheight >= r.Topoheight && strings.Contains(string(extra), r.Code)
+			})
+			if i == -1 {
+				continue
+			}
+
+			log.Info("address", addr, "proved ownership in transaction", v.Hash)
+			req = reqs[i]
+			amount = t.Amount
+			proofTopo = v.Topoheight
+			found = true
+			break
+		}
+	}
+
+	return
+}
+
+// verifyThreshold looks for the proof of a pending threshold request of the
+// address in the wallet, and applies its threshold. The other requests of the
+// address are removed. The amount of the proof transfer is credited to the
+// address.
+func verifyThreshold(addr string) (uint64, error) {
+	var reqs []database.ThresholdRequest
+	err := DB.View(func(tx *bolt.Tx) error {
+		reqs = pendingThresholdRequests(tx, addr)
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	if len(reqs) == 0 {
+		return 0, errNoThresholdRequest
+	}
+
+	minTopo := reqs[0].Topoheight
+	for _, r := range reqs {
+		minTopo = min(minTopo, r.Topoheight)
+	}
+
+	txs, err := newWalletRPC().ListTransactions(wallet.ListTransactionsParams{
+		MinTopoheight:  &minTopo,
+		Address:        &addr,
+		AcceptIncoming: true,
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	req, proofAmount, found := findThresholdProof(txs, addr, reqs)
+	if !found {
+		return 0, errProofNotFound
+	}
+
+	err = DB.Update(func(tx *bolt.Tx) error {
+		reqBuck := tx.Bucket(database.THRESHOLD_REQUESTS)
+
+		// make sure that the proof isn't used twice
+		if reqBuck.Get(database.ThresholdRequestKey(addr, req.Code)) == nil {
+			return errNoThresholdRequest
+		}
+		for _, r := range reqs {
+			err := reqBuck.Delete(database.ThresholdRequestKey(addr, r.Code))
+			if err != nil {
+				return err
+			}
+		}
+
+		// the proof transfer is added to the balance of the address
+		err = postEntry(tx, &database.LedgerEntry{
+			Kind: database.LEDGER_DEPOSIT,
+			Ref:  addr,
+			Postings: []database.Posting{
+				debit(ACCOUNT_DEPOSITS, proofAmount),
+				credit(addrAccount(ACCOUNT_BALANCE, addr), proofAmount),
+			},
+		})
+		if err != nil {
+			return err
+		}
+
+		buck := tx.Bucket(database.ADDRESS_INFO)
+
+		addrInfo := database.AddrInfo{}
+		if addrInfoBin := buck.Get([]byte(addr)); addrInfoBin != nil {
+			err := addrInfo.Deserialize(addrInfoBin)
+			if err != nil {
+				return err
+			}
+		}
+
+		addrInfo.PayoutThreshold = req.Threshold
+
+		return buck.Put([]byte(addr), addrInfo.Serialize())
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	log.Infof("address %s set payout threshold to %f", addr, float64(req.Threshold)/math.Pow10(cfg.Cfg.Atomic))
+
+	return req.Threshold, nil
+}
+
+// cleanupThresholdRequests removes the expired threshold requests
+func cleanupThresholdRequests(tx *bolt.Tx) (removed int) {
+	buck := tx.Bucket(database.THRESHOLD_REQUESTS)
+
+	var expired [][]byte
+	buck.ForEach(func(k, v []byte) error {
+		req := database.ThresholdRequest{}
+		err := req.Deserialize(v)
+		if err != nil || req.Expires < util.Time() {
+			expired = append(expired, bytes.Clone(k))
+		}
+		return nil
+	})
+
+	for _, k := range expired {
+		buck.Delete(k)
+	}
+
+	return len(expired)
+}
@@ -0,0 +1,77 @@
+// Copyright (C) 2024 XELIS
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"testing"
+	"xelis-pool/config"
+	"xelis-pool/database"
+
+	"github.com/xelis-project/xelis-go-sdk/wallet"
+)
+
+func proofTx(from string, topo, amount uint64, extra string) wallet.TransactionEntry {
+	var data interface{} = extra
+	return wallet.TransactionEntry{
+		Hash:       "tx",
+		Topoheight: topo,
+		Incoming: &wallet.Incoming{
+			From: from,
+			Transfers: []wallet.TransferIn{{
+				Amount:    amount,
+				Asset:     config.ASSET,
+				ExtraData: &data,
+			}},
+		},
+	}
+}
+
+func TestFindThresholdProof(t *testing.T) {
+	const owner = "xel:owner"
+
+	// the first request is made by someone else, the owner proves the second one
+	reqs := []database.ThresholdRequest{
+		{Threshold: 1000, Code: "aaaa", Topoheight: 10},
+		{Threshold: 5, Code: "bbbb", Topoheight: 20},
+		{Threshold: 7, Code: "cccc", Topoheight: 50},
+	}
+
+	tests := []struct {
+		name      string
+		txs       []wallet.TransactionEntry
+		found     bool
+		threshold uint64
+		amount    uint64
+	}{
+		{"no transfer", nil, false, 0, 0},
+		{"proof of the owner", []wallet.TransactionEntry{proofTx(owner, 25, 3, "bbbb")}, true, 5, 3},
+		{"transfer from another address", []wallet.TransactionEntry{proofTx("xel:other", 25, 3, "aaaa")}, false, 0, 0},
+		{"transfer before the request", []wallet.TransactionEntry{proofTx(owner, 40, 3, "cccc")}, false, 0, 0},
+		{"unknown code", []wallet.TransactionEntry{proofTx(owner, 60, 3, "dddd")}, false, 0, 0},
+		{"most recent proof", []wallet.TransactionEntry{
+			proofTx(owner, 60, 4, "cccc"),
+			proofTx(owner, 25, 3, "bbbb"),
+		}, true, 7, 4},
+	}
+
+	for _, test := range tests {
+		req, amount, found := findThresholdProof(test.txs, owner, reqs)
+		if found != test.found || req.Threshold != test.threshold || amount != test.amount {
+			t.Errorf("%s: got threshold %d amount %d found %v, expected %d %d %v", test.name,
+				req.Threshold, amount, found, test.threshold, test.amount, test.found)
+		}
+	}
+}
@@ -53,6 +53,8 @@ func Updater() {
 					}
 				}
 				log.Info("Withdraw() loop done")
+
+				DatabaseCleanup()
 			}()
 			time.Sleep(time.Duration(config.WITHDRAW_INTERVAL) * time.Second)
 		}
@@ -113,6 +115,12 @@ func Updater() {
 				} else {
 					log.Debug("CheckWithdraw(): no balances have been updated")
 				}
+
+				// pay the PPS shares
+				CreditPPS()
+
+				// confirm broadcast withdrawals
+				ReconcileWithdrawals()
 			}()
 
 		} else {
@@ -209,54 +217,12 @@ func UpdatePendingBals() {
 		}
 		minHeightMut.Unlock()
 
-		var totalPendings = make(map[string]uint64)
-
 		nextHeight := pending.LastHeight
 
 		for _, vt := range transfers {
 			if vt.Topoheight > pending.LastHeight {
 				log.DEBUG("transfer is fine! adding unconfirmed balance to it")
 
-				rewardNoFee := float64(vt.Coinbase.Reward)
-				log.Debug("reward before fee is", rewardNoFee/Coin)
-
-				fee := cfg.Cfg.Master.FeePercent
-
-				reward := rewardNoFee * (100 - fee) / 100
-				log.Debug("reward after fee is", reward/Coin)
-
-				var totHashes float64
-				var minersTotalHashes = make(map[string]float64, 10)
-
-				buck := tx.Bucket(database.SHARES)
-
-				c := buck.Cursor()
-
-				for key, v := c.First(); key != nil; key, v = c.Next() {
-					sh := database.Share{}
-
-					err := sh.Deserialize(v)
-
-					if err != nil {
-						log.Err("error reading share:", err)
-						continue
-					}
-
-					Stats.RLock()
-					// delete outdated shares
-					if sh.Time+GetPplnsWindow() < util.Time() {
-						Stats.RUnlock()
-						buck.Delete(key)
-						continue
-					}
-					Stats.RUnlock()
-
-					totHashes += float64(sh.Diff)
-					minersTotalHashes[sh.Wallet] += float64(sh.Diff)
-
-					// log.Dev("block payout: adding share", sh.Wallet, ",", sh.Diff)
-				}
-
 				log.Dev("transaction entry", vt)
 
 				txHashBin, err := hex.DecodeString(vt.Hash)
@@ -269,32 +235,11 @@ func UpdatePendingBals() {
 					return fmt.Errorf("tx hash length is not 32 bytes")
 				}
 
-				pendBals := database.UnconfTx{
-					UnlockHeight: vt.Topoheight + cfg.Cfg.Master.MinConfs,
-					Bals:         make(map[string]uint64),
-					TxnBlockHash: [32]byte(txHashBin),
-				}
-
-				var minersBalances = make(map[string]float64, len(minersTotalHashes))
-				var totalRewarded uint64 // totalReward is slightly smaller than rewardNoFee because of uint64 rounding error
-				for i, v := range minersTotalHashes {
-					minersBalances[i] = v * float64(reward) / totHashes
-
-					x := uint64(v * float64(reward) / totHashes)
-					pendBals.Bals[i] = x
-
-					totalPendings[i] += x
-
-					totalRewarded += x
+				pendBals, err := creditCoinbase(tx, [32]byte(txHashBin), vt.Topoheight, vt.Coinbase.Reward)
+				if err != nil {
+					log.Err(err)
+					return err
 				}
-				pendBals.Bals[cfg.Cfg.FeeAddress] += uint64(rewardNoFee) - totalRewarded
-
-				totalPendings[cfg.Cfg.FeeAddress] += pendBals.Bals[cfg.Cfg.FeeAddress]
-
-				log.Debug("Fee wallet has earned", (rewardNoFee-float64(totalRewarded))/math.Pow10(cfg.Cfg.Atomic))
-
-				log.Dev("total hashes", util.DumpJson(minersTotalHashes))
-				log.Dev("balances", util.DumpJson(minersBalances))
 
 				if pending.UnconfirmedTxs == nil {
 					pending.UnconfirmedTxs = make([]database.UnconfTx, 0, 10)
@@ -316,38 +261,154 @@ func UpdatePendingBals() {
 
 		pending.LastHeight = nextHeight
 
-		infoBuck := tx.Bucket(database.ADDRESS_INFO)
+		return pendingBuck.Put([]byte("pending"), pending.Serialize())
+	})
 
-		c := infoBuck.Cursor()
+	if err != nil {
+		log.Err(err)
+	}
+}
 
-		for k, infoBin := c.First(); k != nil; k, infoBin = c.Next() {
-			pendBal := totalPendings[string(k)]
+// creditCoinbase credits the pending balances with the reward of a block found
+// by the pool, received by the wallet at topoheight, and returns them
+func creditCoinbase(tx *bolt.Tx, hash [32]byte, topoheight, coinbase uint64) (database.UnconfTx, error) {
+	// blocks found by solo miners are paid to the finder only
+	soloFinder := tx.Bucket(database.SOLO_FOUND).Get(hash[:])
 
-			log.Devf("Setting pending %s to %f", k, float64(pendBal)/math.Pow10(cfg.Cfg.Atomic))
+	rewardNoFee := float64(coinbase)
+	log.Debug("reward before fee is", rewardNoFee/Coin)
 
-			addrInfo := database.AddrInfo{}
-			if infoBin == nil {
-				log.Warn("infoBin is nil")
-			} else {
-				err = addrInfo.Deserialize(infoBin)
-				if err != nil {
-					log.Warn(err)
-					continue
-				}
-			}
+	fee := cfg.Cfg.Master.FeePercent
+	if soloFinder != nil {
+		fee = cfg.Cfg.Master.SoloFeePercent
+	}
+
+	reward := rewardNoFee * (100 - fee) / 100
+	log.Debug("reward after fee is", reward/Coin)
 
-			addrInfo.BalancePending = pendBal
+	// under PPS, the pool keeps the reward of its blocks as the reserve which pays the shares
+	var kept uint64
 
-			err := infoBuck.Put(k, addrInfo.Serialize())
+	pendBals := database.UnconfTx{
+		UnlockHeight: topoheight + cfg.Cfg.Master.MinConfs,
+		TxnBlockHash: hash,
+	}
+
+	if soloFinder != nil {
+		log.Infof("block %x was found by solo miner %s", hash, soloFinder)
+		pendBals.Bals = map[string]uint64{
+			string(soloFinder): uint64(reward),
+		}
+		tx.Bucket(database.SOLO_FOUND).Delete(hash[:])
+	} else {
+		var err error
+		pendBals.Bals, err = rewardScheme.Distribute(tx, pendBals.TxnBlockHash, uint64(reward))
+		if err != nil {
+			return pendBals, err
+		}
+		if _, ok := rewardScheme.(ShareCreditor); ok {
+			kept = uint64(reward)
+		}
+	}
+	tx.Bucket(database.FOUND_BY).Delete(hash[:])
+
+	// the miners never earn more than the block reward
+	available := uint64(rewardNoFee) - kept
+	totalRewarded := sum(pendBals.Bals) // slightly smaller than the reward because of uint64 rounding error
+	if totalRewarded > available {
+		log.Warn("miners have earned more than the block reward, scaling down their rewards")
+		totalRewarded = capRewards(pendBals.Bals, available)
+	}
+
+	poolFee := available - totalRewarded
+	if poolFee != 0 {
+		pendBals.Bals[cfg.Cfg.FeeAddress] += poolFee
+	}
+
+	log.Debug("Fee wallet has earned", float64(pendBals.Bals[cfg.Cfg.FeeAddress])/math.Pow10(cfg.Cfg.Atomic))
+
+	err := creditBlock(tx, pendBals.TxnBlockHash, pendBals.Bals, poolFee)
+	if err != nil {
+		return pendBals, err
+	}
+	err = updateBlockStatus(tx, pendBals.TxnBlockHash, database.BLOCK_PENDING, func(bl *database.Block) {
+		bl.PoolFee = poolFee
+	})
+	if err != nil {
+		return pendBals, err
+	}
+
+	log.Dev("balances", util.DumpJson(pendBals.Bals))
+
+	return pendBals, nil
+}
+
+// CreditPPS credits the PPS shares to the miners, as long as the wallet holds
+// more than the balances of the miners. It does nothing with the other reward
+// schemes.
+func CreditPPS() {
+	creditor, ok := rewardScheme.(ShareCreditor)
+	if !ok {
+		return
+	}
+
+	// the wallet balance isn't reliable while a withdrawal is in progress
+	withdrawMut.Lock()
+	defer withdrawMut.Unlock()
+
+	MasterInfo.RLock()
+	height := MasterInfo.Height
+	reward := uint64(float64(MasterInfo.BlockReward) * (100 - cfg.Cfg.Master.FeePercent) / 100)
+	MasterInfo.RUnlock()
+
+	if reward == 0 {
+		log.Debug("CreditPPS: block reward is unknown")
+		return
+	}
+
+	balance, err := newWalletRPC().GetBalance(wallet.GetBalanceParams{
+		Asset: config.ASSET,
+	})
+	if err != nil {
+		log.Warn("CreditPPS:", err)
+		return
+	}
+
+	err = DB.Update(func(tx *bolt.Tx) error {
+		if len(openWithdrawals(tx)) != 0 {
+			log.Debug("CreditPPS: some withdrawals are not reconciled yet")
+			return nil
+		}
+
+		var liabilities uint64
+		err := tx.Bucket(database.ADDRESS_INFO).ForEach(func(k, v []byte) error {
+			addrInfo := database.AddrInfo{}
+			err := addrInfo.Deserialize(v)
 			if err != nil {
-				log.Err(err)
+				return fmt.Errorf("address %s: %w", k, err)
 			}
+			liabilities += addrInfo.Balance + addrInfo.BalancePending
+			return nil
+		})
+		if err != nil {
+			return err
 		}
 
-		return pendingBuck.Put([]byte("pending"), pending.Serialize())
-	})
+		var reserve uint64
+		if balance > liabilities {
+			reserve = balance - liabilities
+		}
 
+		bals := creditor.CreditShares(tx, reward, reserve)
+		if len(bals) == 0 {
+			return nil
+		}
+
+		log.Info("PPS: crediting", float64(sum(bals))/Coin, "to", len(bals), "miners, reserve is", float64(reserve)/Coin)
+
+		return creditPPS(tx, height, bals)
+	})
 	if err != nil {
-		log.Err(err)
+		log.Err("CreditPPS:", err)
 	}
 }
@@ -0,0 +1,128 @@
+// Copyright (C) 2024 XELIS
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"maps"
+	"testing"
+	"xelis-pool/cfg"
+	"xelis-pool/database"
+	"xelis-pool/util"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+func TestCreditCoinbase(t *testing.T) {
+	const coinbase = 1000_000
+	const finder = "xel:finder"
+	fee := cfg.Cfg.FeeAddress
+
+	oldFee, oldSoloFee, oldScheme := cfg.Cfg.Master.FeePercent, cfg.Cfg.Master.SoloFeePercent, rewardScheme
+	cfg.Cfg.Master.FeePercent = 1
+	cfg.Cfg.Master.SoloFeePercent = 2
+	t.Cleanup(func() {
+		cfg.Cfg.Master.FeePercent, cfg.Cfg.Master.SoloFeePercent, rewardScheme = oldFee, oldSoloFee, oldScheme
+	})
+
+	var hash [32]byte
+	hash[0] = 2
+
+	tests := []struct {
+		name    string
+		scheme  RewardScheme
+		solo    bool // the block is in SOLO_FOUND
+		bals    map[string]uint64
+		poolFee uint64
+		shares  int // shares left in the database
+	}{
+		{"solo block", PplnsTime{}, true, map[string]uint64{finder: 980_000, fee: 20_000}, 20_000, 2},
+		{"solo block under pps", PPS{}, true, map[string]uint64{finder: 980_000, fee: 20_000}, 20_000, 2},
+		{"solo block under prop", PROP{}, true, map[string]uint64{finder: 980_000, fee: 20_000}, 20_000, 2},
+		{"pool block", PplnsTime{}, false, map[string]uint64{"a": 247_500, "b": 742_500, fee: 10_000}, 10_000, 2},
+		{"pool block under pps", PPS{}, false, map[string]uint64{fee: 10_000}, 10_000, 2},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			newTestDB(t)
+			setNetwork(t, 1000)
+			rewardScheme = test.scheme
+
+			var pendBals database.UnconfTx
+			err := DB.Update(func(tx *bolt.Tx) error {
+				for _, sh := range []database.Share{
+					{Wallet: "a", Diff: 100, Time: util.Time() - 60},
+					{Wallet: "b", Diff: 300, Time: util.Time() - 30},
+				} {
+					err := storeShare(tx, sh)
+					if err != nil {
+						return err
+					}
+				}
+
+				err := tx.Bucket(database.FOUND_BY).Put(hash[:], []byte(finder))
+				if err != nil {
+					return err
+				}
+				if test.solo {
+					err := tx.Bucket(database.SOLO_FOUND).Put(hash[:], []byte(finder))
+					if err != nil {
+						return err
+					}
+				}
+
+				pendBals, err = creditCoinbase(tx, hash, 100, coinbase)
+				return err
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !maps.Equal(pendBals.Bals, test.bals) {
+				t.Errorf("got %v, expected %v", pendBals.Bals, test.bals)
+			}
+			if total := sum(pendBals.Bals); total > coinbase {
+				t.Errorf("credited %d, more than the coinbase %d", total, coinbase)
+			}
+			if pendBals.UnlockHeight != 100+cfg.Cfg.Master.MinConfs {
+				t.Errorf("unlock height is %d", pendBals.UnlockHeight)
+			}
+			if n := countShares(); n != test.shares {
+				t.Errorf("%d shares left, expected %d", n, test.shares)
+			}
+
+			DB.View(func(tx *bolt.Tx) error {
+				if tx.Bucket(database.FOUND_BY).Get(hash[:]) != nil || tx.Bucket(database.SOLO_FOUND).Get(hash[:]) != nil {
+					t.Error("the finder of the block is still stored")
+				}
+
+				_, bl, ok := findBlock(tx, hash)
+				if !ok || bl.Status != database.BLOCK_PENDING || bl.PoolFee != test.poolFee {
+					t.Errorf("block stored as %+v", bl)
+				}
+
+				for addr, v := range test.bals {
+					addrInfo := database.AddrInfo{}
+					addrInfo.Deserialize(tx.Bucket(database.ADDRESS_INFO).Get([]byte(addr)))
+					if addrInfo.BalancePending != v {
+						t.Errorf("pending balance of %s is %d, expected %d", addr, addrInfo.BalancePending, v)
+					}
+				}
+				return nil
+			})
+		})
+	}
+}
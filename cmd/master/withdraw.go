@@ -18,7 +18,9 @@ package main
 import (
 	"encoding/hex"
 	"errors"
+	"fmt"
 	"math"
+	"slices"
 	"strings"
 	"xelis-pool/cfg"
 	"xelis-pool/config"
@@ -99,6 +101,14 @@ func CheckWithdraw() bool {
 				if pending.UnconfirmedTxs[0].UnlockHeight+10 < MasterInfo.Height {
 					// block is probably orphaned
 					log.Warn("block is very old, accounting it as orphaned")
+					err := orphanBlock(tx, pending.UnconfirmedTxs[0].TxnBlockHash, pending.UnconfirmedTxs[0].Bals)
+					if err != nil {
+						return err
+					}
+					err = updateBlockStatus(tx, pending.UnconfirmedTxs[0].TxnBlockHash, database.BLOCK_ORPHANED, nil)
+					if err != nil {
+						return err
+					}
 					pending.UnconfirmedTxs = pending.UnconfirmedTxs[1:]
 					log.Info("pending unconfirmedtxs", pending.UnconfirmedTxs)
 
@@ -114,6 +124,17 @@ func CheckWithdraw() bool {
 			blockType := strings.ToLower(txnBlock.BlockType)
 			if blockType == "orphaned" {
 				log.Warn("Block reward is orphaned - removing it, as this should not happen! Block hash is:", txnBlock.Hash)
+				err := orphanBlock(tx, pending.UnconfirmedTxs[0].TxnBlockHash, pending.UnconfirmedTxs[0].Bals)
+				if err != nil {
+					return err
+				}
+				err = updateBlockStatus(tx, pending.UnconfirmedTxs[0].TxnBlockHash, database.BLOCK_ORPHANED, func(bl *database.Block) {
+					bl.Height = txnBlock.Height
+					bl.Type = txnBlock.BlockType
+				})
+				if err != nil {
+					return err
+				}
 				pending.UnconfirmedTxs = pending.UnconfirmedTxs[1:]
 				pendingBuck.Put([]byte("pending"), pending.Serialize())
 				return nil
@@ -137,54 +158,41 @@ func CheckWithdraw() bool {
 				multiplier = 1
 			}
 
+			// a difference between the wallet and the balances is fixed by the
+			// operators with balance adjustments, never by changing the rewards.
+			// Under PPS, the difference is the reserve which pays the shares.
 			debt := GetDebt()
 			log.Info("debt:", debt)
-			if debt > 50 {
-				log.Err("POOL HAS DEBT TO MINERS! Debt:", debt)
-				log.Err("paying the block 2x to miners in order to compensate")
-				multiplier *= 2
+			_, pps := rewardScheme.(ShareCreditor)
+			if debt > 50 && !pps {
+				log.Warn("the wallet holds", debt, "more than the balances of the miners, use a balance adjustment to distribute it")
 			} else if debt < -10 {
-				log.Err("MINERS HAVE DEBT TO POOL! Debt:", debt)
-				log.Err("paying the block 0.5x to miners in order to compensate")
-				multiplier *= 0.5
+				log.Err("the balances of the miners exceed the wallet balance by", -debt)
 			}
 
-			infoBuck := tx.Bucket(database.ADDRESS_INFO)
-			for i, v := range pending.UnconfirmedTxs[0].Bals {
-				wallInfoBin := infoBuck.Get([]byte(i))
-
-				addrInfo := database.AddrInfo{}
-
-				if wallInfoBin == nil {
-					log.Debug("wallInfoBin is nil")
-				} else {
-					err := addrInfo.Deserialize(wallInfoBin)
-					if err != nil {
-						log.Err(err)
-						return err
-					}
-				}
-
-				banned := false
-				for _, v := range config.BANNED_ADDRESSES {
-					if i == v {
-						log.Warn("CheckWithdraw: banned address, setting its balance to 0")
-						banned = true
-						break
-					}
-				}
-
-				addrInfo.Balance += uint64(float64(v) * multiplier)
-
-				if banned {
-					addrInfo.Balance = 0
-					addrInfo.BalancePending = 0
-				}
+			err = creditBalances(tx, pending.UnconfirmedTxs[0].TxnBlockHash, txnBlock.Height, pending.UnconfirmedTxs[0].Bals, multiplier)
+			if err != nil {
+				return err
+			}
+			err = storeBlockFee(tx, pending.UnconfirmedTxs[0].TxnBlockHash, multiplier)
+			if err != nil {
+				return err
+			}
 
-				err = infoBuck.Put([]byte(i), addrInfo.Serialize())
-				if err != nil {
-					return err
+			status := database.BLOCK_CONFIRMED
+			if blockType == "side" {
+				status = database.BLOCK_SIDE
+			}
+			err = updateBlockStatus(tx, pending.UnconfirmedTxs[0].TxnBlockHash, status, func(bl *database.Block) {
+				bl.Height = txnBlock.Height
+				bl.Type = txnBlock.BlockType
+				bl.Reward = *txnBlock.MinerReward
+				if bl.Time == 0 {
+					bl.Time = txnBlock.Timestamp / 1000
 				}
+			})
+			if err != nil {
+				return err
 			}
 
 			if len(pending.UnconfirmedTxs) > 1 {
@@ -208,22 +216,127 @@ func CheckWithdraw() bool {
 	return balancesChanged
 }
 
+// creditBalances adds the matured balances of a block to the confirmed balances,
+// and stores what each address has been credited
+func creditBalances(tx *bolt.Tx, hash [32]byte, height uint64, bals map[string]uint64, multiplier float64) error {
+	_, bl, _ := findBlock(tx, hash)
+	if height == 0 {
+		height = bl.Height
+	}
+
+	credited := make(map[string]uint64, len(bals))
+	var uncredited, forfeited uint64
+	var banned []string
+	for i, v := range bals {
+		c := min(uint64(float64(v)*multiplier), v)
+		uncredited += v - c
+
+		if slices.Contains(config.BANNED_ADDRESSES, i) {
+			log.Warn("CheckWithdraw: banned address, setting its balance to 0")
+			banned = append(banned, i)
+			forfeited += c
+			c = 0
+		}
+
+		credited[i] = c
+
+		err := storeBlockReward(tx, database.BlockReward{
+			Hash:       hash,
+			Height:     height,
+			Address:    i,
+			Amount:     v,
+			Multiplier: multiplier,
+			Credited:   c,
+			Time:       util.Time(),
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	// the part which isn't credited (side blocks) was never received, and the
+	// rewards of banned addresses stay to the pool
+	postings := sortedPostings(ACCOUNT_PENDING, bals, true)
+	postings = append(postings, sortedPostings(ACCOUNT_BALANCE, credited, false)...)
+	postings = append(postings, credit(ACCOUNT_BLOCKS, uncredited), credit(ACCOUNT_POOL, forfeited))
+
+	err := postEntry(tx, &database.LedgerEntry{
+		Kind:     database.LEDGER_MATURITY,
+		Ref:      fmt.Sprintf("%x", hash),
+		Postings: postings,
+	})
+	if err != nil {
+		return err
+	}
+
+	infoBuck := tx.Bucket(database.ADDRESS_INFO)
+	for _, addr := range banned {
+		addrInfo := database.AddrInfo{}
+		if infoBin := infoBuck.Get([]byte(addr)); infoBin != nil {
+			err := addrInfo.Deserialize(infoBin)
+			if err != nil {
+				return err
+			}
+		}
+
+		err := postEntry(tx, &database.LedgerEntry{
+			Kind: database.LEDGER_FORFEIT,
+			Ref:  addr,
+			Postings: []database.Posting{
+				debit(addrAccount(ACCOUNT_BALANCE, addr), addrInfo.Balance),
+				credit(ACCOUNT_POOL, addrInfo.Balance),
+			},
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
 const MIN_WITHDRAW_DESTINATIONS = 1
 const MAX_WITHDRAW_DESTINATIONS = 25 // TODO
 
-// returns true if there are still unpaid wallets
+// Withdraw pays the confirmed balances in two phases: the transaction is built
+// without broadcasting it and stored in the journal as prepared, deducting the
+// balances, and only then it's submitted to the daemon. If the master stops in
+// between, the withdrawal is reconciled by its transaction hash instead of
+// being paid again.
+// Returns true if there are still unpaid wallets.
 func Withdraw() (unpaid bool) {
 	log.Info("Withdraw()")
 
+	withdrawMut.Lock()
+	defer withdrawMut.Unlock()
+
+	if !reconcileWithdrawals() {
+		log.Warn("Withdraw: some withdrawals are not reconciled yet, not paying")
+		return false
+	}
+
 	unpaid = false
 
 	coin := math.Pow10(cfg.Cfg.Atomic)
 
-	err := DB.Update(func(tx *bolt.Tx) error {
-		buck := tx.Bucket(database.ADDRESS_INFO)
+	wrpc := newWithdrawWallet()
+
+	topo, err := wrpc.GetTopoheight()
+	if err != nil {
+		log.Err("Withdraw: failed to get wallet topoheight:", err)
+		return false
+	}
+
+	var destinations []wallet.TransferOut
+	var feeRevenue uint64
+	withdrawal := database.Withdrawal{
+		Status:     database.WITHDRAWAL_PREPARED,
+		Topoheight: topo,
+		Time:       util.Time(),
+	}
 
-		var destinations []wallet.TransferOut
-		var feeRevenue uint64
+	err = DB.View(func(tx *bolt.Tx) error {
+		buck := tx.Bucket(database.ADDRESS_INFO)
 
 		curs := buck.Cursor()
 
@@ -247,7 +360,7 @@ func Withdraw() (unpaid bool) {
 
 			log.Debug("Address has balance", float64(addrInfo.Balance)/coin)
 
-			if addrInfo.Balance > uint64(cfg.Cfg.Master.MinWithdrawal*coin) {
+			if addrInfo.Balance > payoutThreshold(addrInfo) {
 
 				if address == cfg.Cfg.PoolAddress {
 					log.Warn("Withdraw: address is PoolAddress, replacing it with fee address")
@@ -294,80 +407,100 @@ func Withdraw() (unpaid bool) {
 					Asset:       config.ASSET,
 					Destination: address,
 				})
+				withdrawal.Destinations = append(withdrawal.Destinations, database.WithdrawalDestination{
+					Account: string(key),
+					Address: address,
+					Amount:  addrInfo.Balance - fee,
+					Fee:     fee,
+				})
 				feeRevenue += fee
-
-				addrInfo.Paid += addrInfo.Balance
-
-				addrInfo.Balance = 0
-
-				err = buck.Put(key, addrInfo.Serialize())
-				if err != nil {
-					log.Err(err)
-					return err
-				}
 			}
 		}
 
 		if len(destinations) < MIN_WITHDRAW_DESTINATIONS {
 			log.Warn("Not enough destinations for withdrawal")
-			return nil
 		}
+		return nil
+	})
+	if err != nil {
+		log.Err(err)
+		return false
+	}
+	if len(destinations) < MIN_WITHDRAW_DESTINATIONS {
+		return false
+	}
 
-		log.Info("Transferring to destinations", destinations)
+	log.Info("Transferring to destinations", destinations)
 
-		wrpc := newWalletRPC()
+	data, err := wrpc.BuildTransaction(wallet.BuildTransactionParams{
+		Transfers: destinations,
+		Broadcast: false,
+		TxAsHex:   true,
+	})
+	if err != nil {
+		log.Err("failed to build the transaction:", err)
+		return false
+	}
+	log.Devf("Transfer result %x", data)
 
-		data, err := wrpc.BuildTransaction(wallet.BuildTransactionParams{
-			Transfers: destinations,
-			Broadcast: true,
-		})
+	txid, err := hex.DecodeString(data.Hash)
+	if err != nil || len(txid) != 32 || data.TxAsHex == "" {
+		log.Err("invalid transaction", data.Hash)
+		return false
+	}
+	copy(withdrawal.Txid[:], txid)
+	withdrawal.TxFee = data.Fee
+	withdrawal.TxNonce = data.Nonce
+	withdrawal.TxHex = data.TxAsHex
+
+	// phase 1: the withdrawal is prepared in the same transaction that deducts the
+	// balances. If a balance decreased since it was read, the ledger refuses the
+	// payout and the transaction is never submitted.
+	err = DB.Update(func(tx *bolt.Tx) error {
+		err := putWithdrawal(tx, &withdrawal)
 		if err != nil {
-			log.Err("transfer failed:", err)
 			return err
 		}
-		log.Devf("Transfer result %x", data)
-
-		Stats.Lock()
-		Stats.RecentWithdrawals = append([]Withdrawal{
-			{
-				Txid:         data.Hash,
-				Timestamp:    util.Time(),
-				Destinations: destinations,
-			},
-		}, Stats.RecentWithdrawals...)
-		Stats.Unlock()
-
-		var txnFee uint64 = data.Fee
-
-		log.Info("Payout txs total fee", float64(txnFee)/Coin)
-		log.Info("Payout revenue fee  ", float64(feeRevenue)/Coin)
-		log.Info("Earned ", float64(feeRevenue-txnFee)/Coin)
-
-		if txnFee >= feeRevenue {
-			log.Warn("Payout txs total fee is bigger than the revenue fee. Consider increasing withdrawal_fee.")
-			feeRevenue = 0
-		} else {
-			feeRevenue -= txnFee
-		}
-
-		feeAddrData := buck.Get([]byte(cfg.Cfg.FeeAddress))
-		feeAddr := database.AddrInfo{}
-
-		if feeAddrData != nil {
-			err := feeAddr.Deserialize(feeAddrData)
-			if err != nil {
-				log.Err(err)
-				return err
-			}
+		err = postPayout(tx, withdrawal, database.LEDGER_PAYOUT)
+		if err != nil {
+			return err
 		}
+		return storePayouts(tx, withdrawal)
+	})
+	if err != nil {
+		log.Err("failed to prepare the withdrawal:", err)
+		return false
+	}
 
-		feeAddr.Balance += feeRevenue
+	// phase 2: submit the transaction
+	_, err = newWithdrawDaemon().SubmitTransaction(withdrawal.TxHex)
+	if err != nil {
+		// the transaction may have reached the daemon anyway, leave it to reconciliation
+		log.Err("transfer failed:", err, "- withdrawal", withdrawal.Id, "will be reconciled")
+		return false
+	}
 
-		return nil
+	Stats.Lock()
+	Stats.RecentWithdrawals = append([]Withdrawal{
+		{
+			Txid:         data.Hash,
+			Timestamp:    util.Time(),
+			Destinations: destinations,
+		},
+	}, Stats.RecentWithdrawals...)
+	Stats.Unlock()
+
+	log.Info("Payout txs total fee", float64(data.Fee)/Coin)
+	log.Info("Payout revenue fee  ", float64(feeRevenue)/Coin)
+	log.Info("Earned ", (float64(feeRevenue)-float64(data.Fee))/Coin)
+
+	// phase 3: the transaction is broadcast, it will be confirmed by reconcileWithdrawals
+	withdrawal.Status = database.WITHDRAWAL_BROADCAST
+	err = DB.Update(func(tx *bolt.Tx) error {
+		return putWithdrawal(tx, &withdrawal)
 	})
 	if err != nil {
-		log.Err(err)
-		unpaid = false
+		log.Err(err, "- withdrawal", withdrawal.Id, "will be reconciled")
 	}
 
 	return unpaid
@@ -0,0 +1,251 @@
+// Copyright (C) 2024 XELIS
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"sync"
+	"xelis-pool/database"
+	"xelis-pool/log"
+
+	"github.com/xelis-project/xelis-go-sdk/daemon"
+	"github.com/xelis-project/xelis-go-sdk/wallet"
+	bolt "go.etcd.io/bbolt"
+)
+
+// The transaction of an open withdrawal is submitted again until it's executed.
+// After this many blocks, if the nonce of the transaction has been used by
+// another transaction, the withdrawal is considered failed and its balances are
+// restored.
+const WITHDRAWAL_GRACE_BLOCKS = 30
+
+// withdrawMut makes sure that only one withdrawal (or reconciliation) runs at a time
+var withdrawMut sync.Mutex
+
+// withdrawWallet and withdrawDaemon are the RPC methods used by the
+// withdrawals, replaced by fakes in the tests
+type withdrawWallet interface {
+	GetTopoheight() (uint64, error)
+	GetAddress(params wallet.GetAddressParams) (string, error)
+	ListTransactions(params wallet.ListTransactionsParams) ([]wallet.TransactionEntry, error)
+	BuildTransaction(params wallet.BuildTransactionParams) (wallet.BuildTransactionResult, error)
+}
+type withdrawDaemon interface {
+	GetNonce(addr string) (daemon.GetNonceResult, error)
+	GetTransaction(hash string) (daemon.Transaction, error)
+	SubmitTransaction(data string) (bool, error)
+}
+
+var newWithdrawWallet = func() withdrawWallet { return newWalletRPC() }
+var newWithdrawDaemon = func() withdrawDaemon { return newDaemonRPC() }
+
+func withdrawalKey(id uint64) []byte {
+	return binary.BigEndian.AppendUint64(nil, id)
+}
+
+// putWithdrawal stores a withdrawal journal entry. If the entry has no id, a new one is assigned.
+func putWithdrawal(tx *bolt.Tx, w *database.Withdrawal) error {
+	buck := tx.Bucket(database.WITHDRAWALS)
+
+	if w.Id == 0 {
+		id, err := buck.NextSequence()
+		if err != nil {
+			return err
+		}
+		w.Id = id
+	}
+
+	return buck.Put(withdrawalKey(w.Id), w.Serialize())
+}
+
+// openWithdrawals returns the prepared and broadcast withdrawals, from the oldest
+func openWithdrawals(tx *bolt.Tx) []database.Withdrawal {
+	var ws []database.Withdrawal
+
+	tx.Bucket(database.WITHDRAWALS).ForEach(func(k, v []byte) error {
+		w := database.Withdrawal{}
+		err := w.Deserialize(v)
+		if err != nil {
+			log.Err("error reading withdrawal", k, ":", err)
+			return nil
+		}
+
+		if w.Status == database.WITHDRAWAL_PREPARED || w.Status == database.WITHDRAWAL_BROADCAST {
+			ws = append(ws, w)
+		}
+		return nil
+	})
+
+	return ws
+}
+
+// restoreWithdrawal gives back to the accounts the balances deducted by a
+// withdrawal that never reached the network
+func restoreWithdrawal(tx *bolt.Tx, w database.Withdrawal) error {
+	return postPayout(tx, w, database.LEDGER_PAYOUT_FAILED)
+}
+
+// postPayout moves the balances of the destinations of a withdrawal to their
+// paid balances, or back to their balances for LEDGER_PAYOUT_FAILED
+func postPayout(tx *bolt.Tx, w database.Withdrawal, kind database.LedgerKind) error {
+	entry := database.LedgerEntry{
+		Kind: kind,
+		Ref:  strconv.FormatUint(w.Id, 10),
+	}
+
+	for _, d := range w.Destinations {
+		amount := d.Amount + d.Fee
+
+		from := debit(addrAccount(ACCOUNT_BALANCE, d.Account), amount)
+		to := credit(addrAccount(ACCOUNT_PAID, d.Account), amount)
+		if kind == database.LEDGER_PAYOUT_FAILED {
+			from = debit(addrAccount(ACCOUNT_PAID, d.Account), amount)
+			to = credit(addrAccount(ACCOUNT_BALANCE, d.Account), amount)
+		}
+
+		entry.Postings = append(entry.Postings, from, to)
+	}
+
+	return postEntry(tx, &entry)
+}
+
+// ReconcileWithdrawals checks the prepared and broadcast withdrawals against
+// the wallet and the daemon. It returns false if the outcome of some
+// withdrawals is still unknown, so it's not safe to pay again.
+func ReconcileWithdrawals() bool {
+	withdrawMut.Lock()
+	defer withdrawMut.Unlock()
+
+	return reconcileWithdrawals()
+}
+
+// withdrawMut must be locked
+func reconcileWithdrawals() bool {
+	var open []database.Withdrawal
+	err := DB.View(func(tx *bolt.Tx) error {
+		open = openWithdrawals(tx)
+		return nil
+	})
+	if err != nil {
+		log.Err(err)
+		return false
+	}
+
+	if len(open) == 0 {
+		return true
+	}
+
+	log.Info("reconciling", len(open), "withdrawals")
+
+	wrpc := newWithdrawWallet()
+	drpc := newWithdrawDaemon()
+
+	topo, err := wrpc.GetTopoheight()
+	if err != nil {
+		log.Err("reconcile withdrawals: failed to get wallet topoheight:", err)
+		return false
+	}
+
+	minTopo := open[0].Topoheight
+	for _, w := range open {
+		minTopo = min(minTopo, w.Topoheight)
+	}
+
+	walletTxs, err := wrpc.ListTransactions(wallet.ListTransactionsParams{
+		MinTopoheight:  &minTopo,
+		AcceptOutgoing: true,
+	})
+	if err != nil {
+		log.Err("reconcile withdrawals: failed to list wallet transactions:", err)
+		return false
+	}
+	executed := make(map[string]bool, len(walletTxs))
+	for _, v := range walletTxs {
+		executed[v.Hash] = true
+	}
+
+	// the nonce of the pool wallet tells if the nonce of a transaction has been
+	// used. It's only trusted if the wallet is synced past it, so that the
+	// transaction would be in walletTxs if it was executed.
+	var nonce *daemon.GetNonceResult
+	walletAddr, err := wrpc.GetAddress(wallet.GetAddressParams{})
+	if err == nil {
+		n, err := drpc.GetNonce(walletAddr)
+		if err == nil && n.Topoheight <= topo {
+			nonce = &n
+		}
+	}
+
+	reconciled := true
+	for _, w := range open {
+		wasPrepared := w.Status == database.WITHDRAWAL_PREPARED
+		hash := hex.EncodeToString(w.Txid[:])
+
+		if executed[hash] {
+			log.Infof("withdrawal %d: transaction %s executed", w.Id, hash)
+			w.Status = database.WITHDRAWAL_CONFIRMED
+		} else if txn, err := drpc.GetTransaction(hash); err == nil && txn.ExecutedInBlock != nil {
+			log.Infof("withdrawal %d: transaction %s executed in block %s", w.Id, hash, *txn.ExecutedInBlock)
+			w.Status = database.WITHDRAWAL_CONFIRMED
+		} else if err == nil && txn.InMempool {
+			log.Debugf("withdrawal %d: transaction %s is in the mempool", w.Id, hash)
+			w.Status = database.WITHDRAWAL_BROADCAST
+			reconciled = false
+		} else if w.Topoheight+WITHDRAWAL_GRACE_BLOCKS < topo && nonce != nil && nonce.Nonce > w.TxNonce {
+			log.Warnf("withdrawal %d: transaction %s never reached the network, restoring balances", w.Id, hash)
+			w.Status = database.WITHDRAWAL_FAILED
+		} else {
+			reconciled = false
+
+			_, err := drpc.SubmitTransaction(w.TxHex)
+			if err != nil {
+				log.Warnf("withdrawal %d: failed to submit transaction %s: %s", w.Id, hash, err)
+				continue
+			}
+			log.Infof("withdrawal %d: submitted transaction %s", w.Id, hash)
+			w.Status = database.WITHDRAWAL_BROADCAST
+		}
+
+		if w.Status == database.WITHDRAWAL_BROADCAST && !wasPrepared {
+			continue
+		}
+
+		err := DB.Update(func(tx *bolt.Tx) error {
+			if w.Status == database.WITHDRAWAL_FAILED {
+				err := restoreWithdrawal(tx, w)
+				if err != nil {
+					return err
+				}
+			}
+			if w.Status == database.WITHDRAWAL_CONFIRMED {
+				err := postWithdrawalFees(tx, w)
+				if err != nil {
+					return err
+				}
+			}
+			return putWithdrawal(tx, &w)
+		})
+		if err != nil {
+			log.Err(fmt.Errorf("failed to update withdrawal %d: %w", w.Id, err))
+			reconciled = false
+		}
+	}
+
+	return reconciled
+}
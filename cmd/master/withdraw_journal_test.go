@@ -0,0 +1,300 @@
+// Copyright (C) 2024 XELIS
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"xelis-pool/database"
+
+	"github.com/xelis-project/xelis-go-sdk/daemon"
+	"github.com/xelis-project/xelis-go-sdk/wallet"
+	bolt "go.etcd.io/bbolt"
+)
+
+// fakeChain is the pool wallet and the daemon seen by the withdrawals
+type fakeChain struct {
+	topo      uint64
+	nonce     uint64 // next nonce of the pool wallet
+	nonceTopo uint64 // topoheight of the nonce, the wallet is synced past it if <= topo
+
+	accept    bool  // submitted transactions reach the mempool
+	submitErr error // error returned by SubmitTransaction
+
+	built     int
+	submitted int
+	hashes    map[string]string // transaction hex -> hash
+	mempool   map[string]bool
+	executed  map[string]uint64 // hash -> topoheight
+}
+
+func newFakeChain(t *testing.T) *fakeChain {
+	f := &fakeChain{
+		topo:     100,
+		accept:   true,
+		hashes:   make(map[string]string),
+		mempool:  make(map[string]bool),
+		executed: make(map[string]uint64),
+	}
+
+	oldWallet, oldDaemon := newWithdrawWallet, newWithdrawDaemon
+	newWithdrawWallet = func() withdrawWallet { return f }
+	newWithdrawDaemon = func() withdrawDaemon { return f }
+	t.Cleanup(func() {
+		newWithdrawWallet, newWithdrawDaemon = oldWallet, oldDaemon
+	})
+
+	return f
+}
+
+func (f *fakeChain) GetTopoheight() (uint64, error) {
+	return f.topo, nil
+}
+func (f *fakeChain) GetAddress(wallet.GetAddressParams) (string, error) {
+	return "xel:pool", nil
+}
+func (f *fakeChain) ListTransactions(params wallet.ListTransactionsParams) ([]wallet.TransactionEntry, error) {
+	var txs []wallet.TransactionEntry
+	for hash, topo := range f.executed {
+		if params.MinTopoheight == nil || topo >= *params.MinTopoheight {
+			txs = append(txs, wallet.TransactionEntry{Hash: hash, Topoheight: topo})
+		}
+	}
+	return txs, nil
+}
+func (f *fakeChain) BuildTransaction(params wallet.BuildTransactionParams) (wallet.BuildTransactionResult, error) {
+	f.built++
+	res := wallet.BuildTransactionResult{
+		Hash:    fmt.Sprintf("%064x", f.built),
+		Fee:     1000,
+		Nonce:   f.nonce,
+		TxAsHex: fmt.Sprintf("tx%d", f.built),
+	}
+	f.hashes[res.TxAsHex] = res.Hash
+	return res, nil
+}
+
+func (f *fakeChain) GetNonce(string) (daemon.GetNonceResult, error) {
+	return daemon.GetNonceResult{Nonce: f.nonce, Topoheight: f.nonceTopo}, nil
+}
+func (f *fakeChain) GetTransaction(hash string) (daemon.Transaction, error) {
+	if topo, ok := f.executed[hash]; ok {
+		block := fmt.Sprintf("block%d", topo)
+		return daemon.Transaction{Hash: hash, ExecutedInBlock: &block}, nil
+	}
+	if f.mempool[hash] {
+		return daemon.Transaction{Hash: hash, InMempool: true}, nil
+	}
+	return daemon.Transaction{}, errors.New("transaction not found")
+}
+func (f *fakeChain) SubmitTransaction(data string) (bool, error) {
+	f.submitted++
+	if f.accept {
+		f.mempool[f.hashes[data]] = true
+	}
+	return f.submitErr == nil, f.submitErr
+}
+
+// mine executes the transactions of the mempool in the next block
+func (f *fakeChain) mine() {
+	f.topo++
+	for hash := range f.mempool {
+		f.executed[hash] = f.topo
+		f.nonce++
+	}
+	f.nonceTopo = f.topo
+	clear(f.mempool)
+}
+
+const testMiner = "xel:miner"
+
+// fundMiner credits the confirmed balance of the test miner with one coin
+func fundMiner(t *testing.T) {
+	_, err := adjustBalance(testMiner, uint64(Coin), false, "test", "admin")
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func getWithdrawal(t *testing.T, id uint64) (w database.Withdrawal) {
+	err := DB.View(func(tx *bolt.Tx) error {
+		return w.Deserialize(tx.Bucket(database.WITHDRAWALS).Get(withdrawalKey(id)))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return
+}
+
+func getAddrInfo(t *testing.T, addr string) (addrInfo database.AddrInfo) {
+	err := DB.View(func(tx *bolt.Tx) error {
+		return addrInfo.Deserialize(tx.Bucket(database.ADDRESS_INFO).Get([]byte(addr)))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return
+}
+
+func TestWithdrawInterruptedBeforeSubmit(t *testing.T) {
+	newTestDB(t)
+	f := newFakeChain(t)
+	fundMiner(t)
+
+	// the master stops after building and journaling the transaction, which
+	// never reaches the daemon
+	f.accept = false
+	f.submitErr = errors.New("connection refused")
+	Withdraw()
+
+	w := getWithdrawal(t, 1)
+	if w.Status != database.WITHDRAWAL_PREPARED || w.TxHex != "tx1" {
+		t.Fatalf("withdrawal is %s with transaction %q", w.Status, w.TxHex)
+	}
+	if bal := getAddrInfo(t, testMiner); bal.Balance != 0 || bal.Paid != uint64(Coin) {
+		t.Errorf("balance %d paid %d after the withdrawal was prepared", bal.Balance, bal.Paid)
+	}
+
+	// after the restart, the same transaction is submitted again
+	f.accept = true
+	f.submitErr = nil
+	if ReconcileWithdrawals() {
+		t.Error("withdrawal reconciled before its transaction is executed")
+	}
+	if f.submitted != 2 || f.built != 1 {
+		t.Errorf("%d transactions built, %d submitted", f.built, f.submitted)
+	}
+	if w := getWithdrawal(t, 1); w.Status != database.WITHDRAWAL_BROADCAST {
+		t.Errorf("withdrawal is %s after being submitted again", w.Status)
+	}
+
+	// and no new withdrawal is made until it's reconciled
+	Withdraw()
+	if f.built != 1 {
+		t.Error("a new transaction was built while a withdrawal is open")
+	}
+
+	f.mine()
+	if !ReconcileWithdrawals() {
+		t.Error("executed withdrawal not reconciled")
+	}
+	if w := getWithdrawal(t, 1); w.Status != database.WITHDRAWAL_CONFIRMED {
+		t.Errorf("withdrawal is %s after its transaction is executed", w.Status)
+	}
+	if bal := getAddrInfo(t, testMiner); bal.Balance != 0 || bal.Paid != uint64(Coin) {
+		t.Errorf("balance %d paid %d after the withdrawal", bal.Balance, bal.Paid)
+	}
+
+	// the miner is paid only once
+	Withdraw()
+	if f.built != 1 {
+		t.Error("the miner was paid twice")
+	}
+}
+
+func TestReconcileSubmitErrorInMempool(t *testing.T) {
+	newTestDB(t)
+	f := newFakeChain(t)
+	fundMiner(t)
+
+	// the daemon accepts the transaction, but the response is lost
+	f.submitErr = errors.New("timeout")
+	Withdraw()
+
+	if w := getWithdrawal(t, 1); w.Status != database.WITHDRAWAL_PREPARED {
+		t.Fatalf("withdrawal is %s", w.Status)
+	}
+
+	// even past the grace period, a transaction in the mempool is never failed
+	// nor submitted again
+	f.topo += WITHDRAWAL_GRACE_BLOCKS + 1
+	f.nonceTopo = f.topo
+	if ReconcileWithdrawals() {
+		t.Error("withdrawal reconciled while its transaction is in the mempool")
+	}
+	if w := getWithdrawal(t, 1); w.Status != database.WITHDRAWAL_BROADCAST {
+		t.Errorf("withdrawal is %s while its transaction is in the mempool", w.Status)
+	}
+	if f.submitted != 1 {
+		t.Errorf("transaction submitted %d times", f.submitted)
+	}
+	if bal := getAddrInfo(t, testMiner); bal.Balance != 0 {
+		t.Errorf("balance restored to %d while the transaction is in the mempool", bal.Balance)
+	}
+
+	f.mine()
+	if !ReconcileWithdrawals() {
+		t.Error("executed withdrawal not reconciled")
+	}
+	if w := getWithdrawal(t, 1); w.Status != database.WITHDRAWAL_CONFIRMED {
+		t.Errorf("withdrawal is %s after its transaction is executed", w.Status)
+	}
+	if bal := getAddrInfo(t, testMiner); bal.Balance != 0 || bal.Paid != uint64(Coin) {
+		t.Errorf("balance %d paid %d after the withdrawal", bal.Balance, bal.Paid)
+	}
+}
+
+func TestReconcileNonceReused(t *testing.T) {
+	newTestDB(t)
+	f := newFakeChain(t)
+	fundMiner(t)
+
+	// the transaction is rejected, then another transaction of the pool wallet
+	// uses its nonce
+	f.accept = false
+	f.submitErr = errors.New("invalid nonce")
+	Withdraw()
+	f.topo++
+	f.nonce++
+	f.nonceTopo = f.topo
+
+	check := func(name string, status database.WithdrawalStatus, reconciled bool, balance uint64) {
+		t.Helper()
+		if ReconcileWithdrawals() != reconciled {
+			t.Errorf("%s: reconciled is not %v", name, reconciled)
+		}
+		if w := getWithdrawal(t, 1); w.Status != status {
+			t.Errorf("%s: withdrawal is %s, expected %s", name, w.Status, status)
+		}
+		if bal := getAddrInfo(t, testMiner); bal.Balance != balance {
+			t.Errorf("%s: balance is %d, expected %d", name, bal.Balance, balance)
+		}
+	}
+
+	check("within the grace period", database.WITHDRAWAL_PREPARED, false, 0)
+
+	// the nonce isn't trusted while the wallet isn't synced past it
+	f.topo += WITHDRAWAL_GRACE_BLOCKS
+	f.nonceTopo = f.topo + 1
+	check("wallet not synced", database.WITHDRAWAL_PREPARED, false, 0)
+
+	f.nonceTopo = f.topo
+	check("nonce used", database.WITHDRAWAL_FAILED, true, uint64(Coin))
+
+	if bal := getAddrInfo(t, testMiner); bal.Paid != 0 {
+		t.Errorf("paid balance is %d after the withdrawal failed", bal.Paid)
+	}
+
+	// the restored balance is paid by a new transaction
+	f.accept = true
+	f.submitErr = nil
+	Withdraw()
+	if w := getWithdrawal(t, 2); w.Status != database.WITHDRAWAL_BROADCAST || f.built != 2 {
+		t.Errorf("new withdrawal is %s, %d transactions built", w.Status, f.built)
+	}
+
+}
@@ -27,18 +27,18 @@ import (
 	"xelis-pool/log"
 	"xelis-pool/pow"
 	"xelis-pool/rate_limit"
+	"xelis-pool/util"
 	"xelis-pool/xatum"
 	"xelis-pool/xatum/server"
 
 	"github.com/xelis-project/xelis-go-sdk/getwork"
 )
 
-func handleDaemon(srv *server.Server, srvgw *GetworkServer, srvstr *StratumServer) {
-	log.Debug("handleDaemon")
-	for {
-		getworkConn(srv, srvgw, srvstr)
-	}
-}
+// a daemon which hasn't sent a job for this time is not used as job source
+const DAEMON_JOB_TIMEOUT = 90 * time.Second
+
+// a daemon more than this many blocks behind the others is not used as job source
+const DAEMON_MAX_HEIGHT_LAG = 2
 
 // MemJob is a fast & efficient struct used for storing a job in memory
 type MemJob struct {
@@ -48,89 +48,276 @@ type MemJob struct {
 	Algorithm string
 }
 
-var gwConn *getwork.Getwork
-var gwMut sync.RWMutex
-
 var LastKnownJob MemJob
 var MutLastJob sync.RWMutex
 
-func SubmitBlock(hexData string) error {
-	gwMut.Lock()
-	defer gwMut.Unlock()
+// daemonConn is a getwork connection to a daemon
+type daemonConn struct {
+	Url string
 
-	if gwConn == nil {
-		return errors.New("getwork connection is nil")
-	}
+	gw        *getwork.Getwork // nil if disconnected
+	job       MemJob
+	jobTime   time.Time
+	submitMut sync.Mutex // websocket writes must not be concurrent
+}
 
-	return gwConn.SubmitBlock(hexData)
+// Daemons are sorted by priority: jobs come from the first healthy daemon,
+// blocks are submitted to all the healthy ones
+type daemonPool struct {
+	daemons []*daemonConn
+	active  *daemonConn
+
+	onJob func(job MemJob)
+
+	sync.RWMutex
 }
 
-func getworkConn(srv *server.Server, srvgw *GetworkServer, srvstr *StratumServer) {
-	log.Debug("getworkConn")
+var daemons daemonPool
 
-	gw, err := getwork.NewGetwork("ws://"+cfg.Cfg.Master.DaemonRpc+"/getwork", cfg.Cfg.PoolAddress, "xelis-pool")
-	if err != nil {
-		log.Err(err)
-		time.Sleep(time.Second)
-		return
+func daemonUrls() []string {
+	if len(cfg.Cfg.Slave.DaemonRpcs) != 0 {
+		return cfg.Cfg.Slave.DaemonRpcs
 	}
+	return []string{cfg.Cfg.Master.DaemonRpc}
+}
 
-	gwMut.Lock()
-	gwConn = gw
-	gwMut.Unlock()
+func handleDaemon(srv *server.Server, srvgw *GetworkServer, srvstr *StratumServer) {
+	log.Debug("handleDaemon")
 
-	log.Debug("getwork connected!")
+	daemons.Lock()
+	daemons.onJob = func(job MemJob) {
+		go sendJobs(srv, job.Diff, job.Blob)
+		go srvgw.sendGetworkJobs(job.Diff, job.Blob, job.Algorithm)
+		go srvstr.sendJobs(job.Diff, job.Blob)
 
-	go getworkAccepts(gw)
-	go getworkRejects(gw)
+		MutLastJob.Lock()
+		LastKnownJob = job
+		MutLastJob.Unlock()
+	}
+	for _, url := range daemonUrls() {
+		d := &daemonConn{
+			Url: url,
+		}
+		daemons.daemons = append(daemons.daemons, d)
+
+		go d.run()
+	}
+	daemons.Unlock()
 
+	// health check
 	for {
-		job, ok := <-gw.Job
-		if !ok {
-			log.Err("getwork invalid job received")
-			return
+		time.Sleep(5 * time.Second)
+
+		daemons.Lock()
+		daemons.selectSource(nil)
+		daemons.Unlock()
+	}
+}
+
+// healthy returns true if the daemon can be used as job source. Pool must be locked.
+func (d *daemonConn) healthy(maxHeight uint64) bool {
+	return d.gw != nil && time.Since(d.jobTime) < DAEMON_JOB_TIMEOUT &&
+		d.job.Height+DAEMON_MAX_HEIGHT_LAG >= maxHeight
+}
+
+// maxHeight returns the height of the most recent job of the connected
+// daemons. Pool must be locked.
+func (p *daemonPool) maxHeight() uint64 {
+	var maxHeight uint64
+	for _, d := range p.daemons {
+		if d.gw != nil && time.Since(d.jobTime) < DAEMON_JOB_TIMEOUT {
+			maxHeight = max(maxHeight, d.job.Height)
 		}
+	}
+	return maxHeight
+}
+
+// selectSource chooses the job source, and sends its job to miners if it has
+// changed or if it's the daemon which has just sent a new job. Pool must be locked.
+func (p *daemonPool) selectSource(newJobFrom *daemonConn) {
+	maxHeight := p.maxHeight()
 
-		blob, err := hex.DecodeString(job.Template)
-		if err != nil {
-			log.Warnf("%v", err)
-			continue
+	var best *daemonConn
+	for _, d := range p.daemons {
+		if d.healthy(maxHeight) {
+			best = d
+			break
+		}
+	}
+
+	if best != p.active {
+		if best == nil {
+			log.Err("no healthy daemon available, miners won't receive new jobs")
+		} else if p.active == nil {
+			log.Info("using daemon", best.Url, "as job source")
+		} else {
+			log.Warn("switching job source from daemon", p.active.Url, "to", best.Url)
 		}
 
-		job.Algorithm, err = pow.ConvertAlgorithmToStratum(job.Algorithm)
-		if err != nil {
-			err := fmt.Errorf("unknown algorithm received: %s", job.Algorithm)
-			log.Fatal(err)
+		p.active = best
+		if best != nil {
+			p.onJob(best.job)
 		}
+		return
+	}
+
+	if best != nil && best == newJobFrom {
+		p.onJob(best.job)
+	}
+}
+
+// run keeps the getwork connection to the daemon open
+func (d *daemonConn) run() {
+	for {
+		d.connect()
+		time.Sleep(time.Second)
+	}
+}
+
+func (d *daemonConn) connect() {
+	log.Debug("connecting to daemon", d.Url)
+
+	gw, err := getwork.NewGetwork("ws://"+d.Url+"/getwork", cfg.Cfg.PoolAddress, "xelis-pool")
+	if err != nil {
+		log.Err("daemon", d.Url+":", err)
+		return
+	}
 
-		log.Infof("new job: height %d blob %s diff %s algo %s", job.Height, job.Template, job.Difficulty,
-			job.Algorithm)
+	daemons.Lock()
+	d.gw = gw
+	daemons.Unlock()
 
-		if len(blob) != pow.BLOCKMINER_LENGTH {
-			log.Warnf("blob is not %d bytes long", pow.BLOCKMINER_LENGTH)
-			continue
+	log.Info("getwork connected to daemon", d.Url)
+
+	defer func() {
+		daemons.Lock()
+		d.gw = nil
+		daemons.selectSource(nil)
+		daemons.Unlock()
+	}()
+
+	// all the channels must be read, otherwise the getwork client blocks
+	for {
+		select {
+		case job, ok := <-gw.Job:
+			if !ok {
+				log.Warn("daemon", d.Url, "disconnected")
+				return
+			}
+
+			memJob, err := parseJob(job)
+			if err != nil {
+				// the daemon is not used until it sends a valid job
+				log.Warn("daemon", d.Url+":", err)
+				daemons.Lock()
+				d.jobTime = time.Time{}
+				daemons.selectSource(nil)
+				daemons.Unlock()
+				continue
+			}
+
+			log.Infof("new job from %s: height %d blob %s diff %s algo %s", d.Url, job.Height, job.Template,
+				job.Difficulty, memJob.Algorithm)
+
+			daemons.Lock()
+			d.job = memJob
+			d.jobTime = time.Now()
+			daemons.selectSource(d)
+			daemons.Unlock()
+		case err, ok := <-gw.Err:
+			if !ok {
+				log.Warn("daemon", d.Url, "disconnected")
+				return
+			}
+			// the connection is closed after read errors, then Job is closed
+			log.Warn("daemon", d.Url+":", err)
+		case accBl, ok := <-gw.AcceptedBlock:
+			if ok {
+				log.Infof("block accepted by %s: %v", d.Url, accBl)
+			}
+		case rejBl, ok := <-gw.RejectedBlock:
+			if ok {
+				log.Errf("block rejected by %s: %v", d.Url, rejBl)
+			}
 		}
-		diff, err := strconv.ParseUint(job.Difficulty, 10, 64)
-		if err != nil {
-			log.Warnf("%v", err)
-			continue
+	}
+}
+
+func parseJob(job getwork.BlockTemplate) (MemJob, error) {
+	blob, err := hex.DecodeString(job.Template)
+	if err != nil {
+		return MemJob{}, err
+	}
+
+	algo, err := pow.ConvertAlgorithmToStratum(job.Algorithm)
+	if err != nil {
+		return MemJob{}, fmt.Errorf("unknown algorithm received: %s", job.Algorithm)
+	}
+
+	if len(blob) != pow.BLOCKMINER_LENGTH {
+		return MemJob{}, fmt.Errorf("blob is not %d bytes long", pow.BLOCKMINER_LENGTH)
+	}
+	diff, err := strconv.ParseUint(job.Difficulty, 10, 64)
+	if err != nil {
+		return MemJob{}, err
+	}
+
+	return MemJob{
+		Blob:      pow.BlockMiner(blob),
+		Diff:      diff,
+		Height:    job.Height,
+		Algorithm: algo,
+	}, nil
+}
+
+// SubmitBlock submits the block to all the healthy daemons at once. It
+// returns as soon as one daemon has received it, or when all of them failed.
+func SubmitBlock(hexData string) error {
+	type target struct {
+		d  *daemonConn
+		gw *getwork.Getwork
+	}
+
+	daemons.RLock()
+	maxHeight := daemons.maxHeight()
+	targets := make([]target, 0, len(daemons.daemons))
+	for _, d := range daemons.daemons {
+		if d.healthy(maxHeight) {
+			targets = append(targets, target{d, d.gw})
 		}
+	}
+	daemons.RUnlock()
 
-		bl := pow.BlockMiner(blob)
+	if len(targets) == 0 {
+		return errors.New("no healthy daemon")
+	}
 
-		go sendJobs(srv, diff, bl)
-		go srvgw.sendGetworkJobs(diff, bl, job.Algorithm)
-		go srvstr.sendJobs(diff, bl)
+	results := make(chan error, len(targets))
+	for _, t := range targets {
+		go func() {
+			t.d.submitMut.Lock()
+			err := t.gw.SubmitBlock(hexData)
+			t.d.submitMut.Unlock()
+
+			if err != nil {
+				err = fmt.Errorf("%s: %w", t.d.Url, err)
+			} else {
+				log.Info("block submitted to daemon", t.d.Url)
+			}
+			results <- err
+		}()
+	}
 
-		MutLastJob.Lock()
-		LastKnownJob = MemJob{
-			Blob:      bl,
-			Diff:      diff,
-			Height:    job.Height,
-			Algorithm: job.Algorithm,
+	var errs []error
+	for range targets {
+		err := <-results
+		if err == nil {
+			return nil
 		}
-		MutLastJob.Unlock()
+		errs = append(errs, err)
 	}
+
+	return errors.Join(errs...)
 }
 
 // NOTE: Connection MUST be locked before calling this
@@ -166,6 +353,8 @@ func SendJob(v *server.Connection, blockDiff uint64, blob pow.BlockMiner) {
 }
 
 func sendJobs(srv *server.Server, diff uint64, blob pow.BlockMiner) {
+	start := time.Now()
+
 	log.Info("sendJobs: sending jobs to", len(srv.Connections), "peers")
 
 	srv.Lock()
@@ -189,7 +378,7 @@ func sendJobs(srv *server.Server, diff uint64, blob pow.BlockMiner) {
 			if time.Since(v.CData.LastShare) > 10*time.Minute {
 				log.Debug("sendJobs: disconnecting peer after", time.Since(v.CData.LastShare))
 
-				ip := v.Conn.RemoteAddr().String()
+				ip := util.RemovePort(v.Conn.RemoteAddr().String())
 
 				rate_limit.Ban(ip, time.Now().Unix()+(5*60))
 
@@ -208,6 +397,7 @@ func sendJobs(srv *server.Server, diff uint64, blob pow.BlockMiner) {
 			log.Dev("sendJobs: sending job to peer", v.Conn.RemoteAddr())
 
 			SendJob(v, diff, blob)
+			jobBroadcastMetric.ObserveDuration(start, PROTOCOL_XATUM)
 			log.Dev("sendJobs: sent job to peer", v.Conn.RemoteAddr())
 
 		}()
@@ -215,29 +405,6 @@ func sendJobs(srv *server.Server, diff uint64, blob pow.BlockMiner) {
 	}
 }
 
-func getworkAccepts(gw *getwork.Getwork) {
-	for {
-		accBl, ok := <-gw.AcceptedBlock
-		if !ok {
-			log.Warn("getworkAccept closed")
-			return
-		}
-		log.Infof("block accepted: %v", accBl)
-	}
-
-}
-func getworkRejects(gw *getwork.Getwork) {
-	for {
-		rejBl, ok := <-gw.RejectedBlock
-		if !ok {
-			log.Warn("getworkReject closed")
-			return
-		}
-		log.Errf("block rejected: %v", rejBl)
-	}
-
-}
-
 /*func setupRPC() (*daemon.RPC, context.Context) {
 	ctx := context.Background()
 	dae, err := daemon.NewRPC(ctx, "http://"+config.DAEMON_ADDRESS+"/json_rpc")
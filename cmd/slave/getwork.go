@@ -16,19 +16,23 @@
 package main
 
 import (
+	"crypto/tls"
 	"encoding/hex"
 	"encoding/json"
-	"io"
+	"fmt"
 	"net/http"
+	"net/url"
 	"strconv"
 	"strings"
 	"sync"
-	"xelis-pool/address"
+	"time"
 	"xelis-pool/cfg"
 	"xelis-pool/config"
 	"xelis-pool/log"
+	"xelis-pool/login"
 	"xelis-pool/pow"
 	"xelis-pool/rate_limit"
+	"xelis-pool/trustedproxy"
 	"xelis-pool/xatum"
 	"xelis-pool/xatum/server"
 
@@ -74,6 +78,8 @@ func fmtMessageType(mt int) string {
 
 // sends a job to all the websockets, and removes old websockets
 func (s *GetworkServer) sendGetworkJobs(diff uint64, blob pow.BlockMiner, algo string) {
+	start := time.Now()
+
 	sockets2 := make([]*GetworkConn, 0)
 	func() {
 		s.Lock()
@@ -132,55 +138,39 @@ func (s *GetworkServer) sendGetworkJobs(diff uint64, blob pow.BlockMiner, algo s
 				c.Alive = false
 				return
 			}
+			jobBroadcastMetric.ObserveDuration(start, PROTOCOL_GETWORK)
 
 			log.Debug("sendJobToWebsocket: done, sent to IP", c.IP)
 		}()
 	}
 }
 
-func getIPV4list() []string {
-	resp, err := http.Get("https://www.cloudflare.com/ips-v4")
-
+func (s *GetworkServer) listenGetwork(tlsConfig *tls.Config) {
+	proxies, err := trustedproxy.New(cfg.Cfg.Slave.TrustedProxies, cfg.Cfg.Slave.TrustedProxyFile,
+		cfg.Cfg.Slave.TrustedProxyUrls, time.Duration(cfg.Cfg.Slave.TrustedProxyRefresh)*time.Second)
 	if err != nil {
-		log.Fatal(err)
+		log.Fatal(fmt.Errorf("invalid trusted proxies: %w", err))
 	}
 
-	defer resp.Body.Close()
-
-	body, err := io.ReadAll(resp.Body)
-
-	if err != nil {
-		log.Fatal(err)
-	}
-
-	ls := strings.Split(strings.ReplaceAll(string(body), "\r", ""), "\n")
-
-	log.Info("Cloudflare IP addresses:", ls)
-
-	return ls
-}
-
-func (s *GetworkServer) listenGetwork() {
 	r := gin.Default()
 
-	r.RemoteIPHeaders = append(r.RemoteIPHeaders, "True-Client-IP")
-	r.ForwardedByClientIP = true
-
-	ipList := getIPV4list()
-
-	r.SetTrustedProxies(append(ipList, "127.0.0.1"))
+	// the client IP is given by proxies, whose list can change at runtime
+	r.ForwardedByClientIP = false
+	r.SetTrustedProxies(nil)
 
 	r.GET("/getwork/:addr/*worker", func(c *gin.Context) {
+		ip := proxies.ClientIP(c.Request)
+
 		// DDoS protection
-		if !rate_limit.CanConnect(c.ClientIP()) {
-			log.Warn("IP", c.ClientIP(), "has too many Getwork connections")
+		if !rate_limit.CanConnect(ip) {
+			log.Warn("IP", ip, "has too many Getwork connections")
 			c.String(429, "429 too many open connections")
 
 			return
 		}
 
-		if !rate_limit.CanDoAction(c.ClientIP(), rate_limit.ACTION_CONNECT) {
-			log.Warn("IP", c.ClientIP(), "rate limited on Getwork server")
+		if !rate_limit.CanDoAction(ip, rate_limit.ACTION_CONNECT) {
+			log.Warn("IP", ip, "rate limited on Getwork server")
 			c.String(429, "429 too many requests")
 
 			return
@@ -194,60 +184,54 @@ func (s *GetworkServer) listenGetwork() {
 			return
 		}
 
-		splAddr := strings.Split(strings.Split(addy, ".")[0], "+")
-
-		var wall string
-		if len(splAddr) > 0 {
-			wall = splAddr[0]
-		}
-		var diff float64
-
-		if len(splAddr) > 1 {
-			diffStr := splAddr[1]
-
-			diffNum, err := strconv.ParseUint(diffStr, 10, 64)
-
-			if err != nil {
-				log.Debug(err)
-			} else {
-				const MAX = 10_000_000
-
-				if diffNum < cfg.Cfg.Slave.MinDifficulty {
-					diffNum = cfg.Cfg.Slave.MinDifficulty
-				} else if diffNum > MAX {
-					diffNum = MAX
-				}
-				diff = float64(diffNum)
-			}
-		}
-
-		worker, _ := c.Params.Get("worker")
+		// login options can also be sent in the query string
+		opts, _ := url.QueryUnescape(c.Request.URL.RawQuery)
 
-		if !address.IsAddressValid(wall) {
-			c.String(400, "400 invalid wallet address")
+		auth, err := parseLogin(addy, opts)
+		if err != nil {
+			c.String(400, "400 "+err.Error())
 
 			return
 		}
 
-		if worker == "" {
-			worker = "x"
+		// the worker in the path takes priority over the one in the login
+		if pathWorker := strings.Trim(c.Param("worker"), "/"); pathWorker != "" {
+			auth.Worker = login.CleanWorkerName(pathWorker)
 		}
 
-		log.Info("new GetWork miner with IP", c.ClientIP(), "wallet", addy, "worker", worker)
+		log.Info("new GetWork miner with IP", ip, "wallet", addy, "worker", auth.Worker)
 
 		s.Lock()
 		gwConn := &GetworkConn{
 			Alive: true,
-			IP:    c.ClientIP(),
-			CData: server.NewCData(),
+			IP:    ip,
+			CData: server.NewCData(PROTOCOL_GETWORK),
 		}
-		gwConn.CData.Wallet = wall
-		gwConn.CData.NextDiff = diff
+		applyLogin(&gwConn.CData, auth)
 		s.Conns = append(s.Conns, gwConn)
 		s.Unlock()
 
 		s.wsHandler(gwConn, c.Writer, c.Request)
 	})
+
+	if cfg.Cfg.Slave.GetworkTlsPort != 0 {
+		srv := &http.Server{
+			Addr:      ":" + strconv.FormatUint(uint64(cfg.Cfg.Slave.GetworkTlsPort), 10),
+			Handler:   r,
+			TLSConfig: tlsConfig,
+		}
+
+		go func() {
+			log.Info("Getwork TLS server listening on port", cfg.Cfg.Slave.GetworkTlsPort)
+
+			// the certificate comes from tlsConfig
+			err := srv.ListenAndServeTLS("", "")
+			if err != nil {
+				log.Fatal(err)
+			}
+		}()
+	}
+
 	r.Run(":" + strconv.FormatUint(uint64(cfg.Cfg.Slave.GetworkPort), 10))
 }
 
@@ -354,7 +338,7 @@ func (s *GetworkServer) wsHandler(c *GetworkConn, w http.ResponseWriter, r *http
 
 		log.Dev("str:", str)
 
-		print, shouldKick, err := handleConnPacket(&c.CData, str, packetsRecv, c.IP, &jobToSend, [16]byte{})
+		print, shouldKick, err := handleConnPacket(PROTOCOL_GETWORK, &c.CData, str, packetsRecv, c.IP, &jobToSend, [16]byte{})
 		if err != nil {
 			log.Warn("Getwork:", err)
 		}
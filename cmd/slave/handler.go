@@ -25,10 +25,10 @@ import (
 	"strconv"
 	"strings"
 	"time"
-	"xelis-pool/address"
 	"xelis-pool/cfg"
 	"xelis-pool/config"
 	"xelis-pool/log"
+	"xelis-pool/login"
 	"xelis-pool/pow"
 	"xelis-pool/rate_limit"
 	"xelis-pool/slave"
@@ -54,7 +54,7 @@ type JobToSend struct {
 	BM   pow.BlockMiner
 }
 
-func handleConnPacket(cdat *server.CData, str string, packetsRecv int, ip string, toSend *JobToSend, minerId [16]byte) (*xatum.S2C_Print, bool, error) {
+func handleConnPacket(protocol string, cdat *server.CData, str string, packetsRecv int, ip string, toSend *JobToSend, minerId [16]byte) (*xatum.S2C_Print, bool, error) {
 	spl := strings.SplitN(str, "~", 2)
 	if len(spl) < 2 {
 		log.Warn("packet data is malformed, spl:", spl)
@@ -92,41 +92,15 @@ func handleConnPacket(cdat *server.CData, str string, packetsRecv int, ip string
 			}, true, errors.New("failed to parse data")
 		}
 
-		pData.Addr = strings.ReplaceAll(pData.Addr, ".", "+")
-
-		splAddr := strings.Split(pData.Addr, "+")
-
-		var wall string
-		if len(splAddr) > 0 {
-			wall = splAddr[0]
-		}
-
-		if !address.IsAddressValid(wall) {
+		auth, err := parseLogin(pData.Addr, "")
+		if err != nil {
 			return &xatum.S2C_Print{
-				Msg: "invalid address",
+				Msg: err.Error(),
 				Lvl: 3,
-			}, true, errors.New("IP " + ip + " invalid address " + wall)
+			}, true, fmt.Errorf("IP %s login %s: %w", ip, pData.Addr, err)
 		}
-
-		if len(splAddr) > 1 {
-			diffStr := splAddr[1]
-
-			diffNum, err := strconv.ParseUint(diffStr, 10, 64)
-
-			if err != nil {
-				log.Debug(err)
-			} else {
-				const MAX = 10_000_000
-
-				if diffNum < cfg.Cfg.Slave.MinDifficulty {
-					diffNum = cfg.Cfg.Slave.MinDifficulty
-				} else if diffNum > MAX {
-					diffNum = MAX
-				}
-				cdat.Lock()
-				cdat.NextDiff = float64(diffNum)
-				cdat.Unlock()
-			}
+		if pData.Work != "" {
+			auth.Worker = login.CleanWorkerName(pData.Work)
 		}
 
 		if !slices.Contains(pData.Algos, "xel/0") && !slices.Contains(pData.Algos, "xel/1") && !slices.Contains(pData.Algos, "xel/2") {
@@ -136,10 +110,10 @@ func handleConnPacket(cdat *server.CData, str string, packetsRecv int, ip string
 			}, true, errors.New("your miner does not support xel/0, xel/1 or xel/2 algorithms")
 		}
 
-		log.Infof("New miner | Address: %s %s UserAgent: %s Algos: %s", wall, pData.Work, pData.Agent, pData.Algos)
+		log.Infof("New miner | Address: %s Worker: %s UserAgent: %s Algos: %s", auth.Wallet, auth.Worker, pData.Agent, pData.Algos)
 
 		cdat.Lock()
-		cdat.Wallet = wall
+		applyLogin(cdat, auth)
 		cdat.Unlock()
 
 		// send first job
@@ -156,6 +130,13 @@ func handleConnPacket(cdat *server.CData, str string, packetsRecv int, ip string
 		toSend.Diff = diff
 		toSend.BM = blob
 
+		if auth.Diff != 0 {
+			return &xatum.S2C_Print{
+				Msg: "fixed difficulty " + strconv.FormatUint(auth.Diff, 10),
+				Lvl: 1,
+			}, false, nil
+		}
+
 	case xatum.PacketC2S_Pong:
 		log.Dev("received pong packet")
 	case xatum.PacketC2S_Submit:
@@ -190,6 +171,7 @@ func handleConnPacket(cdat *server.CData, str string, packetsRecv int, ip string
 
 		// validate BlockMiner length
 		if len(pData.Data) != pow.BLOCKMINER_LENGTH {
+			sharesMetric.Inc(protocol, SHARE_INVALID)
 			return &xatum.S2C_Print{
 				Msg: "invalid blockminer length",
 				Lvl: 3,
@@ -205,6 +187,7 @@ func handleConnPacket(cdat *server.CData, str string, packetsRecv int, ip string
 		if bm.GetPoolNonce() != config.POOL_NONCE {
 			log.Warnf("user sent invalid pool nonce, expected %x, got %x",
 				config.POOL_NONCE, bm.GetPoolNonce())
+			sharesMetric.Inc(protocol, SHARE_INVALID)
 
 			return &xatum.S2C_Print{
 				Msg: "invalid pool nonce",
@@ -216,6 +199,7 @@ func handleConnPacket(cdat *server.CData, str string, packetsRecv int, ip string
 
 		if jobid == [16]byte{} {
 			log.Warn("user sent 00 job id in extra nonce, which is not valid")
+			sharesMetric.Inc(protocol, SHARE_INVALID)
 
 			return &xatum.S2C_Print{
 				Msg: "blank extra nonce",
@@ -244,6 +228,8 @@ func handleConnPacket(cdat *server.CData, str string, packetsRecv int, ip string
 			cdat.LastShare = time.Now()
 			cdat.Unlock()
 
+			sharesMetric.Inc(protocol, SHARE_STALE)
+
 			return &xatum.S2C_Print{
 				Msg: err.Error(),
 				Lvl: 3,
@@ -263,6 +249,7 @@ func handleConnPacket(cdat *server.CData, str string, packetsRecv int, ip string
 			err := fmt.Errorf("invalid Workhash or Publickey, WorkHash %x, got %x; PublicKey %x, got %x",
 				minerJob.BlockMiner.GetWorkhash(), bm.GetWorkhash(),
 				minerJob.BlockMiner.GetPublickey(), bm.GetPublickey())
+			sharesMetric.Inc(protocol, SHARE_INVALID)
 
 			return &xatum.S2C_Print{
 				Msg: "share accepted (dev)",
@@ -272,6 +259,8 @@ func handleConnPacket(cdat *server.CData, str string, packetsRecv int, ip string
 
 		// validate nonce
 		if slices.Contains(minerJob.SubmittedNonces, bm.GetNonce()) {
+			sharesMetric.Inc(protocol, SHARE_DUPLICATE)
+
 			cdat.Lock()
 			defer cdat.Unlock()
 
@@ -288,6 +277,7 @@ func handleConnPacket(cdat *server.CData, str string, packetsRecv int, ip string
 			bm.GetTimestamp() > uint64(time.Now().UnixMilli()+config.TIMESTAMP_FUTURE_LIMIT*1000) {
 
 			err := fmt.Errorf("timestamp is too much in the past/future: %d, current: %d", bm.GetTimestamp(), time.Now().UnixMilli())
+			sharesMetric.Inc(protocol, SHARE_INVALID)
 
 			return &xatum.S2C_Print{
 				Msg: "timestamp is too much in the past or future, check that your clock is synchronized",
@@ -312,6 +302,7 @@ func handleConnPacket(cdat *server.CData, str string, packetsRecv int, ip string
 					log.Err("failed to compute forced PoW:", err)
 					return
 				}
+				powVerifyMetric.ObserveDuration(t, algo)
 
 				powHash = pow[:]
 
@@ -320,12 +311,14 @@ func handleConnPacket(cdat *server.CData, str string, packetsRecv int, ip string
 
 			if [32]byte(powHash) == [32]byte{} {
 				log.Errf("invalid blank pow data %x", powHash)
+				sharesMetric.Inc(protocol, SHARE_INVALID)
 				return
 			}
 
 			// validate difficulty
 			if !pow.CheckDiff([32]byte(powHash), minerJob.Diff) {
 				log.Warn("hash does not meet target, ForcePowCheck:", ForcePowCheck)
+				sharesMetric.Inc(protocol, SHARE_INVALID)
 				if ForcePowCheck {
 					cdat.Lock()
 					cdat.Score = -cfg.Cfg.Slave.TrustScore
@@ -358,6 +351,7 @@ func handleConnPacket(cdat *server.CData, str string, packetsRecv int, ip string
 						log.Err("failed to compute PoW:", err)
 						return
 					}
+					powVerifyMetric.ObserveDuration(t, algo)
 
 					log.Debugf("PoW checked in %v algo: %s", time.Since(t).String(), algo)
 
@@ -366,6 +360,8 @@ func handleConnPacket(cdat *server.CData, str string, packetsRecv int, ip string
 						cdat.Score = -cfg.Cfg.Slave.TrustScore
 						cdat.Unlock()
 
+						sharesMetric.Inc(protocol, SHARE_INVALID)
+
 						err := fmt.Errorf("invalid pow hash: %x, expected %x", powHash, pow)
 						log.Warn(err)
 						return
@@ -375,33 +371,23 @@ func handleConnPacket(cdat *server.CData, str string, packetsRecv int, ip string
 				}
 			}
 			// SHARE IS CONSIDERED VALID
+			sharesMetric.Inc(protocol, SHARE_ACCEPTED)
+
 			cdat.Lock()
 			cdat.Score++
-			deltaT := float64(time.Since(cdat.LastShare).Nanoseconds()) * time.Nanosecond.Seconds()
-			hr := float64(minerJob.Diff) / deltaT
-			log.Debugf("Hashrate: %.1f H/s", hr)
 			cdat.LastShare = time.Now()
-			futDiff := hr * cfg.Cfg.Slave.ShareTarget
-			if futDiff < float64(cfg.Cfg.Slave.MinDifficulty) {
-				futDiff = float64(cfg.Cfg.Slave.MinDifficulty)
-			}
-
-			// new connections have faster diff adjustment
-			var K float64 = 20
-			if cdat.Score >= 0 && cdat.Score < 5 {
-				K = 5
-			} else if cdat.Score < 15 {
-				K = 12
-			}
-
-			cdat.NextDiff = (cdat.NextDiff*(K-1) + futDiff) / K
-			log.Debug("next diff:", cdat.GetNextDiff())
+			nextDiff, diffChanged := cdat.VarDiff.Share(float64(minerJob.Diff))
+			log.Debug("next diff:", nextDiff)
 			cdat.Unlock()
 
 			cdat.RLock()
-			slave.SendShare(cdat.Wallet, minerJob.Diff)
+			wallet := cdat.Wallet
+			worker := cdat.Worker
+			solo := cdat.Login.Solo
 			cdat.RUnlock()
 
+			slave.SendShare(wallet, worker, minerJob.Diff, solo)
+
 			// if share finds a block, submit it
 			if findsBlock {
 				log.Info("BLOCK FOUND")
@@ -416,22 +402,21 @@ func handleConnPacket(cdat *server.CData, str string, packetsRecv int, ip string
 						err = SubmitBlock(hex.EncodeToString(bm[:]))
 						log.Err("block resubmit attempt:", err)
 						if err != nil {
-							slave.SendBlockFound(bm.Hash())
+							slave.SendBlockFound(bm.Hash(), wallet, solo)
 						}
 					}()
 
 					return
 				}
 
-				slave.SendBlockFound(bm.Hash())
+				slave.SendBlockFound(bm.Hash(), wallet, solo)
 			}
 			// if the difficulty changed too much, send a new job with updated difficulty
 
 			cdat.Lock()
 			defer cdat.Unlock()
 
-			if cdat.NextDiff > float64(cdat.LastJob().Diff)*4 ||
-				cdat.NextDiff < float64(cdat.LastJob().Diff)*0.5 {
+			if diffChanged && uint64(nextDiff) != cdat.LastJob().Diff {
 
 				toSend.Diff = cdat.LastJob().ChainDiff
 				toSend.BM = cdat.LastJob().BlockMiner
@@ -0,0 +1,45 @@
+// Copyright (C) 2024 XELIS
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"xelis-pool/address"
+	"xelis-pool/cfg"
+	"xelis-pool/login"
+	"xelis-pool/vardiff"
+	"xelis-pool/xatum/server"
+)
+
+// parseLogin parses the login and the password of a miner, see the login package
+func parseLogin(user, password string) (login.Login, error) {
+	return login.Parser{
+		IsAddressValid: address.IsAddressValid,
+		MinDiff:        cfg.Cfg.Slave.MinDifficulty,
+		MaxDiff:        cfg.Cfg.Slave.MaxDifficulty,
+	}.Parse(user, password)
+}
+
+// applyLogin sets the wallet, worker, options and difficulty of a connection.
+// A fixed difficulty disables the vardiff. CData MUST be locked before calling this.
+func applyLogin(cdat *server.CData, l login.Login) {
+	cdat.Wallet = l.Wallet
+	cdat.Worker = l.Worker
+	cdat.Login = l
+
+	if l.Diff != 0 {
+		cdat.VarDiff = vardiff.NewFixed(float64(l.Diff))
+	}
+}
@@ -0,0 +1,43 @@
+// Copyright (C) 2024 XELIS
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import "xelis-pool/metrics"
+
+const (
+	PROTOCOL_XATUM   = "xatum"
+	PROTOCOL_STRATUM = "stratum"
+	PROTOCOL_GETWORK = "getwork"
+)
+
+// share results
+const (
+	SHARE_ACCEPTED  = "accepted"
+	SHARE_STALE     = "stale"
+	SHARE_DUPLICATE = "duplicate"
+	SHARE_INVALID   = "invalid"
+)
+
+var sharesMetric = metrics.NewCounter("xelis_slave_shares_total",
+	"Number of shares submitted by miners.", "protocol", "result")
+
+var powVerifyMetric = metrics.NewHistogram("xelis_slave_pow_verify_seconds",
+	"Time spent computing the PoW hash of a share.", []float64{0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5}, "algorithm")
+
+var jobBroadcastMetric = metrics.NewHistogram("xelis_slave_job_broadcast_seconds",
+	"Time between the start of a job broadcast and the job being sent to a miner.", metrics.LatencyBuckets, "protocol")
+
+var minersMetric = metrics.NewGauge("xelis_slave_miners", "Number of connected miners.", "protocol")
@@ -24,7 +24,10 @@ import (
 	"xelis-pool/cfg"
 	"xelis-pool/config"
 	"xelis-pool/log"
+	"xelis-pool/metrics"
+	"xelis-pool/rate_limit"
 	"xelis-pool/slave"
+	"xelis-pool/tlscert"
 	"xelis-pool/xatum"
 	"xelis-pool/xatum/server"
 )
@@ -69,22 +72,31 @@ func main() {
 		go onKill(c)
 	}
 
+	certs, err := tlscert.Load(cfg.Cfg.Slave.TlsCert, cfg.Cfg.Slave.TlsKey)
+	if err != nil {
+		log.Fatal(err)
+	}
+
 	s := &server.Server{}
 	sGw := &GetworkServer{}
 	strat := &StratumServer{}
 
-	go sGw.listenGetwork()
+	go sGw.listenGetwork(certs.Config())
 	go handleXatumConns(s)
 	go func() {
 		time.Sleep(10 * time.Millisecond)
-		handleStratumConns(strat)
+		handleStratumConns(strat, certs.Config())
 	}()
 
 	go handleDaemon(s, sGw, strat)
+	// bans are shared with the other slaves through the master
+	rate_limit.OnBan = slave.SendBan
+
 	go slave.StartSlaveClient()
 	go statsSender(s, sGw, strat)
+	go metrics.Serve(cfg.Cfg.Slave.MetricsAddr)
 
-	s.Start(cfg.Cfg.Slave.XatumPort)
+	s.Start(cfg.Cfg.Slave.XatumPort, certs.Config())
 }
 
 func statsSender(s *server.Server, gws *GetworkServer, strat *StratumServer) {
@@ -94,6 +106,9 @@ func statsSender(s *server.Server, gws *GetworkServer, strat *StratumServer) {
 		gws.RLock()
 		strat.RLock()
 		slave.SendStats(len(s.Connections)+len(strat.Conns), len(gws.Conns))
+		minersMetric.Set(float64(len(s.Connections)), PROTOCOL_XATUM)
+		minersMetric.Set(float64(len(strat.Conns)), PROTOCOL_STRATUM)
+		minersMetric.Set(float64(len(gws.Conns)), PROTOCOL_GETWORK)
 		strat.RUnlock()
 		gws.RUnlock()
 		s.RUnlock()
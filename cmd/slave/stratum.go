@@ -18,19 +18,21 @@ package main
 import (
 	"bufio"
 	"crypto/rand"
+	"crypto/tls"
 	"encoding/binary"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"net"
 	"strconv"
-	"strings"
 	"sync"
 	"time"
-	"xelis-pool/address"
 	"xelis-pool/cfg"
 	"xelis-pool/config"
 	"xelis-pool/log"
+	"xelis-pool/login"
 	"xelis-pool/pow"
+	"xelis-pool/proxyproto"
 	"xelis-pool/rate_limit"
 	"xelis-pool/stratum"
 	"xelis-pool/util"
@@ -41,6 +43,8 @@ import (
 type StratumServer struct {
 	Conns []*StratumConn
 
+	Sessions map[string]*stratumSession // sessions of the disconnected miners
+
 	sync.RWMutex
 }
 
@@ -52,6 +56,10 @@ type StratumConn struct {
 
 	LastOutID uint32
 	MinerID   [16]byte // the first bytes of extra nonce
+	Solo      bool     // connected to the solo port
+
+	SessionID     string
+	ExtraNonceSub bool // subscribed to extra nonce changes (mining.extranonce.subscribe)
 
 	CData server.CData
 }
@@ -84,16 +92,33 @@ func (g *StratumConn) Close() error {
 	return g.Conn.Close()
 }
 
-func handleStratumConns(s *StratumServer) {
-	/*listener, err := tls.Listen("tcp", "0.0.0.0:"+util.FormatUint(cfg.Cfg.Slave.StratumPort),
-	&tls.Config{Certificates: []tls.Certificate{
-		server.Cert,
-	}})*/
-	listener, err := net.Listen("tcp", "0.0.0.0:"+util.FormatUint(cfg.Cfg.Slave.StratumPort))
+func handleStratumConns(s *StratumServer, tlsConfig *tls.Config) {
+	listener, err := proxyproto.Listen("0.0.0.0:"+util.FormatUint(cfg.Cfg.Slave.StratumPort), cfg.Cfg.Slave.ProxyProtocol)
 	if err != nil {
 		log.Fatal(err)
 	}
 
+	if cfg.Cfg.Slave.StratumTlsPort != 0 {
+		tlsListener, err := proxyproto.Listen("0.0.0.0:"+util.FormatUint(cfg.Cfg.Slave.StratumTlsPort), cfg.Cfg.Slave.ProxyProtocol)
+		if err != nil {
+			log.Fatal(err)
+		}
+		tlsListener = tls.NewListener(tlsListener, tlsConfig)
+		log.Info("Stratum TLS server listening on port", cfg.Cfg.Slave.StratumTlsPort)
+
+		go acceptStratumConns(s, tlsListener, false)
+	}
+
+	if cfg.Cfg.Slave.SoloStratumPort != 0 {
+		soloListener, err := proxyproto.Listen("0.0.0.0:"+util.FormatUint(cfg.Cfg.Slave.SoloStratumPort), cfg.Cfg.Slave.ProxyProtocol)
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.Info("Stratum solo server listening on port", cfg.Cfg.Slave.SoloStratumPort)
+
+		go acceptStratumConns(s, soloListener, true)
+	}
+
 	// Start the pinger
 	go func() {
 		for {
@@ -117,7 +142,12 @@ func handleStratumConns(s *StratumServer) {
 		}
 	}()
 
-	// Accept incoming connections and handle them
+	acceptStratumConns(s, listener, false)
+}
+
+// acceptStratumConns accepts incoming connections and handles them. All the
+// miners of a solo listener mine solo.
+func acceptStratumConns(s *StratumServer, listener net.Listener, solo bool) {
 	for {
 		Conn, err := listener.Accept()
 		if err != nil {
@@ -140,6 +170,8 @@ func handleStratumConns(s *StratumServer) {
 		sConn := &StratumConn{
 			Conn:    Conn,
 			MinerID: GenerateID(),
+			Solo:    solo,
+			CData:   server.NewCData(PROTOCOL_STRATUM),
 		}
 
 		log.Debugf("miner has MinerID %x", sConn.MinerID)
@@ -147,7 +179,9 @@ func handleStratumConns(s *StratumServer) {
 		sConn.Alive = true
 		sConn.IP = ip
 
+		s.Lock()
 		s.Conns = append(s.Conns, sConn)
+		s.Unlock()
 
 		// Handle the connection in a new goroutine
 		go handleStratumConn(s, sConn)
@@ -161,9 +195,11 @@ func GenerateID() [16]byte {
 }
 
 // TODO: put mutexes on disconnect errors
-func handleStratumConn(_ *StratumServer, c *StratumConn) {
+func handleStratumConn(s *StratumServer, c *StratumConn) {
 	rdr := bufio.NewReader(c.Conn)
 
+	defer s.saveSession(c)
+
 	// go sendPingPackets(s, Conn)
 
 	numMessages := 0
@@ -208,25 +244,36 @@ func handleStratumConn(_ *StratumServer, c *StratumConn) {
 
 		switch req.Method {
 		case "mining.subscribe":
+			// params are the user agent and the session id to resume
+			var params []any
+			json.Unmarshal(req.Params, &params)
+
+			if len(params) >= 2 {
+				if id, ok := params[1].(string); ok && id != "" {
+					if s.resumeSession(c, id) {
+						log.Debug("Stratum miner with IP", c.IP, "resumed session", id)
+					}
+				}
+			}
+
 			MutLastJob.RLock()
 			job := LastKnownJob
 			MutLastJob.RUnlock()
 
-			// set pool nonce to the POOL_NONCE constant
-			job.Blob.SetExtraNonce([32]byte{})
-			job.Blob.SetPoolNonce(config.POOL_NONCE)
-			job.Blob.SetJobID(c.MinerID)
-
-			xnonce := job.Blob.GetExtraNonce()
 			pubkey := job.Blob.GetPublickey()
 
 			c.CData.Lock()
+			if c.SessionID == "" {
+				c.SessionID = newSessionID()
+			}
+			xnonce := c.GetExtraNonce()
+
 			err := c.WriteJSON(stratum.ResponseOut{
 				Id: req.Id,
 				Result: []any{
-					"",                            // useless (session id)
+					c.SessionID,
 					hex.EncodeToString(xnonce[:]), // extra nonce
-					32,                            // useless (extra nonce length)
+					32,                            // extra nonce length
 					hex.EncodeToString(pubkey[:]), // public key
 				},
 			})
@@ -255,60 +302,33 @@ func handleStratumConn(_ *StratumServer, c *StratumConn) {
 				return
 			}
 
-			params[0] = strings.ReplaceAll(params[0], ".", "+")
-
-			splAddr := strings.Split(params[0], "+")
-
-			var wall string
-			if len(splAddr) > 0 {
-				wall = splAddr[0]
-			}
-			var diff uint64 = cfg.Cfg.Slave.InitialDifficulty
-
-			if len(splAddr) > 1 {
-				diffStr := splAddr[1]
-
-				diffNum, err := strconv.ParseUint(diffStr, 10, 64)
-
-				if err != nil {
-					log.Debug(err)
-				} else {
-					const MAX = 10_000_000
-
-					if diffNum < cfg.Cfg.Slave.MinDifficulty {
-						diffNum = cfg.Cfg.Slave.MinDifficulty
-					} else if diffNum > MAX {
-						diffNum = MAX
-					}
-					diff = diffNum
-				}
-			}
-
-			if !address.IsAddressValid(wall) {
+			// the password may contain login options
+			auth, err := parseLogin(params[0], params[1])
+			if err != nil {
 				c.CData.Lock()
 
 				c.WriteJSON(stratum.ResponseOut{
 					Id:     req.Id,
 					Result: false,
-					Error: &stratum.Error{
-						Code:    -1,
-						Message: "invalid wallet address",
-					},
+					Error:  stratumLoginError(err),
 				})
 
-				log.Debug("Invalid wallet address", wall)
+				log.Debugf("invalid login %s: %v", params[0], err)
 				c.Close()
 
 				c.CData.Unlock()
 				return
 			}
 
-			log.Info("Stratum miner with address", wall, "IP", c.IP, "connected")
+			if c.Solo {
+				auth.Solo = true
+			}
 
-			c.CData.NextDiff = float64(diff)
+			log.Info("Stratum miner with address", auth.Wallet, "worker", auth.Worker, "solo", auth.Solo, "IP", c.IP, "connected")
 
 			c.CData.Lock()
-			c.CData.Wallet = wall
+			applyLogin(&c.CData, auth)
+			diff := uint64(c.CData.VarDiff.Diff())
 
 			// send the job
 			MutLastJob.RLock()
@@ -331,6 +351,10 @@ func handleStratumConn(_ *StratumServer, c *StratumConn) {
 				return
 			}
 
+			if auth.Diff != 0 {
+				c.ShowMessage("fixed difficulty " + strconv.FormatUint(auth.Diff, 10))
+			}
+
 			// send actual job
 			SendStratumJob(c, job.Diff, job.Blob)
 
@@ -393,6 +417,7 @@ func handleStratumConn(_ *StratumServer, c *StratumConn) {
 
 			if bm.GetTimestamp() == 0 {
 				log.Warnf("outdated share, job id %x", bm.GetJobID())
+				sharesMetric.Inc(PROTOCOL_STRATUM, SHARE_STALE)
 
 				c.WriteJSON(stratum.ResponseOut{
 					Id:     req.Id,
@@ -419,7 +444,7 @@ func handleStratumConn(_ *StratumServer, c *StratumConn) {
 
 			c.CData.Unlock()
 
-			print, shouldKick, err := handleConnPacket(&c.CData, pStr, 10, c.IP, jobToSend, c.MinerID)
+			print, shouldKick, err := handleConnPacket(PROTOCOL_STRATUM, &c.CData, pStr, 10, c.IP, jobToSend, c.MinerID)
 			if err != nil {
 				log.Err(err)
 			}
@@ -456,6 +481,15 @@ func handleStratumConn(_ *StratumServer, c *StratumConn) {
 				SendStratumJob(c, jobToSend.Diff, jobToSend.BM)
 			}
 
+		case "mining.extranonce.subscribe":
+			c.CData.Lock()
+			c.ExtraNonceSub = true
+			c.WriteJSON(stratum.ResponseOut{
+				Id:     req.Id,
+				Result: true,
+			})
+			c.CData.Unlock()
+
 		default:
 			if req.Method != "mining.pong" {
 				log.Warn("Unknown Stratum method", req.Method)
@@ -477,24 +511,56 @@ func (c *StratumConn) SendDifficulty(diff uint64) error {
 	})
 }
 
-func (c *StratumConn) SendJob(bm pow.BlockMiner) error {
+// stratumLoginError returns the Stratum error of an invalid login
+func stratumLoginError(err error) *stratum.Error {
+	var lerr *login.Error
+	if errors.As(err, &lerr) && lerr.Kind == login.ERR_ADDRESS {
+		return &stratum.Error{
+			Code:    24, // unauthorized worker
+			Message: err.Error(),
+		}
+	}
+
+	return &stratum.Error{
+		Code:    20, // other
+		Message: err.Error(),
+	}
+}
+
+// ShowMessage shows a message in the miner console (client.show_message extension)
+func (c *StratumConn) ShowMessage(msg string) error {
 	c.LastOutID++
 
-	jobid := bm.GetJobID()
-	workhash := bm.GetWorkhash()
+	return c.WriteJSON(stratum.RequestOut{
+		Id:     c.LastOutID,
+		Method: "client.show_message",
+		Params: []string{msg},
+	})
+}
 
-	timeStr := strconv.FormatUint(bm.GetTimestamp(), 16)
+// SendExtraNonce sends the new extra nonce to a miner subscribed to extra nonce changes
+// NOTE: StratumConn MUST be locked before calling this
+func (c *StratumConn) SendExtraNonce() error {
+	c.LastOutID++
 
-	/*xnonce := c.GetExtraNonce()
-	c.WriteJSON(stratum.RequestOut{
+	xnonce := c.GetExtraNonce()
+	return c.WriteJSON(stratum.RequestOut{
 		Id:     c.LastOutID,
 		Method: "mining.set_extranonce",
 		Params: []any{
 			hex.EncodeToString(xnonce[:]), // extra nonce
-			32,                            // useless parameter
+			32,                            // extra nonce length
 		},
 	})
-	c.LastOutID++*/
+}
+
+func (c *StratumConn) SendJob(bm pow.BlockMiner) error {
+	c.LastOutID++
+
+	jobid := bm.GetJobID()
+	workhash := bm.GetWorkhash()
+
+	timeStr := strconv.FormatUint(bm.GetTimestamp(), 16)
 
 	MutLastJob.RLock()
 	algo := LastKnownJob.Algorithm
@@ -558,6 +624,8 @@ func SendStratumJob(v *StratumConn, blockDiff uint64, blob pow.BlockMiner) {
 
 // sends a job to all the websockets, and removes old websockets
 func (s *StratumServer) sendJobs(diff uint64, blob pow.BlockMiner) {
+	start := time.Now()
+
 	s.Lock()
 	log.Dev("StratumServer sendJobs: num sockets:", len(s.Conns))
 
@@ -605,6 +673,7 @@ func (s *StratumServer) sendJobs(diff uint64, blob pow.BlockMiner) {
 			defer c.CData.Unlock()
 
 			SendStratumJob(c, diff, blob)
+			jobBroadcastMetric.ObserveDuration(start, PROTOCOL_STRATUM)
 
 			log.Debug("StratumServer sendJobs: done, sent to IP", c.IP)
 		}()
@@ -0,0 +1,198 @@
+// Copyright (C) 2024 XELIS
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"time"
+	"xelis-pool/log"
+	"xelis-pool/vardiff"
+	"xelis-pool/xatum/server"
+)
+
+// Stratum miners get a session id in the mining.subscribe response. A miner
+// which reconnects can send it back to resume the session: it keeps its extra
+// nonce (MinerID) and its jobs, so shares of the previous connection are not
+// stale.
+
+// time a session can be resumed for after the miner disconnects
+const STRATUM_SESSION_TTL = 5 * time.Minute
+
+const MAX_SESSION_ID_LENGTH = 64
+
+type stratumSession struct {
+	MinerID [16]byte
+	Jobs    []server.ConnJob
+	VarDiff vardiff.VarDiff
+	Expires time.Time
+}
+
+func newSessionID() string {
+	id := make([]byte, 16)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+// resumeSession gives c the MinerID and the jobs of the session id, if it
+// exists. If a connection still uses the session (usually the previous
+// connection of the miner, not closed yet), the session is taken from it.
+// Returns false if the session is unknown.
+// StratumServer and c MUST NOT be locked.
+func (s *StratumServer) resumeSession(c *StratumConn, id string) bool {
+	if len(id) > MAX_SESSION_ID_LENGTH {
+		return false
+	}
+
+	old, ok := s.takeSession(c, id)
+	if !ok {
+		return false
+	}
+
+	// the previous connection is notified once StratumServer is unlocked, so a
+	// slow miner doesn't block the other connections
+	if old != nil {
+		old.CData.Lock()
+		old.detachSession()
+		old.CData.Unlock()
+	}
+
+	return true
+}
+
+// takeSession gives c the state of the session id. Returns the connection the
+// session was taken from, if any, which must then be detached.
+// StratumServer and c MUST NOT be locked.
+func (s *StratumServer) takeSession(c *StratumConn, id string) (*StratumConn, bool) {
+	s.Lock()
+	defer s.Unlock()
+
+	if sess, ok := s.Sessions[id]; ok {
+		delete(s.Sessions, id)
+
+		if time.Now().After(sess.Expires) {
+			return nil, false
+		}
+
+		c.CData.Lock()
+		c.SessionID = id
+		c.MinerID = sess.MinerID
+		c.CData.Jobs = sess.Jobs
+		c.CData.VarDiff = sess.VarDiff
+		c.CData.Unlock()
+
+		return nil, true
+	}
+
+	for _, old := range s.Conns {
+		if old == c {
+			continue
+		}
+
+		old.CData.Lock()
+		if !old.Alive || old.SessionID != id {
+			old.CData.Unlock()
+			continue
+		}
+
+		c.CData.Lock()
+		c.SessionID = id
+		c.MinerID = old.MinerID
+		c.CData.Jobs = old.CData.Jobs
+		c.CData.VarDiff = old.CData.VarDiff
+		c.CData.Unlock()
+
+		// the old connection gets a new session right away, so the session
+		// can't be resumed twice
+		old.resetSession()
+		old.CData.Unlock()
+
+		return old, true
+	}
+
+	return nil, false
+}
+
+// resetSession gives a new session to a connection whose session has been
+// resumed by another connection.
+// StratumConn MUST be locked before calling this.
+func (c *StratumConn) resetSession() {
+	c.SessionID = newSessionID()
+	c.MinerID = GenerateID()
+	c.CData.Jobs = nil
+	c.CData.VarDiff = server.NewCData(PROTOCOL_STRATUM).VarDiff
+}
+
+// detachSession notifies a connection whose session has been reset by
+// resetSession. Miners subscribed to extra nonce changes keep mining with the
+// new extra nonce, the other ones are disconnected.
+// StratumConn MUST be locked before calling this, StratumServer MUST NOT.
+func (c *StratumConn) detachSession() {
+	if !c.Alive {
+		return
+	}
+
+	if !c.ExtraNonceSub {
+		log.Debug("Stratum session of IP", c.IP, "resumed by another connection, disconnecting")
+		c.Close()
+		return
+	}
+
+	err := c.SendExtraNonce()
+	if err != nil {
+		log.Debug(err)
+		c.Close()
+		return
+	}
+
+	MutLastJob.RLock()
+	job := LastKnownJob
+	MutLastJob.RUnlock()
+
+	SendStratumJob(c, job.Diff, job.Blob)
+}
+
+// saveSession keeps the session of a disconnected miner, so that it can be
+// resumed, and removes the expired sessions.
+// StratumServer and c MUST NOT be locked.
+func (s *StratumServer) saveSession(c *StratumConn) {
+	s.Lock()
+	defer s.Unlock()
+
+	now := time.Now()
+	for id, sess := range s.Sessions {
+		if now.After(sess.Expires) {
+			delete(s.Sessions, id)
+		}
+	}
+
+	c.CData.Lock()
+	defer c.CData.Unlock()
+
+	if c.SessionID == "" || len(c.CData.Jobs) == 0 {
+		return
+	}
+
+	if s.Sessions == nil {
+		s.Sessions = make(map[string]*stratumSession)
+	}
+	s.Sessions[c.SessionID] = &stratumSession{
+		MinerID: c.MinerID,
+		Jobs:    c.CData.Jobs,
+		VarDiff: c.CData.VarDiff,
+		Expires: now.Add(STRATUM_SESSION_TTL),
+	}
+}
@@ -81,7 +81,7 @@ func handleConn(s *server.Server, conn *server.Connection) {
 
 		var jobToSend JobToSend
 
-		print, shouldKick, err := handleConnPacket(&conn.CData, str, packetsRecv, conn.Conn.RemoteAddr().String(), &jobToSend, [16]byte{})
+		print, shouldKick, err := handleConnPacket(PROTOCOL_XATUM, &conn.CData, str, packetsRecv, conn.Conn.RemoteAddr().String(), &jobToSend, [16]byte{})
 		if err != nil {
 			log.Warn("Xatum:", err)
 		}
@@ -15,24 +15,32 @@
 
 package database
 
-import "xelis-pool/serializer"
+import (
+	"encoding/binary"
+	"math"
+	"xelis-pool/serializer"
+)
 
 type Share struct {
-	Wallet string `json:"wall"`
-	Diff   uint64 `json:"diff"`
-	Time   uint64 `json:"time"`
+	Wallet  string `json:"wall"`
+	Diff    uint64 `json:"diff"`
+	Time    uint64 `json:"time"`
+	NetDiff uint64 `json:"net_diff"` // network difficulty when the share was found (0 in old shares)
 }
 
 const VERSION = 0
 
+const SHARE_VERSION = 1
+
 func (x *Share) Serialize() []byte {
 	s := serializer.Serializer{}
 
-	s.AddUint8(VERSION)
+	s.AddUint8(SHARE_VERSION)
 
 	s.AddString(x.Wallet)
 	s.AddUint64(x.Diff)
 	s.AddUint64(x.Time)
+	s.AddUvarint(x.NetDiff)
 
 	return s.Data
 }
@@ -41,12 +49,16 @@ func (x *Share) Deserialize(data []byte) error {
 		Data: data,
 	}
 
-	d.ReadUint8()
+	version := d.ReadUint8()
 
 	x.Wallet = d.ReadString()
 	x.Diff = d.ReadUint64()
 	x.Time = d.ReadUint64()
 
+	if version >= 1 {
+		x.NetDiff = d.ReadUvarint()
+	}
+
 	return d.Error
 }
 
@@ -147,19 +159,23 @@ func (x *PendingBals) Deserialize(data []byte) error {
 
 // AddrInfo holds informations about a given address
 type AddrInfo struct {
-	Balance        uint64 // confirmed balance that can be paid out
-	BalancePending uint64 // unconfirmed balance (cannot be paid out)
-	Paid           uint64 // amount that has been paid out so far
+	Balance         uint64 // confirmed balance that can be paid out
+	BalancePending  uint64 // unconfirmed balance (cannot be paid out)
+	Paid            uint64 // amount that has been paid out so far
+	PayoutThreshold uint64 // custom minimum withdrawal, 0 to use the pool default
 }
 
+const ADDR_INFO_VERSION = 1
+
 func (x *AddrInfo) Serialize() []byte {
 	s := serializer.Serializer{}
 
-	s.AddUint8(VERSION)
+	s.AddUint8(ADDR_INFO_VERSION)
 
 	s.AddUvarint(x.Balance)
 	s.AddUvarint(x.BalancePending)
 	s.AddUvarint(x.Paid)
+	s.AddUvarint(x.PayoutThreshold)
 
 	return s.Data
 }
@@ -169,24 +185,733 @@ func (x *AddrInfo) Deserialize(data []byte) error {
 		Data: data,
 	}
 
-	d.ReadUint8()
+	version := d.ReadUint8()
 
 	x.Balance = d.ReadUvarint()
 	x.BalancePending = d.ReadUvarint()
 	x.Paid = d.ReadUvarint()
 
+	if version >= 1 {
+		x.PayoutThreshold = d.ReadUvarint()
+	}
+
+	return d.Error
+}
+
+// ThresholdRequest is a payout threshold change waiting for the proof of
+// ownership of the address: a transfer to the pool wallet with Code as extra data
+type ThresholdRequest struct {
+	Threshold  uint64
+	Code       string
+	Topoheight uint64 // wallet topoheight when the request was made
+	Expires    uint64 // UNIX timestamp
+}
+
+// ThresholdRequestKey returns the key of a threshold request: address, a zero
+// byte, then the code
+func ThresholdRequestKey(address, code string) []byte {
+	return append(append([]byte(address), 0), code...)
+}
+
+func (x *ThresholdRequest) Serialize() []byte {
+	s := serializer.Serializer{}
+
+	s.AddUint8(VERSION)
+
+	s.AddUvarint(x.Threshold)
+	s.AddString(x.Code)
+	s.AddUvarint(x.Topoheight)
+	s.AddUvarint(x.Expires)
+
+	return s.Data
+}
+
+func (x *ThresholdRequest) Deserialize(data []byte) error {
+	d := serializer.Deserializer{
+		Data: data,
+	}
+
+	d.ReadUint8()
+
+	x.Threshold = d.ReadUvarint()
+	x.Code = d.ReadString()
+	x.Topoheight = d.ReadUvarint()
+	x.Expires = d.ReadUvarint()
+
+	return d.Error
+}
+
+// Ban is an IP (or IPv6 /64 network) banned on all the slaves
+type Ban struct {
+	Ends  uint64 // UNIX timestamp
+	Slave string // name of the slave which banned the IP
+}
+
+func (x *Ban) Serialize() []byte {
+	s := serializer.Serializer{}
+
+	s.AddUint8(VERSION)
+
+	s.AddUvarint(x.Ends)
+	s.AddString(x.Slave)
+
+	return s.Data
+}
+
+func (x *Ban) Deserialize(data []byte) error {
+	d := serializer.Deserializer{
+		Data: data,
+	}
+
+	d.ReadUint8()
+
+	x.Ends = d.ReadUvarint()
+	x.Slave = d.ReadString()
+
+	return d.Error
+}
+
+// AuditEntry is a call to the admin API
+type AuditEntry struct {
+	Time   uint64 `json:"time"`
+	Token  string `json:"token"` // name of the token, empty if the authentication failed
+	Role   string `json:"role"`
+	IP     string `json:"ip"`
+	Method string `json:"method"`
+	Path   string `json:"path"`
+	Status uint16 `json:"status"`
+}
+
+func (x *AuditEntry) Serialize() []byte {
+	s := serializer.Serializer{}
+
+	s.AddUint8(VERSION)
+
+	s.AddUvarint(x.Time)
+	s.AddString(x.Token)
+	s.AddString(x.Role)
+	s.AddString(x.IP)
+	s.AddString(x.Method)
+	s.AddString(x.Path)
+	s.AddUvarint(uint64(x.Status))
+
+	return s.Data
+}
+
+func (x *AuditEntry) Deserialize(data []byte) error {
+	d := serializer.Deserializer{
+		Data: data,
+	}
+
+	d.ReadUint8()
+
+	x.Time = d.ReadUvarint()
+	x.Token = d.ReadString()
+	x.Role = d.ReadString()
+	x.IP = d.ReadString()
+	x.Method = d.ReadString()
+	x.Path = d.ReadString()
+	x.Status = uint16(d.ReadUvarint())
+
+	return d.Error
+}
+
+type BlockStatus uint8
+
+const (
+	BLOCK_PENDING   BlockStatus = iota // waiting for confirmations
+	BLOCK_CONFIRMED                    // matured and paid to miners
+	BLOCK_ORPHANED                     // orphaned, miners haven't been paid
+	BLOCK_SIDE                         // matured as a side block, paid with a reduced reward
+)
+
+func (s BlockStatus) String() string {
+	switch s {
+	case BLOCK_PENDING:
+		return "pending"
+	case BLOCK_CONFIRMED:
+		return "confirmed"
+	case BLOCK_ORPHANED:
+		return "orphaned"
+	case BLOCK_SIDE:
+		return "side"
+	default:
+		return "unknown"
+	}
+}
+
+// Block is a block found by the pool
+type Block struct {
+	Height uint64
+	Hash   [32]byte
+	Finder string  // address of the miner who found the block
+	Effort float32 // sum of share difficulty / network difficulty of the round, 1 = 100% effort
+	Reward uint64  // miner reward of the block
+	Type   string  // block type from the daemon (normal, side, sync, orphaned)
+	Status BlockStatus
+	Time   uint64 // UNIX timestamp
+
+	PoolFee uint64 // pool fee credited to the fee address (0 in old blocks)
+
+	// work of the round which found the block (0 in old blocks)
+	RoundStart  uint64 // UNIX timestamp of the previous block
+	RoundShares uint64 // number of shares
+	RoundHashes uint64 // sum of the share difficulties
+
+	Solo bool // found by a solo miner, the reward is paid to the finder only
+}
+
+const BLOCK_VERSION = 3
+
+// BlockKey returns the key of a block in the BLOCKS bucket. Keys are sorted by height.
+func BlockKey(height uint64, hash [32]byte) []byte {
+	return append(binary.BigEndian.AppendUint64(make([]byte, 0, 8+32), height), hash[:]...)
+}
+
+func (x *Block) Serialize() []byte {
+	s := serializer.Serializer{}
+
+	s.AddUint8(BLOCK_VERSION)
+
+	s.AddUvarint(x.Height)
+	s.AddFixedByteArray(x.Hash[:], 32)
+	s.AddString(x.Finder)
+	s.AddUint32(math.Float32bits(x.Effort))
+	s.AddUvarint(x.Reward)
+	s.AddString(x.Type)
+	s.AddUint8(uint8(x.Status))
+	s.AddUvarint(x.Time)
+	s.AddUvarint(x.PoolFee)
+	s.AddUvarint(x.RoundStart)
+	s.AddUvarint(x.RoundShares)
+	s.AddUvarint(x.RoundHashes)
+	s.AddBool(x.Solo)
+
+	return s.Data
+}
+
+func (x *Block) Deserialize(data []byte) error {
+	d := serializer.Deserializer{
+		Data: data,
+	}
+
+	version := d.ReadUint8()
+
+	x.Height = d.ReadUvarint()
+	copy(x.Hash[:], d.ReadFixedByteArray(32))
+	x.Finder = d.ReadString()
+	x.Effort = math.Float32frombits(d.ReadUint32())
+	x.Reward = d.ReadUvarint()
+	x.Type = d.ReadString()
+	x.Status = BlockStatus(d.ReadUint8())
+	x.Time = d.ReadUvarint()
+
+	if version >= 1 {
+		x.PoolFee = d.ReadUvarint()
+	}
+	if version >= 2 {
+		x.RoundStart = d.ReadUvarint()
+		x.RoundShares = d.ReadUvarint()
+		x.RoundHashes = d.ReadUvarint()
+	} else {
+		// effort of old blocks was multiplied by 32
+		x.Effort /= 32
+	}
+	if version >= 3 {
+		x.Solo = d.ReadBool()
+	}
+
+	return d.Error
+}
+
+type WithdrawalStatus uint8
+
+const (
+	WITHDRAWAL_PREPARED  WithdrawalStatus = iota // balances deducted and transaction built, not submitted yet
+	WITHDRAWAL_BROADCAST                         // transaction accepted by the daemon
+	WITHDRAWAL_CONFIRMED                         // transaction executed in a block
+	WITHDRAWAL_FAILED                            // transaction never reached the network, balances restored
+)
+
+func (s WithdrawalStatus) String() string {
+	switch s {
+	case WITHDRAWAL_PREPARED:
+		return "prepared"
+	case WITHDRAWAL_BROADCAST:
+		return "broadcast"
+	case WITHDRAWAL_CONFIRMED:
+		return "confirmed"
+	case WITHDRAWAL_FAILED:
+		return "failed"
+	default:
+		return "unknown"
+	}
+}
+
+type WithdrawalDestination struct {
+	Account string // address whose balance has been deducted
+	Address string // destination of the transfer
+	Amount  uint64 // amount transferred
+	Fee     uint64 // withdrawal fee paid by the account
+}
+
+// Withdrawal is an entry of the withdrawal journal
+type Withdrawal struct {
+	Id         uint64
+	Status     WithdrawalStatus
+	Txid       [32]byte
+	TxFee      uint64 // network fee of the transaction
+	TxNonce    uint64 // nonce of the transaction
+	TxHex      string // signed transaction, submitted again if it's dropped
+	Topoheight uint64 // wallet topoheight when the withdrawal was prepared
+	Time       uint64 // UNIX timestamp
+
+	Destinations []WithdrawalDestination
+}
+
+func (x *Withdrawal) Serialize() []byte {
+	s := serializer.Serializer{}
+
+	s.AddUint8(VERSION)
+
+	s.AddUvarint(x.Id)
+	s.AddUint8(uint8(x.Status))
+	s.AddFixedByteArray(x.Txid[:], 32)
+	s.AddUvarint(x.TxFee)
+	s.AddUvarint(x.TxNonce)
+	s.AddString(x.TxHex)
+	s.AddUvarint(x.Topoheight)
+	s.AddUvarint(x.Time)
+
+	s.AddUvarint(uint64(len(x.Destinations)))
+	for _, v := range x.Destinations {
+		s.AddString(v.Account)
+		s.AddString(v.Address)
+		s.AddUvarint(v.Amount)
+		s.AddUvarint(v.Fee)
+	}
+
+	return s.Data
+}
+
+func (x *Withdrawal) Deserialize(data []byte) error {
+	d := serializer.Deserializer{
+		Data: data,
+	}
+
+	d.ReadUint8()
+
+	x.Id = d.ReadUvarint()
+	x.Status = WithdrawalStatus(d.ReadUint8())
+	copy(x.Txid[:], d.ReadFixedByteArray(32))
+	x.TxFee = d.ReadUvarint()
+	x.TxNonce = d.ReadUvarint()
+	x.TxHex = d.ReadString()
+	x.Topoheight = d.ReadUvarint()
+	x.Time = d.ReadUvarint()
+
+	numDests := int(d.ReadUvarint())
+	if d.Error != nil {
+		return d.Error
+	}
+
+	x.Destinations = make([]WithdrawalDestination, 0, min(numDests, 100))
+	for i := 0; i < numDests && d.Error == nil; i++ {
+		x.Destinations = append(x.Destinations, WithdrawalDestination{
+			Account: d.ReadString(),
+			Address: d.ReadString(),
+			Amount:  d.ReadUvarint(),
+			Fee:     d.ReadUvarint(),
+		})
+	}
+
+	return d.Error
+}
+
+// Payout is a withdrawal destination, indexed by the paid address
+type Payout struct {
+	WithdrawalId uint64
+	Address      string // destination of the transfer
+	Amount       uint64
+	Fee          uint64 // withdrawal fee
+	Time         uint64 // UNIX timestamp
+}
+
+// PayoutKey returns the key of a payout: address, a zero byte, then big endian
+// time and withdrawal id
+func PayoutKey(address string, time, withdrawalId uint64) []byte {
+	k := append([]byte(address), 0)
+	k = binary.BigEndian.AppendUint64(k, time)
+	return binary.BigEndian.AppendUint64(k, withdrawalId)
+}
+
+func (x *Payout) Serialize() []byte {
+	s := serializer.Serializer{}
+
+	s.AddUint8(VERSION)
+
+	s.AddUvarint(x.WithdrawalId)
+	s.AddString(x.Address)
+	s.AddUvarint(x.Amount)
+	s.AddUvarint(x.Fee)
+	s.AddUvarint(x.Time)
+
+	return s.Data
+}
+
+func (x *Payout) Deserialize(data []byte) error {
+	d := serializer.Deserializer{
+		Data: data,
+	}
+
+	d.ReadUint8()
+
+	x.WithdrawalId = d.ReadUvarint()
+	x.Address = d.ReadString()
+	x.Amount = d.ReadUvarint()
+	x.Fee = d.ReadUvarint()
+	x.Time = d.ReadUvarint()
+
+	return d.Error
+}
+
+// Adjustment is a manual change of the confirmed balance of an address, made
+// by an operator
+type Adjustment struct {
+	Id           uint64
+	Address      string
+	Amount       uint64
+	Debit        bool   // the amount is removed from the balance
+	BalanceAfter uint64 // confirmed balance after the adjustment
+	Reason       string
+	Admin        string // name of the admin token
+	Time         uint64 // UNIX timestamp
+}
+
+// AdjustmentKey returns the key of an adjustment: address, a zero byte, then
+// big endian id
+func AdjustmentKey(address string, id uint64) []byte {
+	k := append([]byte(address), 0)
+	return binary.BigEndian.AppendUint64(k, id)
+}
+
+func (x *Adjustment) Serialize() []byte {
+	s := serializer.Serializer{}
+
+	s.AddUint8(VERSION)
+
+	s.AddUvarint(x.Id)
+	s.AddString(x.Address)
+	s.AddUvarint(x.Amount)
+	s.AddBool(x.Debit)
+	s.AddUvarint(x.BalanceAfter)
+	s.AddString(x.Reason)
+	s.AddString(x.Admin)
+	s.AddUvarint(x.Time)
+
+	return s.Data
+}
+
+func (x *Adjustment) Deserialize(data []byte) error {
+	d := serializer.Deserializer{
+		Data: data,
+	}
+
+	d.ReadUint8()
+
+	x.Id = d.ReadUvarint()
+	x.Address = d.ReadString()
+	x.Amount = d.ReadUvarint()
+	x.Debit = d.ReadBool()
+	x.BalanceAfter = d.ReadUvarint()
+	x.Reason = d.ReadString()
+	x.Admin = d.ReadString()
+	x.Time = d.ReadUvarint()
+
+	return d.Error
+}
+
+type LedgerKind uint8
+
+const (
+	LEDGER_OPENING        LedgerKind = iota // balances which existed before the ledger
+	LEDGER_BLOCK_CREDIT                     // block found, credited to the pending balances of the miners
+	LEDGER_POOL_FEE                         // pool fee of a found block, credited to the fee address
+	LEDGER_MATURITY                         // block matured, pending balances become confirmed
+	LEDGER_ORPHAN                           // block orphaned, pending balances are reversed
+	LEDGER_PAYOUT                           // confirmed balances sent by a withdrawal
+	LEDGER_PAYOUT_FAILED                    // withdrawal which never reached the network, balances are restored
+	LEDGER_WITHDRAWAL_FEE                   // withdrawal fees, minus the network fee, credited to the fee address
+	LEDGER_ADJUSTMENT                       // manual adjustment by an operator
+	LEDGER_DEPOSIT                          // transfer received from a miner (payout threshold proof)
+	LEDGER_FORFEIT                          // balance of a banned address
+	LEDGER_PPS                              // shares paid by the pool under PPS, credited to the balances of the miners
+)
+
+func (k LedgerKind) String() string {
+	switch k {
+	case LEDGER_OPENING:
+		return "opening"
+	case LEDGER_BLOCK_CREDIT:
+		return "block_credit"
+	case LEDGER_POOL_FEE:
+		return "pool_fee"
+	case LEDGER_MATURITY:
+		return "maturity"
+	case LEDGER_ORPHAN:
+		return "orphan"
+	case LEDGER_PAYOUT:
+		return "payout"
+	case LEDGER_PAYOUT_FAILED:
+		return "payout_failed"
+	case LEDGER_WITHDRAWAL_FEE:
+		return "withdrawal_fee"
+	case LEDGER_ADJUSTMENT:
+		return "adjustment"
+	case LEDGER_DEPOSIT:
+		return "deposit"
+	case LEDGER_FORFEIT:
+		return "forfeit"
+	case LEDGER_PPS:
+		return "pps"
+	default:
+		return "unknown"
+	}
+}
+
+// Posting is a debit or a credit of an account
+type Posting struct {
+	Account string
+	Amount  uint64
+	Debit   bool
+}
+
+// LedgerEntry is a balance movement. The debits and credits of its postings
+// are equal.
+type LedgerEntry struct {
+	Id       uint64
+	Kind     LedgerKind
+	Ref      string // block hash, withdrawal id, transaction hash or adjustment id
+	Time     uint64 // UNIX timestamp
+	Postings []Posting
+}
+
+func (x *LedgerEntry) Serialize() []byte {
+	s := serializer.Serializer{}
+
+	s.AddUint8(VERSION)
+
+	s.AddUvarint(x.Id)
+	s.AddUint8(uint8(x.Kind))
+	s.AddString(x.Ref)
+	s.AddUvarint(x.Time)
+
+	s.AddUvarint(uint64(len(x.Postings)))
+	for _, v := range x.Postings {
+		s.AddString(v.Account)
+		s.AddUvarint(v.Amount)
+		s.AddBool(v.Debit)
+	}
+
+	return s.Data
+}
+
+func (x *LedgerEntry) Deserialize(data []byte) error {
+	d := serializer.Deserializer{
+		Data: data,
+	}
+
+	d.ReadUint8()
+
+	x.Id = d.ReadUvarint()
+	x.Kind = LedgerKind(d.ReadUint8())
+	x.Ref = d.ReadString()
+	x.Time = d.ReadUvarint()
+
+	numPostings := int(d.ReadUvarint())
+	if d.Error != nil {
+		return d.Error
+	}
+
+	x.Postings = make([]Posting, 0, min(numPostings, 100))
+	for i := 0; i < numPostings && d.Error == nil; i++ {
+		x.Postings = append(x.Postings, Posting{
+			Account: d.ReadString(),
+			Amount:  d.ReadUvarint(),
+			Debit:   d.ReadBool(),
+		})
+	}
+
 	return d.Error
 }
 
+// LedgerIndexKey returns the key of an entry in the LEDGER_INDEX bucket:
+// address, a zero byte, then big endian entry id
+func LedgerIndexKey(address string, id uint64) []byte {
+	k := append([]byte(address), 0)
+	return binary.BigEndian.AppendUint64(k, id)
+}
+
+type RevenueKind uint8
+
+const (
+	REVENUE_BLOCK_FEE      RevenueKind = iota // pool fee of a matured block
+	REVENUE_WITHDRAWAL_FEE                    // withdrawal fees paid by the miners
+)
+
+func (k RevenueKind) String() string {
+	switch k {
+	case REVENUE_BLOCK_FEE:
+		return "block_fee"
+	case REVENUE_WITHDRAWAL_FEE:
+		return "withdrawal_fee"
+	default:
+		return "unknown"
+	}
+}
+
+// Revenue is an income of the pool
+type Revenue struct {
+	Id     uint64
+	Kind   RevenueKind
+	Ref    string // block hash or withdrawal id
+	Amount uint64
+	Cost   uint64 // network fee paid by the pool
+	Time   uint64 // UNIX timestamp
+}
+
+func (x *Revenue) Serialize() []byte {
+	s := serializer.Serializer{}
+
+	s.AddUint8(VERSION)
+
+	s.AddUvarint(x.Id)
+	s.AddUint8(uint8(x.Kind))
+	s.AddString(x.Ref)
+	s.AddUvarint(x.Amount)
+	s.AddUvarint(x.Cost)
+	s.AddUvarint(x.Time)
+
+	return s.Data
+}
+
+func (x *Revenue) Deserialize(data []byte) error {
+	d := serializer.Deserializer{
+		Data: data,
+	}
+
+	d.ReadUint8()
+
+	x.Id = d.ReadUvarint()
+	x.Kind = RevenueKind(d.ReadUint8())
+	x.Ref = d.ReadString()
+	x.Amount = d.ReadUvarint()
+	x.Cost = d.ReadUvarint()
+	x.Time = d.ReadUvarint()
+
+	return d.Error
+}
+
+// BlockReward is the amount credited to an address for a matured block
+type BlockReward struct {
+	Hash       [32]byte
+	Height     uint64
+	Address    string
+	Amount     uint64  // amount assigned by the reward scheme
+	Multiplier float64 // multiplier applied when the block matured
+	Credited   uint64  // amount added to the balance
+	Time       uint64  // UNIX timestamp of the credit
+}
+
+// BlockRewardKey returns the key of a reward in the BLOCK_REWARDS bucket
+func BlockRewardKey(hash [32]byte, address string) []byte {
+	return append(hash[:], address...)
+}
+
+// AddressRewardKey returns the key of a reward in the ADDRESS_REWARDS bucket:
+// address, a zero byte, then big endian time and block hash
+func AddressRewardKey(address string, time uint64, hash [32]byte) []byte {
+	k := append([]byte(address), 0)
+	k = binary.BigEndian.AppendUint64(k, time)
+	return append(k, hash[:]...)
+}
+
+func (x *BlockReward) Serialize() []byte {
+	s := serializer.Serializer{}
+
+	s.AddUint8(VERSION)
+
+	s.AddFixedByteArray(x.Hash[:], 32)
+	s.AddUvarint(x.Height)
+	s.AddString(x.Address)
+	s.AddUvarint(x.Amount)
+	s.AddUint64(math.Float64bits(x.Multiplier))
+	s.AddUvarint(x.Credited)
+	s.AddUvarint(x.Time)
+
+	return s.Data
+}
+
+func (x *BlockReward) Deserialize(data []byte) error {
+	d := serializer.Deserializer{
+		Data: data,
+	}
+
+	d.ReadUint8()
+
+	copy(x.Hash[:], d.ReadFixedByteArray(32))
+	x.Height = d.ReadUvarint()
+	x.Address = d.ReadString()
+	x.Amount = d.ReadUvarint()
+	x.Multiplier = math.Float64frombits(d.ReadUint64())
+	x.Credited = d.ReadUvarint()
+	x.Time = d.ReadUvarint()
+
+	return d.Error
+}
+
+// ShareBatchKey returns the key of a share batch received from a slave:
+// big endian slave spool id and batch id
+func ShareBatchKey(spoolId, batchId uint64) []byte {
+	k := binary.BigEndian.AppendUint64(nil, spoolId)
+	return binary.BigEndian.AppendUint64(k, batchId)
+}
+
 /*
 database structure:
 
 addressInfo: address -> address data
 shares: share id -> share data
+foundBy: block hash -> address of the miner who found the block
+blocks: height + block hash -> block data
+withdrawals: withdrawal id -> withdrawal journal entry
+payouts: address + time + withdrawal id -> payout
+block_rewards: block hash + address -> block reward
+address_rewards: address + time + block hash -> block reward
+threshold_requests: address -> threshold request
+share_batches: spool id + batch id -> time received
+bans: IP or IPv6 network -> ban
 */
 
 var (
-	ADDRESS_INFO = []byte("a") // address -> address data
-	SHARES       = []byte("s") // share id -> share data
-	PENDING      = []byte("p") // "pending" -> pending balances
+	ADDRESS_INFO       = []byte("a") // address -> address data
+	SHARES             = []byte("s") // share id -> share data
+	PENDING            = []byte("p") // "pending" -> pending balances
+	FOUND_BY           = []byte("f") // block hash -> finder address
+	SOLO_FOUND         = []byte("y") // block hash -> finder address, blocks found by solo miners not credited yet
+	BLOCKS             = []byte("b") // height + block hash -> block data
+	BLOCK_INDEX        = []byte("h") // block hash -> key of the block in BLOCKS
+	WITHDRAWALS        = []byte("w") // withdrawal id (big endian) -> withdrawal journal entry
+	PAYOUTS            = []byte("o") // address + time + withdrawal id -> payout
+	BLOCK_REWARDS      = []byte("r") // block hash + address -> block reward
+	ADDRESS_REWARDS    = []byte("e") // address + time + block hash -> block reward
+	THRESHOLD_REQUESTS = []byte("t") // address + code -> payout threshold request
+	SHARE_BATCHES      = []byte("d") // spool id + batch id -> time received (used to ignore duplicate batches)
+	BANS               = []byte("i") // IP or IPv6 /64 network -> ban
+	AUDIT_LOG          = []byte("u") // entry id (big endian) -> admin API call
+	ADJUSTMENTS        = []byte("j") // address + adjustment id -> manual balance adjustment (never modified)
+	ADJUSTMENT_INDEX   = []byte("k") // adjustment id (big endian) -> address of the adjustment
+	LEDGER             = []byte("l") // entry id (big endian) -> ledger entry (never modified)
+	LEDGER_INDEX       = []byte("x") // address + entry id -> nothing, ledger entries moving the balances of an address
+	REVENUE            = []byte("v") // revenue id (big endian) -> revenue of the pool
 )
@@ -0,0 +1,420 @@
+// Copyright (C) 2024 XELIS
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+// Package link implements the encrypted connection between master and slaves.
+//
+// Protocol v2:
+//   - both sides send a plaintext hello: magic "XPL", protocol version and a random nonce
+//   - session keys are derived with HKDF from the shared secret and both nonces,
+//     with a different key for each direction
+//   - every frame is a header (uint32 LE ciphertext length, uint64 LE counter)
+//     followed by the ciphertext. The header is authenticated, and the counter
+//     must be exactly the next one, so frames cannot be replayed or reordered.
+//   - the first frame sent by the slave is its identity (Hello)
+//
+// Protocol v1 (legacy) frames are a XChaCha20-Poly1305 encrypted uint16 length
+// followed by the encrypted message, all keyed by the shared secret.
+package link
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+	"xelis-pool/serializer"
+
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/hkdf"
+)
+
+const VERSION = 2
+
+// MAX_FRAME_SIZE is the maximum size of a decrypted message
+const MAX_FRAME_SIZE = 16 * 1024 * 1024
+
+const HANDSHAKE_TIMEOUT = 10 * time.Second
+
+const headerSize = 4 + 8
+
+// overhead of legacy frames: XChaCha20 nonce and Poly1305 tag
+const legacyOverhead = chacha20poly1305.NonceSizeX + chacha20poly1305.Overhead
+
+var magic = []byte("XPL")
+
+var ErrReplay = errors.New("unexpected frame counter")
+var ErrFrameTooBig = errors.New("frame too big")
+
+// Hello is the identity of a slave
+type Hello struct {
+	Name   string
+	Region string
+}
+
+type Conn struct {
+	conn net.Conn
+
+	// legacy is true for protocol v1 connections
+	legacy bool
+	secret [32]byte
+
+	sendAead    cipher.AEAD
+	recvAead    cipher.AEAD
+	sendCounter atomic.Uint64
+	recvCounter atomic.Uint64
+
+	sendMut sync.Mutex
+	recvMut sync.Mutex
+}
+
+// Client performs the handshake as a slave
+func Client(conn net.Conn, secret [32]byte, hello Hello) (*Conn, error) {
+	conn.SetDeadline(time.Now().Add(HANDSHAKE_TIMEOUT))
+	defer conn.SetDeadline(time.Time{})
+
+	clientNonce, err := writeHello(conn)
+	if err != nil {
+		return nil, err
+	}
+	serverNonce, err := readHello(conn)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &Conn{
+		conn: conn,
+	}
+	err = c.deriveKeys(secret, clientNonce, serverNonce, true)
+	if err != nil {
+		return nil, err
+	}
+
+	s := serializer.Serializer{}
+	s.AddString(hello.Name)
+	s.AddString(hello.Region)
+
+	return c, c.Write(s.Data)
+}
+
+// Server performs the handshake as a master and returns the identity of the slave.
+// If allowLegacy is true, protocol v1 slaves are accepted with an empty identity.
+func Server(conn net.Conn, secret [32]byte, allowLegacy bool) (*Conn, Hello, error) {
+	conn.SetDeadline(time.Now().Add(HANDSHAKE_TIMEOUT))
+	defer conn.SetDeadline(time.Time{})
+
+	head := make([]byte, len(magic))
+	_, err := io.ReadFull(conn, head)
+	if err != nil {
+		return nil, Hello{}, err
+	}
+
+	if !bytes.Equal(head, magic) {
+		if !allowLegacy {
+			return nil, Hello{}, errors.New("legacy slave refused, protocol v2 is required")
+		}
+
+		// the bytes already read are part of the first v1 frame
+		return &Conn{
+			conn:   &prefixConn{Conn: conn, prefix: head},
+			legacy: true,
+			secret: secret,
+		}, Hello{}, nil
+	}
+
+	clientNonce, err := readHelloBody(conn)
+	if err != nil {
+		return nil, Hello{}, err
+	}
+	serverNonce, err := writeHello(conn)
+	if err != nil {
+		return nil, Hello{}, err
+	}
+
+	c := &Conn{
+		conn: conn,
+	}
+	err = c.deriveKeys(secret, clientNonce, serverNonce, false)
+	if err != nil {
+		return nil, Hello{}, err
+	}
+
+	msg, err := c.Read()
+	if err != nil {
+		return nil, Hello{}, fmt.Errorf("handshake failed: %w", err)
+	}
+
+	d := serializer.Deserializer{
+		Data: msg,
+	}
+	hello := Hello{
+		Name:   d.ReadString(),
+		Region: d.ReadString(),
+	}
+	if d.Error != nil {
+		return nil, Hello{}, d.Error
+	}
+
+	return c, hello, nil
+}
+
+func writeHello(conn net.Conn) ([]byte, error) {
+	nonce := make([]byte, 32)
+	_, err := rand.Read(nonce)
+	if err != nil {
+		return nil, err
+	}
+
+	data := append(bytes.Clone(magic), VERSION)
+	_, err = conn.Write(append(data, nonce...))
+
+	return nonce, err
+}
+
+func readHello(conn net.Conn) ([]byte, error) {
+	head := make([]byte, len(magic))
+	_, err := io.ReadFull(conn, head)
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(head, magic) {
+		return nil, errors.New("invalid hello")
+	}
+
+	return readHelloBody(conn)
+}
+
+// readHelloBody reads the hello after the magic
+func readHelloBody(conn net.Conn) ([]byte, error) {
+	buf := make([]byte, 1+32)
+	_, err := io.ReadFull(conn, buf)
+	if err != nil {
+		return nil, err
+	}
+
+	if buf[0] != VERSION {
+		return nil, fmt.Errorf("unsupported protocol version %d", buf[0])
+	}
+
+	return buf[1:], nil
+}
+
+func (c *Conn) deriveKeys(secret [32]byte, clientNonce, serverNonce []byte, isClient bool) error {
+	salt := append(bytes.Clone(clientNonce), serverNonce...)
+
+	c2s := make([]byte, chacha20poly1305.KeySize)
+	s2c := make([]byte, chacha20poly1305.KeySize)
+
+	_, err := io.ReadFull(hkdf.New(sha256.New, secret[:], salt, []byte("xelis-pool link v2 slave to master")), c2s)
+	if err != nil {
+		return err
+	}
+	_, err = io.ReadFull(hkdf.New(sha256.New, secret[:], salt, []byte("xelis-pool link v2 master to slave")), s2c)
+	if err != nil {
+		return err
+	}
+
+	if !isClient {
+		c2s, s2c = s2c, c2s
+	}
+
+	c.sendAead, err = chacha20poly1305.New(c2s)
+	if err != nil {
+		return err
+	}
+	c.recvAead, err = chacha20poly1305.New(s2c)
+	return err
+}
+
+func counterNonce(counter uint64) []byte {
+	nonce := make([]byte, chacha20poly1305.NonceSize)
+	binary.LittleEndian.PutUint64(nonce[4:], counter)
+	return nonce
+}
+
+// Write sends a message. It is safe for concurrent use.
+func (c *Conn) Write(msg []byte) error {
+	if len(msg) > MAX_FRAME_SIZE {
+		return ErrFrameTooBig
+	}
+
+	c.sendMut.Lock()
+	defer c.sendMut.Unlock()
+
+	if c.legacy {
+		return c.writeLegacy(msg)
+	}
+
+	frame := make([]byte, headerSize, headerSize+len(msg)+c.sendAead.Overhead())
+	binary.LittleEndian.PutUint32(frame, uint32(len(msg)+c.sendAead.Overhead()))
+	counter := c.sendCounter.Load()
+	binary.LittleEndian.PutUint64(frame[4:], counter)
+
+	frame = c.sendAead.Seal(frame, counterNonce(counter), msg, frame[:headerSize])
+	c.sendCounter.Add(1)
+
+	_, err := c.conn.Write(frame)
+	return err
+}
+
+// Read reads the next message
+func (c *Conn) Read() ([]byte, error) {
+	c.recvMut.Lock()
+	defer c.recvMut.Unlock()
+
+	if c.legacy {
+		return c.readLegacy()
+	}
+
+	header := make([]byte, headerSize)
+	_, err := io.ReadFull(c.conn, header)
+	if err != nil {
+		return nil, err
+	}
+
+	length := binary.LittleEndian.Uint32(header)
+	counter := binary.LittleEndian.Uint64(header[4:])
+
+	if length > MAX_FRAME_SIZE+uint32(c.recvAead.Overhead()) {
+		return nil, ErrFrameTooBig
+	}
+	if counter != c.recvCounter.Load() {
+		return nil, fmt.Errorf("%w: %d, expected %d", ErrReplay, counter, c.recvCounter.Load())
+	}
+
+	ciphertext := make([]byte, length)
+	_, err = io.ReadFull(c.conn, ciphertext)
+	if err != nil {
+		return nil, err
+	}
+
+	msg, err := c.recvAead.Open(ciphertext[:0], counterNonce(counter), ciphertext, header)
+	if err != nil {
+		return nil, err
+	}
+	c.recvCounter.Add(1)
+
+	return msg, nil
+}
+
+// Counters returns the number of messages sent and received
+func (c *Conn) Counters() (sent, received uint64) {
+	return c.sendCounter.Load(), c.recvCounter.Load()
+}
+
+func (c *Conn) Legacy() bool {
+	return c.legacy
+}
+
+func (c *Conn) RemoteAddr() net.Addr {
+	return c.conn.RemoteAddr()
+}
+
+func (c *Conn) Close() error {
+	return c.conn.Close()
+}
+
+func (c *Conn) legacyEncrypt(msg []byte) []byte {
+	aead, err := chacha20poly1305.NewX(c.secret[:])
+	if err != nil {
+		panic(err)
+	}
+
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(msg)+aead.Overhead())
+	rand.Read(nonce)
+
+	return aead.Seal(nonce, nonce, msg, nil)
+}
+
+func (c *Conn) legacyDecrypt(msg []byte) ([]byte, error) {
+	aead, err := chacha20poly1305.NewX(c.secret[:])
+	if err != nil {
+		panic(err)
+	}
+
+	if len(msg) < aead.NonceSize() {
+		return nil, errors.New("ciphertext too short")
+	}
+
+	nonce, ciphertext := msg[:aead.NonceSize()], msg[aead.NonceSize():]
+
+	return aead.Open(nil, nonce, ciphertext, nil)
+}
+
+func (c *Conn) writeLegacy(msg []byte) error {
+	if len(msg) > 0xffff {
+		return ErrFrameTooBig
+	}
+
+	_, err := c.conn.Write(c.legacyEncrypt(binary.LittleEndian.AppendUint16(nil, uint16(len(msg)))))
+	if err != nil {
+		return err
+	}
+
+	_, err = c.conn.Write(c.legacyEncrypt(msg))
+	if err != nil {
+		return err
+	}
+	c.sendCounter.Add(1)
+
+	return nil
+}
+
+func (c *Conn) readLegacy() ([]byte, error) {
+	lenBuf := make([]byte, 2+legacyOverhead)
+	_, err := io.ReadFull(c.conn, lenBuf)
+	if err != nil {
+		return nil, err
+	}
+	lenBuf, err = c.legacyDecrypt(lenBuf)
+	if err != nil {
+		return nil, err
+	}
+
+	buf := make([]byte, int(binary.LittleEndian.Uint16(lenBuf))+legacyOverhead)
+	_, err = io.ReadFull(c.conn, buf)
+	if err != nil {
+		return nil, err
+	}
+
+	msg, err := c.legacyDecrypt(buf)
+	if err != nil {
+		return nil, err
+	}
+	c.recvCounter.Add(1)
+
+	return msg, nil
+}
+
+// prefixConn is a net.Conn that returns prefix before reading from the connection
+type prefixConn struct {
+	net.Conn
+	prefix []byte
+}
+
+func (p *prefixConn) Read(b []byte) (int, error) {
+	if len(p.prefix) > 0 {
+		n := copy(b, p.prefix)
+		p.prefix = p.prefix[n:]
+		return n, nil
+	}
+	return p.Conn.Read(b)
+}
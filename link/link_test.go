@@ -0,0 +1,173 @@
+// Copyright (C) 2024 XELIS
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package link
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"testing"
+)
+
+var testSecret = [32]byte{1, 2, 3}
+
+type result struct {
+	conn  *Conn
+	hello Hello
+	err   error
+}
+
+func handshake(t *testing.T, clientSecret, serverSecret [32]byte) (*Conn, *Conn, Hello, error) {
+	c1, c2 := net.Pipe()
+	t.Cleanup(func() {
+		c1.Close()
+		c2.Close()
+	})
+
+	ch := make(chan result)
+	go func() {
+		conn, hello, err := Server(c2, serverSecret, false)
+		if err != nil {
+			c2.Close()
+		}
+		ch <- result{conn, hello, err}
+	}()
+
+	client, err := Client(c1, clientSecret, Hello{Name: "eu-1", Region: "eu"})
+	if err != nil {
+		c1.Close()
+	}
+	res := <-ch
+	if err == nil {
+		err = res.err
+	}
+
+	return client, res.conn, res.hello, err
+}
+
+func TestHandshake(t *testing.T) {
+	client, server, hello, err := handshake(t, testSecret, testSecret)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if hello.Name != "eu-1" || hello.Region != "eu" {
+		t.Fatalf("unexpected hello %+v", hello)
+	}
+
+	big := bytes.Repeat([]byte{0xab}, 100_000) // bigger than v1 frames
+	go client.Write(big)
+
+	msg, err := server.Read()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(msg, big) {
+		t.Fatal("message does not match")
+	}
+
+	go server.Write([]byte("pong"))
+
+	msg, err = client.Read()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(msg) != "pong" {
+		t.Fatalf("unexpected message %q", msg)
+	}
+
+	if sent, received := client.Counters(); sent != 2 || received != 1 {
+		t.Fatalf("unexpected client counters %d %d", sent, received)
+	}
+}
+
+func TestWrongSecret(t *testing.T) {
+	_, _, _, err := handshake(t, testSecret, [32]byte{4, 5, 6})
+	if err == nil {
+		t.Fatal("handshake with a wrong secret succeeded")
+	}
+}
+
+func TestReplay(t *testing.T) {
+	client, server, _, err := handshake(t, testSecret, testSecret)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// capture a frame sent by the client
+	raw, rawClient := net.Pipe()
+	defer raw.Close()
+	client.conn = rawClient
+
+	go client.Write([]byte("share"))
+
+	header := make([]byte, headerSize)
+	if _, err := io.ReadFull(raw, header); err != nil {
+		t.Fatal(err)
+	}
+	frame := make([]byte, binary.LittleEndian.Uint32(header))
+	if _, err := io.ReadFull(raw, frame); err != nil {
+		t.Fatal(err)
+	}
+	frame = append(header, frame...)
+
+	// deliver it twice
+	server.conn = &prefixConn{Conn: server.conn, prefix: append(bytes.Clone(frame), frame...)}
+
+	msg, err := server.Read()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(msg) != "share" {
+		t.Fatalf("unexpected message %q", msg)
+	}
+
+	_, err = server.Read()
+	if !errors.Is(err, ErrReplay) {
+		t.Fatalf("expected replay error, got %v", err)
+	}
+}
+
+func TestLegacy(t *testing.T) {
+	c1, c2 := net.Pipe()
+	defer c1.Close()
+	defer c2.Close()
+
+	legacy := &Conn{
+		conn:   c1,
+		legacy: true,
+		secret: testSecret,
+	}
+	go legacy.Write([]byte("hello"))
+
+	server, _, err := Server(c2, testSecret, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !server.Legacy() {
+		t.Fatal("expected a legacy connection")
+	}
+
+	msg, err := server.Read()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(msg) != "hello" {
+		t.Fatalf("unexpected message %q", msg)
+	}
+}
@@ -0,0 +1,197 @@
+// Copyright (C) 2024 XELIS
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+// Package login parses the logins sent by the miners, in the form
+// address[.worker][+diff][#options] (or address[+diff][.worker][#options]).
+// Options are separated by commas, for example "#solo,d=50000,email=a@b.c".
+package login
+
+import (
+	"math"
+	"net/mail"
+	"strconv"
+	"strings"
+)
+
+const MAX_WORKER_LENGTH = 32
+const MAX_EMAIL_LENGTH = 254
+
+// Login is the parsed login of a miner
+type Login struct {
+	Wallet string
+	Worker string
+
+	Diff      uint64  // fixed difficulty, within the bounds of the Parser. 0 if not set.
+	Solo      bool    // mine solo
+	Email     string  // contact address of the miner
+	Threshold float64 // requested payout threshold in coins, 0 if not set
+}
+
+type ErrorKind uint8
+
+const (
+	ERR_ADDRESS ErrorKind = iota + 1
+	ERR_DIFF
+	ERR_OPTION
+)
+
+// Error is returned when a login is not valid. Each protocol reports it in its
+// own format.
+type Error struct {
+	Kind  ErrorKind
+	Value string // the invalid part of the login
+}
+
+func (e *Error) Error() string {
+	switch e.Kind {
+	case ERR_ADDRESS:
+		return "invalid wallet address"
+	case ERR_DIFF:
+		return "invalid difficulty " + strconv.Quote(e.Value)
+	default:
+		return "invalid login option " + strconv.Quote(e.Value)
+	}
+}
+
+type Parser struct {
+	IsAddressValid func(addr string) bool
+
+	// bounds of the fixed difficulty
+	MinDiff uint64
+	MaxDiff uint64
+}
+
+// Parse parses a login and the optional password. The password contains options
+// separated by commas; unlike in the login, unknown options are ignored, as most
+// miners send a placeholder password such as "x".
+func (p Parser) Parse(user, password string) (Login, error) {
+	user, opts, hasOpts := strings.Cut(user, "#")
+
+	wallet, diffStr, _ := strings.Cut(user, "+")
+	wallet, worker, _ := strings.Cut(wallet, ".")
+
+	if d, w, ok := strings.Cut(diffStr, "."); ok {
+		diffStr = d
+		worker = w
+	}
+
+	l := Login{
+		Wallet: wallet,
+		Worker: CleanWorkerName(worker),
+	}
+
+	if !p.IsAddressValid(wallet) {
+		return l, &Error{Kind: ERR_ADDRESS, Value: wallet}
+	}
+
+	if diffStr != "" {
+		err := p.setDiff(&l, diffStr)
+		if err != nil {
+			return l, err
+		}
+	}
+
+	if password != "" {
+		err := p.parseOptions(&l, password, false)
+		if err != nil {
+			return l, err
+		}
+	}
+	if hasOpts {
+		err := p.parseOptions(&l, opts, true)
+		if err != nil {
+			return l, err
+		}
+	}
+
+	return l, nil
+}
+
+func (p Parser) parseOptions(l *Login, opts string, strict bool) error {
+	for _, opt := range strings.FieldsFunc(opts, func(r rune) bool {
+		return r == ',' || r == ';' || r == '&'
+	}) {
+		key, value, hasValue := strings.Cut(strings.TrimSpace(opt), "=")
+
+		switch strings.ToLower(key) {
+		case "solo":
+			if hasValue {
+				solo, err := strconv.ParseBool(value)
+				if err != nil {
+					return &Error{Kind: ERR_OPTION, Value: opt}
+				}
+				l.Solo = solo
+			} else {
+				l.Solo = true
+			}
+		case "d", "diff":
+			err := p.setDiff(l, value)
+			if err != nil {
+				return err
+			}
+		case "email":
+			addr, err := mail.ParseAddress(value)
+			if err != nil || len(value) > MAX_EMAIL_LENGTH || addr.Address != value {
+				return &Error{Kind: ERR_OPTION, Value: opt}
+			}
+			l.Email = value
+		case "t", "threshold":
+			threshold, err := strconv.ParseFloat(value, 64)
+			if err != nil || math.IsNaN(threshold) || math.IsInf(threshold, 0) || threshold <= 0 {
+				return &Error{Kind: ERR_OPTION, Value: opt}
+			}
+			l.Threshold = threshold
+		default:
+			if strict {
+				return &Error{Kind: ERR_OPTION, Value: opt}
+			}
+		}
+	}
+
+	return nil
+}
+
+func (p Parser) setDiff(l *Login, diffStr string) error {
+	diff, err := strconv.ParseUint(diffStr, 10, 64)
+	if err != nil || diff == 0 {
+		return &Error{Kind: ERR_DIFF, Value: diffStr}
+	}
+
+	l.Diff = max(diff, p.MinDiff)
+	if p.MaxDiff != 0 {
+		l.Diff = min(l.Diff, p.MaxDiff)
+	}
+	return nil
+}
+
+// CleanWorkerName removes the unsupported characters from a worker name, and
+// returns the default worker name "x" if it's empty
+func CleanWorkerName(worker string) string {
+	worker = strings.Map(func(r rune) rune {
+		if (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') || r == '-' || r == '_' {
+			return r
+		}
+		return -1
+	}, worker)
+
+	if len(worker) > MAX_WORKER_LENGTH {
+		worker = worker[:MAX_WORKER_LENGTH]
+	}
+	if worker == "" {
+		return "x"
+	}
+
+	return worker
+}
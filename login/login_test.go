@@ -0,0 +1,92 @@
+// Copyright (C) 2024 XELIS
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package login
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+var testParser = Parser{
+	IsAddressValid: func(addr string) bool {
+		return strings.HasPrefix(addr, "xel:")
+	},
+	MinDiff: 1000,
+	MaxDiff: 1_000_000,
+}
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		user, pass string
+		expected   Login
+	}{
+		{"xel:abc", "", Login{Wallet: "xel:abc", Worker: "x"}},
+		{"xel:abc.rig1", "x", Login{Wallet: "xel:abc", Worker: "rig1"}},
+		{"xel:abc.rig1+5000", "", Login{Wallet: "xel:abc", Worker: "rig1", Diff: 5000}},
+		{"xel:abc+5000.rig1", "", Login{Wallet: "xel:abc", Worker: "rig1", Diff: 5000}},
+		{"xel:abc+1", "", Login{Wallet: "xel:abc", Worker: "x", Diff: 1000}},
+		{"xel:abc+9999999999", "", Login{Wallet: "xel:abc", Worker: "x", Diff: 1_000_000}},
+		{"xel:abc.r!g#solo", "", Login{Wallet: "xel:abc", Worker: "rg", Solo: true}},
+		{"xel:abc#d=2000,email=me@example.com,t=1.5", "", Login{
+			Wallet: "xel:abc", Worker: "x", Diff: 2000, Email: "me@example.com", Threshold: 1.5,
+		}},
+		{"xel:abc+5000", "d=3000;solo=false;password", Login{Wallet: "xel:abc", Worker: "x", Diff: 3000}},
+		{"xel:abc#solo=0", "solo", Login{Wallet: "xel:abc", Worker: "x"}},
+	}
+
+	for _, test := range tests {
+		l, err := testParser.Parse(test.user, test.pass)
+		if err != nil {
+			t.Errorf("Parse(%q, %q): %v", test.user, test.pass, err)
+			continue
+		}
+		if l != test.expected {
+			t.Errorf("Parse(%q, %q) = %+v, expected %+v", test.user, test.pass, l, test.expected)
+		}
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	tests := []struct {
+		user, pass string
+		kind       ErrorKind
+	}{
+		{"abc.rig1", "", ERR_ADDRESS},
+		{"xel:abc+big", "", ERR_DIFF},
+		{"xel:abc+0", "", ERR_DIFF},
+		{"xel:abc", "d=-5", ERR_DIFF},
+		{"xel:abc#unknown", "", ERR_OPTION},
+		{"xel:abc#email=nope", "", ERR_OPTION},
+		{"xel:abc", "t=0", ERR_OPTION},
+		{"xel:abc#t=NaN", "", ERR_OPTION},
+		{"xel:abc#t=Inf", "", ERR_OPTION},
+		{"xel:abc", "solo=maybe", ERR_OPTION},
+	}
+
+	for _, test := range tests {
+		_, err := testParser.Parse(test.user, test.pass)
+
+		var lerr *Error
+		if !errors.As(err, &lerr) {
+			t.Errorf("Parse(%q, %q): expected a login error, got %v", test.user, test.pass, err)
+			continue
+		}
+		if lerr.Kind != test.kind {
+			t.Errorf("Parse(%q, %q): error kind %d, expected %d", test.user, test.pass, lerr.Kind, test.kind)
+		}
+	}
+}
@@ -0,0 +1,344 @@
+// Copyright (C) 2024 XELIS
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+// Package metrics implements counters, gauges and histograms exported in the
+// Prometheus text exposition format.
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"xelis-pool/log"
+)
+
+// default histogram buckets for latencies, in seconds
+var LatencyBuckets = []float64{0.0005, 0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5}
+
+type metric interface {
+	write(w io.Writer)
+}
+
+var registry []metric
+var scrapeHooks []func()
+var regMut sync.Mutex
+
+func register(m metric) {
+	regMut.Lock()
+	defer regMut.Unlock()
+
+	registry = append(registry, m)
+}
+
+// OnScrape adds a function called before the metrics are written, used to
+// update the gauges which are expensive to keep up to date
+func OnScrape(f func()) {
+	regMut.Lock()
+	defer regMut.Unlock()
+
+	scrapeHooks = append(scrapeHooks, f)
+}
+
+// series is a set of metric values, one for each combination of labels
+type series[T any] struct {
+	name   string
+	help   string
+	typ    string
+	labels []string
+
+	values map[string]*T
+	keys   map[string][]string // key -> label values
+
+	sync.Mutex
+}
+
+func newSeries[T any](name, help, typ string, labels []string) *series[T] {
+	return &series[T]{
+		name:   name,
+		help:   help,
+		typ:    typ,
+		labels: labels,
+		values: make(map[string]*T),
+		keys:   make(map[string][]string),
+	}
+}
+
+// get returns the value for the label values. Series must be locked.
+func (s *series[T]) get(labelValues []string) *T {
+	if len(labelValues) != len(s.labels) {
+		panic(fmt.Errorf("metric %s has %d labels, got %d", s.name, len(s.labels), len(labelValues)))
+	}
+
+	key := strings.Join(labelValues, "\xff")
+	v := s.values[key]
+	if v == nil {
+		v = new(T)
+		s.values[key] = v
+		s.keys[key] = slices.Clone(labelValues)
+	}
+	return v
+}
+
+// sorted calls f for every value, sorted by labels. Series must be locked.
+func (s *series[T]) sorted(f func(labelValues []string, v *T)) {
+	keys := make([]string, 0, len(s.values))
+	for k := range s.values {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys)
+
+	for _, k := range keys {
+		f(s.keys[k], s.values[k])
+	}
+}
+
+func (s *series[T]) writeHeader(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", s.name, s.help, s.name, s.typ)
+}
+
+func formatLabels(names, values []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+
+	var b strings.Builder
+	b.WriteByte('{')
+	for i, v := range names {
+		if i != 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(v)
+		b.WriteString(`="`)
+		b.WriteString(escapeLabel(values[i]))
+		b.WriteByte('"')
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapeLabel(s string) string {
+	return labelEscaper.Replace(s)
+}
+
+func formatFloat(f float64) string {
+	switch {
+	case math.IsInf(f, 1):
+		return "+Inf"
+	case math.IsInf(f, -1):
+		return "-Inf"
+	case math.IsNaN(f):
+		return "NaN"
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+// Counter is a value that only increases
+type Counter struct {
+	s *series[float64]
+}
+
+func NewCounter(name, help string, labels ...string) *Counter {
+	c := &Counter{
+		s: newSeries[float64](name, help, "counter", labels),
+	}
+	register(c)
+	return c
+}
+
+func (c *Counter) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+func (c *Counter) Add(v float64, labelValues ...string) {
+	c.s.Lock()
+	defer c.s.Unlock()
+
+	*c.s.get(labelValues) += v
+}
+
+func (c *Counter) write(w io.Writer) {
+	c.s.Lock()
+	defer c.s.Unlock()
+
+	c.s.writeHeader(w)
+	c.s.sorted(func(labelValues []string, v *float64) {
+		fmt.Fprintf(w, "%s%s %s\n", c.s.name, formatLabels(c.s.labels, labelValues), formatFloat(*v))
+	})
+}
+
+// Gauge is a value that can go up and down
+type Gauge struct {
+	s *series[float64]
+}
+
+func NewGauge(name, help string, labels ...string) *Gauge {
+	g := &Gauge{
+		s: newSeries[float64](name, help, "gauge", labels),
+	}
+	register(g)
+	return g
+}
+
+func (g *Gauge) Set(v float64, labelValues ...string) {
+	g.s.Lock()
+	defer g.s.Unlock()
+
+	*g.s.get(labelValues) = v
+}
+
+func (g *Gauge) Add(v float64, labelValues ...string) {
+	g.s.Lock()
+	defer g.s.Unlock()
+
+	*g.s.get(labelValues) += v
+}
+
+// Reset removes all the values, so label combinations which don't exist anymore
+// are not exported
+func (g *Gauge) Reset() {
+	g.s.Lock()
+	defer g.s.Unlock()
+
+	clear(g.s.values)
+	clear(g.s.keys)
+}
+
+func (g *Gauge) write(w io.Writer) {
+	g.s.Lock()
+	defer g.s.Unlock()
+
+	g.s.writeHeader(w)
+	g.s.sorted(func(labelValues []string, v *float64) {
+		fmt.Fprintf(w, "%s%s %s\n", g.s.name, formatLabels(g.s.labels, labelValues), formatFloat(*v))
+	})
+}
+
+type histogramValue struct {
+	counts []uint64 // not cumulative
+	sum    float64
+	count  uint64
+}
+
+// Histogram counts observations in buckets
+type Histogram struct {
+	s       *series[histogramValue]
+	buckets []float64
+}
+
+func NewHistogram(name, help string, buckets []float64, labels ...string) *Histogram {
+	h := &Histogram{
+		s:       newSeries[histogramValue](name, help, "histogram", labels),
+		buckets: slices.Sorted(slices.Values(buckets)),
+	}
+	register(h)
+	return h
+}
+
+func (h *Histogram) Observe(v float64, labelValues ...string) {
+	h.s.Lock()
+	defer h.s.Unlock()
+
+	hv := h.s.get(labelValues)
+	if hv.counts == nil {
+		hv.counts = make([]uint64, len(h.buckets))
+	}
+
+	i, _ := slices.BinarySearch(h.buckets, v)
+	if i < len(h.buckets) {
+		hv.counts[i]++
+	}
+	hv.sum += v
+	hv.count++
+}
+
+// ObserveDuration observes the time elapsed since start, in seconds
+func (h *Histogram) ObserveDuration(start time.Time, labelValues ...string) {
+	h.Observe(time.Since(start).Seconds(), labelValues...)
+}
+
+func (h *Histogram) write(w io.Writer) {
+	h.s.Lock()
+	defer h.s.Unlock()
+
+	h.s.writeHeader(w)
+	h.s.sorted(func(labelValues []string, v *histogramValue) {
+		names := append(slices.Clone(h.s.labels), "le")
+
+		var cumulative uint64
+		for i, b := range h.buckets {
+			cumulative += v.counts[i]
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.s.name,
+				formatLabels(names, append(slices.Clone(labelValues), formatFloat(b))), cumulative)
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.s.name,
+			formatLabels(names, append(slices.Clone(labelValues), "+Inf")), v.count)
+
+		labels := formatLabels(h.s.labels, labelValues)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.s.name, labels, formatFloat(v.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.s.name, labels, v.count)
+	})
+}
+
+// Write runs the scrape hooks and writes all the metrics
+func Write(w io.Writer) {
+	regMut.Lock()
+	hooks := slices.Clone(scrapeHooks)
+	metrics := slices.Clone(registry)
+	regMut.Unlock()
+
+	for _, f := range hooks {
+		f()
+	}
+
+	for _, m := range metrics {
+		m.write(w)
+	}
+}
+
+func Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+
+		bw := bufio.NewWriter(w)
+		Write(bw)
+		bw.Flush()
+	})
+}
+
+// Serve exposes the metrics at http://addr/metrics. It does nothing if addr is empty.
+func Serve(addr string) {
+	if addr == "" {
+		return
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", Handler())
+
+	log.Info("serving metrics on", addr)
+
+	err := http.ListenAndServe(addr, mux)
+	if err != nil {
+		log.Err("metrics server:", err)
+	}
+}
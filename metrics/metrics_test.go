@@ -0,0 +1,60 @@
+// Copyright (C) 2024 XELIS
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package metrics
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestExposition(t *testing.T) {
+	shares := NewCounter("test_shares_total", "Shares.", "protocol", "result")
+	shares.Inc("stratum", "accepted")
+	shares.Inc("stratum", "accepted")
+	shares.Inc("xatum", `in"valid`)
+
+	hr := NewGauge("test_hashrate", "Hashrate.")
+	OnScrape(func() {
+		hr.Set(1.5)
+	})
+
+	lat := NewHistogram("test_latency_seconds", "Latency.", []float64{0.1, 1})
+	lat.Observe(0.05)
+	lat.Observe(0.1)
+	lat.Observe(5)
+
+	var b strings.Builder
+	Write(&b)
+
+	expected := `# HELP test_shares_total Shares.
+# TYPE test_shares_total counter
+test_shares_total{protocol="stratum",result="accepted"} 2
+test_shares_total{protocol="xatum",result="in\"valid"} 1
+# HELP test_hashrate Hashrate.
+# TYPE test_hashrate gauge
+test_hashrate 1.5
+# HELP test_latency_seconds Latency.
+# TYPE test_latency_seconds histogram
+test_latency_seconds_bucket{le="0.1"} 2
+test_latency_seconds_bucket{le="1"} 2
+test_latency_seconds_bucket{le="+Inf"} 3
+test_latency_seconds_sum 5.15
+test_latency_seconds_count 3
+`
+	if b.String() != expected {
+		t.Fatalf("unexpected output:\n%s", b.String())
+	}
+}
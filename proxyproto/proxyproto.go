@@ -0,0 +1,280 @@
+// Copyright (C) 2024 XELIS
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+// Package proxyproto parses the HAProxy PROXY protocol (v1 and v2) headers, so
+// the real IP of clients behind a TCP load balancer is known.
+package proxyproto
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+	"xelis-pool/log"
+)
+
+// the load balancer must send the header within this time
+const HEADER_TIMEOUT = 5 * time.Second
+
+// maximum length of a v1 header, including CRLF
+const maxV1Length = 107
+
+var v1Prefix = []byte("PROXY ")
+var v2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+var ErrInvalidHeader = errors.New("invalid PROXY protocol header")
+
+// Listener is a net.Listener whose connections start with a PROXY protocol
+// header. The header is required, and RemoteAddr of the connections is the
+// address of the client.
+type Listener struct {
+	net.Listener
+
+	conns  chan net.Conn
+	err    chan error
+	closed chan struct{}
+}
+
+// NewListener wraps l. Headers are read in the background, so slow clients
+// don't block Accept.
+func NewListener(l net.Listener) *Listener {
+	pl := &Listener{
+		Listener: l,
+		conns:    make(chan net.Conn),
+		err:      make(chan error, 1),
+		closed:   make(chan struct{}),
+	}
+
+	go pl.acceptLoop()
+
+	return pl
+}
+
+// Listen listens for TCP connections on addr, which use the PROXY protocol if
+// enabled is true
+func Listen(addr string, enabled bool) (net.Listener, error) {
+	l, err := net.Listen("tcp", addr)
+	if err != nil || !enabled {
+		return l, err
+	}
+	return NewListener(l), nil
+}
+
+func (l *Listener) acceptLoop() {
+	for {
+		c, err := l.Listener.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				l.err <- err
+				close(l.closed)
+				return
+			}
+			log.Warn("PROXY protocol listener:", err)
+			continue
+		}
+
+		go func() {
+			pc, err := readHeader(c)
+			if err != nil {
+				log.Warn("connection from", c.RemoteAddr(), "sent an invalid PROXY protocol header:", err)
+				c.Close()
+				return
+			}
+			select {
+			case l.conns <- pc:
+			case <-l.closed:
+				pc.Close()
+			}
+		}()
+	}
+}
+
+func (l *Listener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.conns:
+		return c, nil
+	case err := <-l.err:
+		// make the next calls fail too
+		l.err <- err
+		return nil, err
+	}
+}
+
+// Conn is a connection whose remote address comes from the PROXY header
+type Conn struct {
+	net.Conn
+
+	remote net.Addr
+}
+
+func (c *Conn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+// ProxyAddr returns the address of the load balancer
+func (c *Conn) ProxyAddr() net.Addr {
+	return c.Conn.RemoteAddr()
+}
+
+// readHeader reads the PROXY header of the connection, without reading any
+// data after it
+func readHeader(c net.Conn) (*Conn, error) {
+	c.SetReadDeadline(time.Now().Add(HEADER_TIMEOUT))
+	defer c.SetReadDeadline(time.Time{})
+
+	remote, err := ReadHeader(c)
+	if err != nil {
+		return nil, err
+	}
+	if remote == nil {
+		// LOCAL command or unknown protocol: the connection isn't proxied
+		remote = c.RemoteAddr()
+	}
+
+	return &Conn{
+		Conn:   c,
+		remote: remote,
+	}, nil
+}
+
+// ReadHeader reads a v1 or v2 header from r, and returns the source address.
+// The address is nil if the header doesn't contain one.
+func ReadHeader(r io.Reader) (net.Addr, error) {
+	// both versions are longer than 8 bytes
+	start := make([]byte, 8)
+	_, err := io.ReadFull(r, start)
+	if err != nil {
+		return nil, err
+	}
+
+	if bytes.HasPrefix(start, v1Prefix) {
+		return readV1(r, start)
+	}
+	if bytes.Equal(start, v2Signature[:8]) {
+		return readV2(r)
+	}
+
+	return nil, ErrInvalidHeader
+}
+
+func readV1(r io.Reader, start []byte) (net.Addr, error) {
+	line := start
+	b := make([]byte, 1)
+
+	// read byte by byte, to not consume the data after the header
+	for !bytes.HasSuffix(line, []byte("\r\n")) {
+		if len(line) >= maxV1Length {
+			return nil, ErrInvalidHeader
+		}
+
+		_, err := io.ReadFull(r, b)
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, b[0])
+	}
+
+	// PROXY TCP4 <src ip> <dst ip> <src port> <dst port>
+	fields := strings.Split(strings.TrimSuffix(string(line), "\r\n"), " ")
+	if len(fields) < 2 {
+		return nil, ErrInvalidHeader
+	}
+
+	switch fields[1] {
+	case "UNKNOWN":
+		return nil, nil
+	case "TCP4", "TCP6":
+	default:
+		return nil, fmt.Errorf("%w: unknown protocol %q", ErrInvalidHeader, fields[1])
+	}
+
+	if len(fields) != 6 {
+		return nil, ErrInvalidHeader
+	}
+
+	ip := net.ParseIP(fields[2])
+	if ip == nil {
+		return nil, fmt.Errorf("%w: invalid source address %q", ErrInvalidHeader, fields[2])
+	}
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("%w: invalid source port %q", ErrInvalidHeader, fields[4])
+	}
+
+	return &net.TCPAddr{
+		IP:   ip,
+		Port: int(port),
+	}, nil
+}
+
+func readV2(r io.Reader) (net.Addr, error) {
+	// rest of the signature, version and command, family, length
+	header := make([]byte, 8)
+	_, err := io.ReadFull(r, header)
+	if err != nil {
+		return nil, err
+	}
+
+	if !bytes.Equal(header[:4], v2Signature[8:]) {
+		return nil, ErrInvalidHeader
+	}
+	if header[4]>>4 != 2 {
+		return nil, fmt.Errorf("%w: unsupported version %d", ErrInvalidHeader, header[4]>>4)
+	}
+
+	command := header[4] & 0x0f
+	family := header[5]
+
+	body := make([]byte, binary.BigEndian.Uint16(header[6:]))
+	_, err = io.ReadFull(r, body)
+	if err != nil {
+		return nil, err
+	}
+
+	switch command {
+	case 0x0: // LOCAL
+		return nil, nil
+	case 0x1: // PROXY
+	default:
+		return nil, fmt.Errorf("%w: unknown command %d", ErrInvalidHeader, command)
+	}
+
+	switch family {
+	case 0x11, 0x12: // TCP or UDP over IPv4
+		if len(body) < 12 {
+			return nil, ErrInvalidHeader
+		}
+		return &net.TCPAddr{
+			IP:   net.IP(bytes.Clone(body[0:4])),
+			Port: int(binary.BigEndian.Uint16(body[8:])),
+		}, nil
+	case 0x21, 0x22: // TCP or UDP over IPv6
+		if len(body) < 36 {
+			return nil, ErrInvalidHeader
+		}
+		return &net.TCPAddr{
+			IP:   net.IP(bytes.Clone(body[0:16])),
+			Port: int(binary.BigEndian.Uint16(body[32:])),
+		}, nil
+	default:
+		// unspecified or unix sockets
+		return nil, nil
+	}
+}
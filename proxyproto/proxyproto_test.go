@@ -0,0 +1,119 @@
+// Copyright (C) 2024 XELIS
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package proxyproto
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+)
+
+func v2Header(family byte, body []byte) []byte {
+	h := append(bytes.Clone(v2Signature), 0x21, family)
+	h = binary.BigEndian.AppendUint16(h, uint16(len(body)))
+	return append(h, body...)
+}
+
+func TestReadHeader(t *testing.T) {
+	v6Body := make([]byte, 36)
+	copy(v6Body, net.ParseIP("2001:db8::1"))
+	binary.BigEndian.PutUint16(v6Body[32:], 4321)
+
+	tests := []struct {
+		name   string
+		header []byte
+		addr   string // empty if no address
+	}{
+		{"v1 tcp4", []byte("PROXY TCP4 1.2.3.4 10.0.0.1 5555 9351\r\n"), "1.2.3.4:5555"},
+		{"v1 tcp6", []byte("PROXY TCP6 2001:db8::1 ::1 5555 9351\r\n"), "[2001:db8::1]:5555"},
+		{"v1 unknown", []byte("PROXY UNKNOWN\r\n"), ""},
+		{"v2 ipv4", v2Header(0x11, []byte{1, 2, 3, 4, 10, 0, 0, 1, 0x15, 0xb3, 0x24, 0x87}), "1.2.3.4:5555"},
+		{"v2 ipv6", v2Header(0x21, v6Body), "[2001:db8::1]:4321"},
+	}
+
+	for _, test := range tests {
+		r := bytes.NewReader(append(test.header, "payload"...))
+
+		addr, err := ReadHeader(r)
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+
+		if test.addr == "" {
+			if addr != nil {
+				t.Fatalf("%s: expected no address, got %v", test.name, addr)
+			}
+		} else if addr == nil || addr.String() != test.addr {
+			t.Fatalf("%s: expected address %s, got %v", test.name, test.addr, addr)
+		}
+
+		// the data after the header must not be consumed
+		rest, _ := io.ReadAll(r)
+		if string(rest) != "payload" {
+			t.Fatalf("%s: unexpected data after header %q", test.name, rest)
+		}
+	}
+}
+
+func TestInvalidHeader(t *testing.T) {
+	for _, header := range []string{
+		`{"id":1,"method":"mining.subscribe"}`,
+		"PROXY TCP4 1.2.3.4\r\n",
+		"PROXY TCP4 notanip 10.0.0.1 5555 9351\r\n",
+		"PROXY " + string(bytes.Repeat([]byte("a"), 200)),
+	} {
+		_, err := ReadHeader(bytes.NewReader([]byte(header)))
+		if err == nil {
+			t.Fatalf("header %q was accepted", header)
+		}
+	}
+}
+
+func TestListener(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pl := NewListener(l)
+	defer pl.Close()
+
+	go func() {
+		c, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		c.Write([]byte("PROXY TCP6 2001:db8::1 ::1 5555 9351\r\nhello"))
+		io.ReadAll(c)
+	}()
+
+	c, err := pl.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	if c.RemoteAddr().String() != "[2001:db8::1]:5555" {
+		t.Fatalf("unexpected remote address %s", c.RemoteAddr())
+	}
+
+	buf := make([]byte, 5)
+	if _, err := io.ReadFull(c, buf); err != nil || string(buf) != "hello" {
+		t.Fatalf("unexpected data %q, error %v", buf, err)
+	}
+}
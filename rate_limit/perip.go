@@ -26,6 +26,8 @@ var connsMut sync.RWMutex
 // returns true and increases IP connections by 1 if the miner can connect,
 // otherwise returns false and does not increase number of connections
 func CanConnect(ip string) bool {
+	ip = Key(ip)
+
 	connsMut.Lock()
 	defer connsMut.Unlock()
 
@@ -37,6 +39,8 @@ func CanConnect(ip string) bool {
 	return true
 }
 func Disconnect(ip string) {
+	ip = Key(ip)
+
 	connsMut.Lock()
 	defer connsMut.Unlock()
 
@@ -16,9 +16,12 @@
 package rate_limit
 
 import (
+	"net/netip"
 	"sync"
 	"time"
 	"xelis-pool/log"
+	"xelis-pool/metrics"
+	"xelis-pool/util"
 )
 
 // max score of 2000 per minute
@@ -28,12 +31,16 @@ consumption:
 connect: 50 (20 per minute)
 share submit: 25 (40 per minute)
 invalid share PoW: 200 (5 per minute)
+threshold request: 400 (2 per minute)
+failed admin authentication: 200 (5 per minute)
 */
 
 const (
 	ACTION_CONNECT           = 10
 	ACTION_SHARE_SUBMIT      = 1
 	ACTION_INVALID_SHARE_POW = 200
+	ACTION_THRESHOLD_REQUEST = 400
+	ACTION_FAILED_ADMIN_AUTH = 200
 )
 
 const MAX_SCORE = 2000
@@ -45,6 +52,12 @@ var rlMut sync.RWMutex
 var rate_limiters = make(map[string]rate_limiter, 500)
 var bans = make(map[string]ban, 10)
 
+var bansMetric = metrics.NewCounter("xelis_slave_bans_total", "Number of IPs banned by the rate limiter.", "reason")
+
+// OnBan is called when the rate limiter bans an IP, to share the ban with the
+// other slaves
+var OnBan func(ip string, ends int64)
+
 type rate_limiter struct {
 	Score uint32
 }
@@ -52,16 +65,59 @@ type ban struct {
 	Ends int64
 }
 
+// Key returns the key used to rate limit an address: the IP for IPv4, and the
+// /64 network for IPv6, as a single host usually gets a whole /64
+func Key(addr string) string {
+	ip, err := netip.ParseAddr(util.RemovePort(addr))
+	if err != nil {
+		return addr
+	}
+	ip = ip.Unmap().WithZone("")
+
+	if ip.Is4() {
+		return ip.String()
+	}
+
+	prefix, err := ip.Prefix(64)
+	if err != nil {
+		return ip.String()
+	}
+	return prefix.String()
+}
+
+// Ban bans an inactive IP on this slave only
 func Ban(ip string, ends int64) {
+	ip = Key(ip)
+
+	rlMut.Lock()
+	defer rlMut.Unlock()
+
+	if bans[ip].Ends < ends {
+		bans[ip] = ban{
+			Ends: ends,
+		}
+	}
+	bansMetric.Inc("inactive")
+}
+
+// ApplyBan applies a ban received from another slave
+func ApplyBan(ip string, ends int64) {
+	ip = Key(ip)
+
 	rlMut.Lock()
 	defer rlMut.Unlock()
 
-	bans[ip] = ban{
-		Ends: time.Now().Unix() + BAN_DURATION,
+	if bans[ip].Ends < ends {
+		bans[ip] = ban{
+			Ends: ends,
+		}
+		bansMetric.Inc("remote")
 	}
 }
 
 func CanDoAction(ip string, requiredScore uint32) bool {
+	ip = Key(ip)
+
 	rlMut.Lock()
 	defer rlMut.Unlock()
 
@@ -81,7 +137,11 @@ func CanDoAction(ip string, requiredScore uint32) bool {
 		bans[ip] = ban{
 			Ends: t + BAN_DURATION,
 		}
-		//go slave.SendBan(ip, t+BAN_DURATION)
+		bansMetric.Inc("rate_limit")
+
+		if OnBan != nil {
+			go OnBan(ip, t+BAN_DURATION)
+		}
 		return false
 	}
 
@@ -0,0 +1,36 @@
+// Copyright (C) 2024 XELIS
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package rate_limit
+
+import "testing"
+
+func TestKey(t *testing.T) {
+	tests := map[string]string{
+		"1.2.3.4":                     "1.2.3.4",
+		"1.2.3.4:5555":                "1.2.3.4",
+		"[::ffff:1.2.3.4]:5555":       "1.2.3.4",
+		"2001:db8:1:2:3:4:5:6":        "2001:db8:1:2::/64",
+		"[2001:db8:1:2:aaaa::1]:5555": "2001:db8:1:2::/64",
+		"[fe80::1%eth0]:5555":         "fe80::/64",
+		"not an ip":                   "not an ip",
+	}
+
+	for addr, expected := range tests {
+		if k := Key(addr); k != expected {
+			t.Errorf("Key(%q) = %q, expected %q", addr, k, expected)
+		}
+	}
+}
@@ -16,79 +16,73 @@
 package slave
 
 import (
-	"crypto/rand"
-	"encoding/binary"
-	"io"
+	"fmt"
 	"net"
 	"sync"
 	"time"
 	"xelis-pool/cfg"
+	"xelis-pool/link"
 	"xelis-pool/log"
+	"xelis-pool/rate_limit"
 	"xelis-pool/serializer"
-
-	"golang.org/x/crypto/chacha20poly1305"
 )
 
-var conn net.Conn
+var conn *link.Conn
 var connMut sync.RWMutex
 
-const Overhead = 40
-
 var OnBan func(ip string, ends int64)
 
 func StartSlaveClient() {
-out:
+	err := openSpool()
+	if err != nil {
+		log.Fatal(fmt.Errorf("failed to open share spool: %w", err))
+	}
+	go flushLoop()
+
 	for {
 		log.Info("Connecting to master server:", cfg.Cfg.Slave.MasterAddress)
 
-		var err error
-		conn, err = net.Dial("tcp", cfg.Cfg.Slave.MasterAddress)
-
+		c, err := net.Dial("tcp", cfg.Cfg.Slave.MasterAddress)
 		if err != nil {
 			log.Err(err)
 			time.Sleep(time.Second)
-			continue out
+			continue
 		}
 
+		lc, err := link.Client(c, cfg.MasterPass, link.Hello{
+			Name:   cfg.Cfg.Slave.Name,
+			Region: cfg.Cfg.Slave.Region,
+		})
+		if err != nil {
+			log.Err("master handshake failed:", err)
+			c.Close()
+			time.Sleep(time.Second)
+			continue
+		}
+
+		// batches sent to the previous connection may have been lost
+		resetSentBatches()
+
+		connMut.Lock()
+		conn = lc
+		connMut.Unlock()
+
 		for {
-			lenBuf := make([]byte, 2+Overhead)
-			_, err := io.ReadFull(conn, lenBuf)
+			buf, err := lc.Read()
 			if err != nil {
 				log.Warn(err)
-				conn.Close()
-				time.Sleep(time.Second)
-				continue out
-			}
-			lenBuf, err = Decrypt(lenBuf)
-			if err != nil {
-				log.Warn(err)
-				conn.Close()
-				time.Sleep(time.Second)
-				continue out
-			}
-			len := int(lenBuf[0]) | (int(lenBuf[1]) << 8)
+				lc.Close()
 
-			// read the actual message
+				connMut.Lock()
+				conn = nil
+				connMut.Unlock()
 
-			buf := make([]byte, len+Overhead)
-			_, err = io.ReadFull(conn, buf)
-			if err != nil {
-				log.Warn(err)
-				conn.Close()
-				time.Sleep(time.Second)
-				continue out
-			}
-			buf, err = Decrypt(buf)
-			if err != nil {
-				log.Warn(err)
-				conn.Close()
 				time.Sleep(time.Second)
-				continue out
+				break
 			}
 			log.Netf("Received message: %x", buf)
 			OnMessage(buf)
 		}
-
 	}
 }
 
@@ -110,28 +104,41 @@ func OnMessage(b []byte) {
 		}
 		log.Infof("received ban from master, ip: %s ends: %d", ip, banEnds)
 
-		// OnBan(ip, int64(banEnds))
+		rate_limit.ApplyBan(ip, int64(banEnds))
+	case 1: // BatchAckM2S
+		ackSpoolId := d.ReadUint64()
+		batchId := d.ReadUvarint()
+
+		if d.Error != nil {
+			log.Warn(d.Error)
+			return
+		}
+		log.Debug("share batch", batchId, "acknowledged")
+
+		onBatchAck(ackSpoolId, batchId)
 	}
 }
 
-func SendShare(wallet string, diff uint64) {
-	connMut.Lock()
-	defer connMut.Unlock()
-
-	cacheShare(wallet, diff)
+func SendShare(wallet, worker string, diff uint64, solo bool) {
+	cacheShare(wallet, worker, diff, solo)
 }
 
-func SendBlockFound(hash [32]byte) {
+func SendBlockFound(hash [32]byte, wallet string, solo bool) {
 	s := serializer.Serializer{
 		Data: []byte{1},
 	}
 
 	s.AddFixedByteArray(hash[:], 32)
+	s.AddString(wallet)
+	s.AddBool(solo)
 
 	// wait 5 seconds to avoid sending "block found" before the daemon knows it
 	go func() {
 		time.Sleep(5 * time.Second)
+
+		connMut.RLock()
 		sendToConn(s.Data)
+		connMut.RUnlock()
 	}()
 }
 func SendStats(nrMiners, nrGetworkMiners int) {
@@ -140,7 +147,9 @@ func SendStats(nrMiners, nrGetworkMiners int) {
 	}
 	s.AddUvarint(uint64(nrMiners) + uint64(nrGetworkMiners))
 
+	connMut.RLock()
 	sendToConn(s.Data)
+	connMut.RUnlock()
 }
 func SendBan(ip string, ends int64) {
 	s := serializer.Serializer{
@@ -150,51 +159,22 @@ func SendBan(ip string, ends int64) {
 	s.AddString(ip)
 	s.AddUint64(uint64(ends))
 
+	connMut.RLock()
 	sendToConn(s.Data)
+	connMut.RUnlock()
 }
 
-func sendToConn(data []byte) {
+// sendToConn returns false if the message could not be sent. connMut must be locked.
+func sendToConn(data []byte) bool {
 	if conn == nil {
 		log.Err("SendToConn: Connection is nil")
-		return
+		return false
 	}
-	var dataLenBin = make([]byte, 0, 2)
-	dataLenBin = binary.LittleEndian.AppendUint16(dataLenBin, uint16(len(data)))
-	conn.Write(Encrypt(dataLenBin))
-	conn.Write(Encrypt(data))
-}
 
-func Encrypt(msg []byte) []byte {
-	aead, err := chacha20poly1305.NewX(cfg.MasterPass[:])
+	err := conn.Write(data)
 	if err != nil {
-		panic(err)
+		log.Warn("SendToConn:", err)
+		return false
 	}
-
-	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(msg)+aead.Overhead())
-	rand.Read(nonce)
-
-	// Encrypt the message and append the ciphertext to the nonce.
-	return aead.Seal(nonce, nonce, msg, nil)
-}
-
-func Decrypt(msg []byte) ([]byte, error) {
-	aead, err := chacha20poly1305.NewX(cfg.MasterPass[:])
-	if err != nil {
-		panic(err)
-	}
-
-	if len(msg) < aead.NonceSize() {
-		panic("ciphertext too short")
-	}
-
-	// Split nonce and ciphertext.
-	nonce, ciphertext := msg[:aead.NonceSize()], msg[aead.NonceSize():]
-
-	// Decrypt the message and check it wasn't tampered with.
-	decrypted, err := aead.Open(nil, nonce, ciphertext, nil)
-	if err != nil {
-		return []byte{}, err
-	}
-
-	return decrypted, nil
+	return true
 }
@@ -19,7 +19,6 @@ import (
 	"sync"
 	"time"
 	"xelis-pool/log"
-	"xelis-pool/serializer"
 )
 
 type ShareCache struct {
@@ -27,57 +26,90 @@ type ShareCache struct {
 	TotalDiff uint64
 }
 
+type ShareKey struct {
+	Wallet string
+	Worker string
+	Solo   bool
+}
+
 type Cache struct {
-	Shares map[string]ShareCache
+	Shares map[ShareKey]ShareCache
 
 	sync.RWMutex
 }
 
 var slaveCache = Cache{
-	Shares: map[string]ShareCache{},
+	Shares: map[ShareKey]ShareCache{},
 }
 
-func cacheShare(wallet string, diff uint64) {
+func cacheShare(wallet, worker string, diff uint64, solo bool) {
 	slaveCache.Lock()
 	defer slaveCache.Unlock()
 
-	x := slaveCache.Shares[wallet]
+	k := ShareKey{
+		Wallet: wallet,
+		Worker: worker,
+		Solo:   solo,
+	}
+
+	x := slaveCache.Shares[k]
 
 	x.NumShares++
 	x.TotalDiff += diff
 
-	slaveCache.Shares[wallet] = x
+	slaveCache.Shares[k] = x
 }
 
-func init() {
-	go func() {
-		for {
-			time.Sleep(5 * time.Second)
-
-			connMut.Lock()
-			if conn != nil {
-				slaveCache.Lock()
-				length := len(slaveCache.Shares)
-				for i, v := range slaveCache.Shares {
-					log.Debug("sending cache share with address:", i, "count", v.NumShares, "total diff", v.TotalDiff)
-					sendCachedShare(v.NumShares, i, v.TotalDiff)
-				}
-				slaveCache.Shares = make(map[string]ShareCache, length+10)
-				slaveCache.Unlock()
-			}
-			connMut.Unlock()
-		}
-	}()
+// takeCachedShares returns the cached shares and empties the cache
+func takeCachedShares() map[ShareKey]ShareCache {
+	slaveCache.Lock()
+	defer slaveCache.Unlock()
+
+	shares := slaveCache.Shares
+	slaveCache.Shares = make(map[ShareKey]ShareCache, len(shares)+10)
+
+	return shares
 }
 
-func sendCachedShare(count uint32, wallet string, diff uint64) {
-	s := serializer.Serializer{
-		Data: []byte{0},
+// restoreCachedShares adds back shares taken from the cache
+func restoreCachedShares(shares map[ShareKey]ShareCache) {
+	slaveCache.Lock()
+	defer slaveCache.Unlock()
+
+	for k, v := range shares {
+		x := slaveCache.Shares[k]
+
+		x.NumShares += v.NumShares
+		x.TotalDiff += v.TotalDiff
+
+		slaveCache.Shares[k] = x
 	}
+}
+
+// flushLoop moves the cached shares to the spool every 5 seconds, and sends
+// the batches that haven't been acknowledged yet
+func flushLoop() {
+	for {
+		time.Sleep(5 * time.Second)
 
-	s.AddUvarint(uint64(count))
-	s.AddString(wallet)
-	s.AddUvarint(diff)
+		shares := takeCachedShares()
+		if len(shares) != 0 {
+			for i, v := range shares {
+				log.Debug("spooling cached share with address:", i.Wallet, "worker", i.Worker, "solo", i.Solo, "count", v.NumShares, "total diff", v.TotalDiff)
+			}
 
-	sendToConn(s.Data)
+			err := spoolBatch(shares)
+			if err != nil {
+				// the spool is broken, don't lose the shares
+				log.Err("failed to spool shares:", err)
+				restoreCachedShares(shares)
+			}
+		}
+
+		connMut.RLock()
+		if conn != nil {
+			sendSpooledBatches()
+		}
+		connMut.RUnlock()
+	}
 }
@@ -0,0 +1,194 @@
+// Copyright (C) 2024 XELIS
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package slave
+
+import (
+	"encoding/binary"
+	"sync"
+	"time"
+	"xelis-pool/log"
+	"xelis-pool/serializer"
+	"xelis-pool/util"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// Shares are sent to the master in batches. Each batch is stored in the spool
+// until the master acknowledges it, so shares are not lost if the master is
+// unreachable. Batches are identified by the spool id (random, generated once)
+// and an increasing batch id, which the master uses to ignore duplicates.
+
+const SPOOL_FILE = "spool.db"
+
+// an unacknowledged batch is sent again after this time
+const BATCH_RESEND_INTERVAL = 30 * time.Second
+
+// maximum number of batches sent every flush, to avoid flooding the master
+// after a long outage
+const MAX_BATCHES_PER_FLUSH = 100
+
+var (
+	SPOOL_BATCHES = []byte("b") // batch id (big endian) -> share batch packet
+	SPOOL_META    = []byte("m") // "id" -> spool id
+)
+
+var spool *bolt.DB
+var spoolId uint64
+
+// sentBatches contains the time each batch has been sent at
+var sentBatches = make(map[uint64]time.Time)
+var sentMut sync.Mutex
+
+func openSpool() error {
+	var err error
+	spool, err = bolt.Open(SPOOL_FILE, 0o600, bolt.DefaultOptions)
+	if err != nil {
+		return err
+	}
+
+	return spool.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(SPOOL_BATCHES)
+		if err != nil {
+			return err
+		}
+		meta, err := tx.CreateBucketIfNotExists(SPOOL_META)
+		if err != nil {
+			return err
+		}
+
+		if id := meta.Get([]byte("id")); id != nil {
+			spoolId = binary.LittleEndian.Uint64(id)
+		} else {
+			spoolId = util.RandomUint64()
+			err = meta.Put([]byte("id"), util.Itob(spoolId))
+			if err != nil {
+				return err
+			}
+		}
+
+		log.Infof("share spool %x opened, %d batches waiting", spoolId, tx.Bucket(SPOOL_BATCHES).Stats().KeyN)
+
+		return nil
+	})
+}
+
+// spoolBatch stores the shares as a new batch
+func spoolBatch(shares map[ShareKey]ShareCache) error {
+	return spool.Update(func(tx *bolt.Tx) error {
+		buck := tx.Bucket(SPOOL_BATCHES)
+
+		batchId, err := buck.NextSequence()
+		if err != nil {
+			return err
+		}
+
+		s := serializer.Serializer{
+			Data: []byte{5},
+		}
+
+		s.AddUint64(spoolId)
+		s.AddUvarint(batchId)
+		s.AddUvarint(util.Time())
+		// solo shares are sent after the pool shares, so that older masters ignore them
+		var numSolo int
+		for k := range shares {
+			if k.Solo {
+				numSolo++
+			}
+		}
+
+		s.AddUvarint(uint64(len(shares) - numSolo))
+		addBatchShares(&s, shares, false)
+		s.AddUvarint(uint64(numSolo))
+		addBatchShares(&s, shares, true)
+
+		return buck.Put(binary.BigEndian.AppendUint64(nil, batchId), s.Data)
+	})
+}
+
+func addBatchShares(s *serializer.Serializer, shares map[ShareKey]ShareCache, solo bool) {
+	for k, v := range shares {
+		if k.Solo != solo {
+			continue
+		}
+		s.AddString(k.Wallet)
+		s.AddString(k.Worker)
+		s.AddUvarint(uint64(v.NumShares))
+		s.AddUvarint(v.TotalDiff)
+	}
+}
+
+// sendSpooledBatches sends the batches that haven't been acknowledged, from
+// the oldest. connMut must be locked.
+func sendSpooledBatches() {
+	var toSend [][]byte
+	var ids []uint64
+
+	sentMut.Lock()
+	spool.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(SPOOL_BATCHES).Cursor()
+
+		for k, v := c.First(); k != nil && len(toSend) < MAX_BATCHES_PER_FLUSH; k, v = c.Next() {
+			id := binary.BigEndian.Uint64(k)
+
+			if sent, ok := sentBatches[id]; ok && time.Since(sent) < BATCH_RESEND_INTERVAL {
+				continue
+			}
+			sentBatches[id] = time.Now()
+
+			toSend = append(toSend, append([]byte{}, v...))
+			ids = append(ids, id)
+		}
+		return nil
+	})
+	sentMut.Unlock()
+
+	// sentMut isn't locked while sending, as acks are received meanwhile
+	for i, v := range toSend {
+		log.Debug("sending share batch", ids[i])
+		if !sendToConn(v) {
+			resetSentBatches()
+			return
+		}
+	}
+}
+
+// onBatchAck removes an acknowledged batch from the spool
+func onBatchAck(ackSpoolId, batchId uint64) {
+	if ackSpoolId != spoolId {
+		log.Warnf("received ack for unknown spool %x", ackSpoolId)
+		return
+	}
+
+	sentMut.Lock()
+	delete(sentBatches, batchId)
+	sentMut.Unlock()
+
+	err := spool.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(SPOOL_BATCHES).Delete(binary.BigEndian.AppendUint64(nil, batchId))
+	})
+	if err != nil {
+		log.Err("failed to remove batch from spool:", err)
+	}
+}
+
+// resetSentBatches makes all the unacknowledged batches be sent again, in order
+func resetSentBatches() {
+	sentMut.Lock()
+	defer sentMut.Unlock()
+
+	clear(sentBatches)
+}
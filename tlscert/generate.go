@@ -13,7 +13,7 @@
 // You should have received a copy of the GNU Affero General Public License
 // along with this program.  If not, see <https://www.gnu.org/licenses/>.
 
-package server
+package tlscert
 
 import (
 	"crypto/ed25519"
@@ -26,7 +26,8 @@ import (
 	"time"
 )
 
-func GenCertificate() ([]byte, []byte, error) {
+// GenCertificate generates a self-signed certificate and writes it to certFile and keyFile
+func GenCertificate(certFile, keyFile string) ([]byte, []byte, error) {
 	pubkey, key, err := ed25519.GenerateKey(rand.Reader)
 	if err != nil {
 		return []byte{}, []byte{}, err
@@ -68,9 +69,9 @@ func GenCertificate() ([]byte, []byte, error) {
 			Bytes: derBytes,
 		},
 	)
-	err = os.WriteFile("key.pem", keyPem, 0o600)
+	err = os.WriteFile(keyFile, keyPem, 0o600)
 	if err != nil {
 		return []byte{}, []byte{}, err
 	}
-	return certPem, keyPem, os.WriteFile("cert.pem", certPem, 0o600)
+	return certPem, keyPem, os.WriteFile(certFile, certPem, 0o600)
 }
@@ -0,0 +1,146 @@
+// Copyright (C) 2024 XELIS
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+// Package tlscert provides the TLS certificate used by the miner servers, and
+// reloads it when the certificate files change.
+package tlscert
+
+import (
+	"crypto/tls"
+	"os"
+	"sync/atomic"
+	"time"
+	"xelis-pool/log"
+)
+
+// default certificate files, a self-signed certificate is generated if they don't exist
+const (
+	DEFAULT_CERT_FILE = "cert.pem"
+	DEFAULT_KEY_FILE  = "key.pem"
+)
+
+// the certificate files are checked for changes at this interval
+const RELOAD_INTERVAL = 30 * time.Second
+
+type Store struct {
+	certFile string
+	keyFile  string
+
+	cert    atomic.Pointer[tls.Certificate]
+	modTime time.Time
+}
+
+// Load loads the certificate and starts watching the files for changes. If
+// certFile and keyFile are empty, the default files are used, and a
+// self-signed certificate is generated if they are not valid.
+func Load(certFile, keyFile string) (*Store, error) {
+	s := &Store{
+		certFile: certFile,
+		keyFile:  keyFile,
+	}
+
+	if certFile == "" && keyFile == "" {
+		s.certFile = DEFAULT_CERT_FILE
+		s.keyFile = DEFAULT_KEY_FILE
+
+		_, err := tls.LoadX509KeyPair(s.certFile, s.keyFile)
+		if err != nil {
+			log.Err("Invalid TLS certificate:", err, "generating a new one")
+
+			_, _, err := GenCertificate(s.certFile, s.keyFile)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	err := s.reload()
+	if err != nil {
+		return nil, err
+	}
+
+	go s.watch()
+
+	return s, nil
+}
+
+// lastModified returns the last modification time of the certificate files
+func (s *Store) lastModified() (time.Time, error) {
+	var latest time.Time
+	for _, v := range []string{s.certFile, s.keyFile} {
+		info, err := os.Stat(v)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+func (s *Store) reload() error {
+	modTime, err := s.lastModified()
+	if err != nil {
+		return err
+	}
+
+	cert, err := tls.LoadX509KeyPair(s.certFile, s.keyFile)
+	if err != nil {
+		return err
+	}
+
+	s.cert.Store(&cert)
+	s.modTime = modTime
+
+	return nil
+}
+
+// watch reloads the certificate when the files are modified, for example
+// after a renewal. The previous certificate is kept if the new one is invalid.
+func (s *Store) watch() {
+	for {
+		time.Sleep(RELOAD_INTERVAL)
+
+		modTime, err := s.lastModified()
+		if err != nil {
+			log.Warn("TLS certificate:", err)
+			continue
+		}
+		if modTime.Equal(s.modTime) {
+			continue
+		}
+
+		err = s.reload()
+		if err != nil {
+			// files may be partially written, try again later
+			log.Warn("failed to reload TLS certificate:", err)
+			continue
+		}
+
+		log.Info("TLS certificate", s.certFile, "reloaded")
+	}
+}
+
+func (s *Store) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return s.cert.Load(), nil
+}
+
+// Config returns a TLS config which always uses the latest certificate
+func (s *Store) Config() *tls.Config {
+	return &tls.Config{
+		GetCertificate: s.GetCertificate,
+	}
+}
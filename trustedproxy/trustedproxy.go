@@ -0,0 +1,298 @@
+// Copyright (C) 2024 XELIS
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+// Package trustedproxy keeps the list of the reverse proxies (for example a
+// CDN) allowed to set the client IP of HTTP requests.
+package trustedproxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/netip"
+	"os"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"time"
+	"xelis-pool/log"
+	"xelis-pool/util"
+)
+
+// headers containing the client IP, in order of priority
+var ClientIPHeaders = []string{"X-Forwarded-For", "X-Real-IP", "True-Client-IP"}
+
+// localhost is always trusted
+var loopback = []netip.Prefix{
+	netip.MustParsePrefix("127.0.0.0/8"),
+	netip.MustParsePrefix("::1/128"),
+}
+
+const FETCH_TIMEOUT = 30 * time.Second
+
+// delay before retrying a failed refresh, doubled after each failure up to the
+// refresh interval
+const RETRY_DELAY = time.Minute
+
+// maximum size of a list downloaded from a URL
+const MAX_LIST_SIZE = 1024 * 1024
+
+type List struct {
+	static  []netip.Prefix
+	file    string
+	urls    []string
+	refresh time.Duration
+
+	prefixes atomic.Pointer[[]netip.Prefix]
+}
+
+// New returns the list of the static ranges and of the ranges cached in file.
+// If urls are given, they are downloaded in the background every refresh
+// interval, and the last list downloaded successfully is saved to file.
+func New(static []string, file string, urls []string, refresh time.Duration) (*List, error) {
+	l := &List{
+		file:    file,
+		urls:    urls,
+		refresh: refresh,
+	}
+
+	var err error
+	l.static, err = ParsePrefixes(static)
+	if err != nil {
+		return nil, err
+	}
+	l.static = append(l.static, loopback...)
+
+	var cached []netip.Prefix
+	if file != "" {
+		data, err := os.ReadFile(file)
+		if err == nil {
+			cached, err = ParsePrefixes(splitLines(string(data)))
+		}
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			log.Warn("failed to read trusted proxies file:", err)
+		}
+	}
+	l.set(cached)
+
+	if len(urls) != 0 {
+		go l.refreshLoop()
+	}
+
+	return l, nil
+}
+
+func (l *List) set(dynamic []netip.Prefix) {
+	prefixes := append(slices.Clone(l.static), dynamic...)
+	l.prefixes.Store(&prefixes)
+}
+
+func (l *List) refreshLoop() {
+	failures := 0
+	for {
+		prefixes, err := l.fetch()
+		if err != nil {
+			// keep the last good list
+			failures++
+			delay := retryDelay(failures, l.refresh)
+			log.Warn("failed to refresh trusted proxies:", err, "- retrying in", delay)
+
+			time.Sleep(delay)
+			continue
+		}
+		failures = 0
+
+		l.set(prefixes)
+		log.Info("trusted proxies refreshed,", len(prefixes), "ranges")
+
+		if l.file != "" {
+			err = l.save(prefixes)
+			if err != nil {
+				log.Warn("failed to save trusted proxies:", err)
+			}
+		}
+
+		time.Sleep(l.refresh)
+	}
+}
+
+// retryDelay returns the delay before the next refresh after the given number
+// of consecutive failures
+func retryDelay(failures int, refresh time.Duration) time.Duration {
+	delay := RETRY_DELAY
+	for i := 1; i < failures && delay < refresh; i++ {
+		delay *= 2
+	}
+	return min(delay, refresh)
+}
+
+// fetch downloads the ranges from all the URLs. It fails if any of them fails,
+// so a partial list never replaces a complete one.
+func (l *List) fetch() ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+
+	for _, url := range l.urls {
+		p, err := fetchUrl(url)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", url, err)
+		}
+		if len(p) == 0 {
+			return nil, fmt.Errorf("%s: empty list", url)
+		}
+
+		prefixes = append(prefixes, p...)
+	}
+
+	return prefixes, nil
+}
+
+func fetchUrl(url string) ([]netip.Prefix, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), FETCH_TIMEOUT)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("status %s", resp.Status)
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, MAX_LIST_SIZE))
+	if err != nil {
+		return nil, err
+	}
+
+	return ParsePrefixes(splitLines(string(body)))
+}
+
+func (l *List) save(prefixes []netip.Prefix) error {
+	var b strings.Builder
+	for _, v := range prefixes {
+		b.WriteString(v.String())
+		b.WriteByte('\n')
+	}
+
+	// write to a temporary file first, to never leave a truncated cache
+	tmp := l.file + ".tmp"
+	err := os.WriteFile(tmp, []byte(b.String()), 0o644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, l.file)
+}
+
+// Contains returns true if ip is a trusted proxy
+func (l *List) Contains(ip netip.Addr) bool {
+	ip = ip.Unmap()
+	for _, v := range *l.prefixes.Load() {
+		if v.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// ClientIP returns the IP of the client of a request. The headers are only
+// used if the request comes from a trusted proxy.
+func (l *List) ClientIP(r *http.Request) string {
+	remote, err := netip.ParseAddr(util.RemovePort(r.RemoteAddr))
+	if err != nil {
+		return util.RemovePort(r.RemoteAddr)
+	}
+	remote = remote.Unmap()
+
+	if !l.Contains(remote) {
+		return remote.String()
+	}
+
+	for _, header := range ClientIPHeaders {
+		values := r.Header.Values(header)
+		if len(values) == 0 {
+			continue
+		}
+
+		// X-Forwarded-For: client, proxy1, proxy2. Each proxy appends the IP
+		// it received the request from, so the client is the last untrusted one.
+		client, ok := l.lastUntrusted(strings.Split(strings.Join(values, ","), ","))
+		if ok {
+			return client.String()
+		}
+	}
+
+	return remote.String()
+}
+
+// lastUntrusted returns the last IP of the list which isn't a trusted proxy, or
+// the first one if they are all trusted. It fails if an IP is invalid.
+func (l *List) lastUntrusted(ips []string) (netip.Addr, bool) {
+	var client netip.Addr
+	for i := len(ips) - 1; i >= 0; i-- {
+		ip, err := netip.ParseAddr(strings.TrimSpace(ips[i]))
+		if err != nil {
+			return netip.Addr{}, false
+		}
+		client = ip.Unmap()
+		if !l.Contains(client) {
+			break
+		}
+	}
+	return client, client.IsValid()
+}
+
+// ParsePrefixes parses a list of CIDRs or IPs. Empty lines and comments
+// starting with # are ignored.
+func ParsePrefixes(list []string) ([]netip.Prefix, error) {
+	prefixes := make([]netip.Prefix, 0, len(list))
+
+	for _, v := range list {
+		v, _, _ = strings.Cut(v, "#")
+		v = strings.TrimSpace(v)
+		if v == "" {
+			continue
+		}
+
+		if !strings.Contains(v, "/") {
+			ip, err := netip.ParseAddr(v)
+			if err != nil {
+				return nil, err
+			}
+			ip = ip.Unmap()
+			prefixes = append(prefixes, netip.PrefixFrom(ip, ip.BitLen()))
+			continue
+		}
+
+		prefix, err := netip.ParsePrefix(v)
+		if err != nil {
+			return nil, err
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+
+	return prefixes, nil
+}
+
+func splitLines(s string) []string {
+	return strings.Split(strings.ReplaceAll(s, "\r", ""), "\n")
+}
@@ -0,0 +1,128 @@
+// Copyright (C) 2024 XELIS
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package trustedproxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestClientIP(t *testing.T) {
+	l, err := New([]string{"10.0.0.0/8", "2001:db8:cafe::/48"}, "", nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		remote string
+		xff    string
+		ip     string
+	}{
+		{"1.2.3.4:5555", "9.9.9.9", "1.2.3.4"}, // untrusted remote, header ignored
+		{"10.1.2.3:5555", "", "10.1.2.3"},
+		{"10.1.2.3:5555", "9.9.9.9", "9.9.9.9"},
+		{"10.1.2.3:5555", "6.6.6.6, 9.9.9.9, 10.0.0.2", "9.9.9.9"}, // spoofed first value
+		{"[2001:db8:cafe::1]:5555", "2a01:4f8::1", "2a01:4f8::1"},
+		{"[::1]:5555", "invalid", "::1"},
+	}
+
+	for _, test := range tests {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.RemoteAddr = test.remote
+		if test.xff != "" {
+			r.Header.Set("X-Forwarded-For", test.xff)
+		}
+
+		if ip := l.ClientIP(r); ip != test.ip {
+			t.Errorf("remote %s, X-Forwarded-For %q: got %s, expected %s", test.remote, test.xff, ip, test.ip)
+		}
+	}
+}
+
+func TestRefresh(t *testing.T) {
+	var fail atomic.Bool
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if fail.Load() {
+			w.WriteHeader(500)
+			return
+		}
+		w.Write([]byte("173.245.48.0/20\r\n2400:cb00::/32\n"))
+	}))
+	defer srv.Close()
+
+	file := filepath.Join(t.TempDir(), "proxies.txt")
+
+	l, err := New(nil, file, []string{srv.URL}, 10*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cf := netip.MustParseAddr("2400:cb00::1")
+
+	deadline := time.Now().Add(5 * time.Second)
+	for !l.Contains(cf) {
+		if time.Now().After(deadline) {
+			t.Fatal("list was not refreshed")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	// the last good list is kept
+	fail.Store(true)
+	time.Sleep(50 * time.Millisecond)
+	if !l.Contains(cf) {
+		t.Fatal("list was lost after a failed refresh")
+	}
+
+	// and loaded from the cache file
+	if _, err := os.Stat(file); err != nil {
+		t.Fatal(err)
+	}
+	cached, err := New(nil, file, nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !cached.Contains(netip.MustParseAddr("173.245.48.1")) {
+		t.Fatal("cached list was not loaded")
+	}
+}
+
+func TestRetryDelay(t *testing.T) {
+	tests := []struct {
+		failures int
+		refresh  time.Duration
+		expected time.Duration
+	}{
+		{1, 24 * time.Hour, time.Minute},
+		{2, 24 * time.Hour, 2 * time.Minute},
+		{5, 24 * time.Hour, 16 * time.Minute},
+		{20, 24 * time.Hour, 24 * time.Hour},
+		{1000, 24 * time.Hour, 24 * time.Hour},
+		{1, 10 * time.Second, 10 * time.Second},
+	}
+
+	for _, test := range tests {
+		if d := retryDelay(test.failures, test.refresh); d != test.expected {
+			t.Errorf("retryDelay(%d, %s) = %s, expected %s", test.failures, test.refresh, d, test.expected)
+		}
+	}
+}
@@ -19,13 +19,21 @@ import (
 	"crypto/rand"
 	"encoding/binary"
 	"encoding/json"
+	"net"
 	"strconv"
 	"strings"
 	"time"
 )
 
+// RemovePort returns the host of an address with or without port, including
+// IPv6 addresses ("[::1]:1234" and "::1" both return "::1")
 func RemovePort(s string) string {
-	return strings.Split(s, ":")[0]
+	host, _, err := net.SplitHostPort(s)
+	if err != nil {
+		// there is no port
+		return strings.Trim(s, "[]")
+	}
+	return host
 }
 
 func RandomUint64() uint64 {
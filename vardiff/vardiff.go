@@ -0,0 +1,216 @@
+// Copyright (C) 2024 XELIS
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+// Package vardiff adjusts the share difficulty of a miner so that it finds a
+// share every target time
+package vardiff
+
+import (
+	"time"
+)
+
+// maximum factor the difficulty changes by in a single retarget
+const MAX_STEP = 4
+
+// VarDiff computes the share difficulty of a connection. It is not safe for
+// concurrent use.
+type VarDiff interface {
+	// Diff returns the current difficulty
+	Diff() float64
+	// SetDiff sets the difficulty, within the bounds
+	SetDiff(diff float64)
+	// Share records a share of difficulty diff, and returns the new difficulty
+	// and whether it changed
+	Share(diff float64) (float64, bool)
+	// Idle lowers the difficulty if the miner has not found a share for too
+	// long. It's called before sending a job.
+	Idle() (float64, bool)
+}
+
+type Config struct {
+	Initial float64
+	Min     float64
+	Max     float64
+
+	TargetTime   time.Duration // expected time between shares
+	RetargetTime time.Duration // minimum time between retargets
+	// the difficulty is not changed while the average share time is within
+	// TargetTime * (1 ± Variance)
+	Variance float64
+	Window   int // number of shares the hashrate is estimated from
+}
+
+// Clock returns the current time
+type Clock func() time.Time
+
+// New returns the default VarDiff implementation
+func New(cfg Config, now Clock) VarDiff {
+	return NewWindowed(cfg, now)
+}
+
+type sample struct {
+	diff     float64
+	duration float64 // seconds since the previous share
+}
+
+// Fixed is a VarDiff which never retargets, used when the miner asks for a
+// fixed difficulty
+type Fixed struct {
+	diff float64
+}
+
+func NewFixed(diff float64) *Fixed {
+	return &Fixed{diff: diff}
+}
+
+func (f *Fixed) Diff() float64 {
+	return f.diff
+}
+
+func (f *Fixed) SetDiff(diff float64) {
+	f.diff = diff
+}
+
+func (f *Fixed) Share(float64) (float64, bool) {
+	return f.diff, false
+}
+
+func (f *Fixed) Idle() (float64, bool) {
+	return f.diff, false
+}
+
+// Windowed estimates the hashrate from the last shares and their times, and
+// retargets at most every RetargetTime, or as soon as the window is full of
+// new shares.
+type Windowed struct {
+	cfg Config
+	now Clock
+
+	diff float64
+
+	lastShare    time.Time
+	lastRetarget time.Time
+
+	samples []sample // ring buffer
+	next    int
+	fresh   int // shares since the last retarget
+}
+
+func NewWindowed(cfg Config, now Clock) *Windowed {
+	if cfg.Window < 1 {
+		cfg.Window = 1
+	}
+
+	t := now()
+	w := &Windowed{
+		cfg:          cfg,
+		now:          now,
+		lastShare:    t,
+		lastRetarget: t,
+		samples:      make([]sample, 0, cfg.Window),
+	}
+	w.SetDiff(cfg.Initial)
+
+	return w
+}
+
+func (w *Windowed) Diff() float64 {
+	return w.diff
+}
+
+func (w *Windowed) SetDiff(diff float64) {
+	w.diff = w.clamp(diff)
+}
+
+func (w *Windowed) Share(diff float64) (float64, bool) {
+	t := w.now()
+
+	w.add(sample{
+		diff:     diff,
+		duration: t.Sub(w.lastShare).Seconds(),
+	})
+	w.lastShare = t
+	w.fresh++
+
+	if t.Sub(w.lastRetarget) < w.cfg.RetargetTime && w.fresh < w.cfg.Window {
+		return w.diff, false
+	}
+
+	var sumDiff, sumTime float64
+	for _, s := range w.samples {
+		sumDiff += s.diff
+		sumTime += s.duration
+	}
+
+	return w.retarget(sumDiff, sumTime)
+}
+
+func (w *Windowed) Idle() (float64, bool) {
+	t := w.now()
+
+	since := t.Sub(w.lastShare)
+	if t.Sub(w.lastRetarget) < w.cfg.RetargetTime ||
+		since.Seconds() <= w.cfg.TargetTime.Seconds()*(1+w.cfg.Variance) {
+		return w.diff, false
+	}
+
+	// the miner has been working on the current difficulty since the last share
+	return w.retarget(w.diff, since.Seconds())
+}
+
+// retarget sets the difficulty for a hashrate of sumDiff / sumTime
+func (w *Windowed) retarget(sumDiff, sumTime float64) (float64, bool) {
+	w.lastRetarget = w.now()
+	w.fresh = 0
+
+	if sumDiff <= 0 {
+		return w.diff, false
+	}
+	// avoid division by zero with shares found in the same instant
+	sumTime = max(sumTime, 0.001)
+
+	// average time between shares at the current difficulty
+	shareTime := w.diff / (sumDiff / sumTime)
+	target := w.cfg.TargetTime.Seconds()
+	if shareTime >= target*(1-w.cfg.Variance) && shareTime <= target*(1+w.cfg.Variance) {
+		return w.diff, false
+	}
+
+	ratio := min(max(target/shareTime, 1.0/MAX_STEP), MAX_STEP)
+
+	old := w.diff
+	w.SetDiff(w.diff * ratio)
+
+	return w.diff, w.diff != old
+}
+
+func (w *Windowed) add(s sample) {
+	if len(w.samples) < w.cfg.Window {
+		w.samples = append(w.samples, s)
+		return
+	}
+	w.samples[w.next] = s
+	w.next = (w.next + 1) % w.cfg.Window
+}
+
+func (w *Windowed) clamp(diff float64) float64 {
+	if w.cfg.Max > 0 && diff > w.cfg.Max {
+		diff = w.cfg.Max
+	}
+	if diff < w.cfg.Min {
+		diff = w.cfg.Min
+	}
+	return max(diff, 1)
+}
@@ -0,0 +1,149 @@
+// Copyright (C) 2024 XELIS
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package vardiff
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+type fakeClock struct {
+	t time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	return c.t
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.t = c.t.Add(d)
+}
+
+var testConfig = Config{
+	Initial:      1000,
+	Min:          100,
+	Max:          1e12,
+	TargetTime:   10 * time.Second,
+	RetargetTime: 30 * time.Second,
+	Variance:     0.3,
+	Window:       8,
+}
+
+// mine simulates a miner with a constant hashrate for the given duration,
+// sending jobs with the difficulty returned by the VarDiff
+func mine(clock *fakeClock, v VarDiff, hashrate float64, d time.Duration) {
+	end := clock.Now().Add(d)
+	for clock.Now().Before(end) {
+		diff := v.Diff()
+		clock.Advance(time.Duration(diff / hashrate * float64(time.Second)))
+		v.Share(diff)
+	}
+}
+
+func TestConverges(t *testing.T) {
+	for _, hashrate := range []float64{20, 1e3, 1e6, 1e9} {
+		clock := &fakeClock{t: time.Unix(1_700_000_000, 0)}
+		v := New(testConfig, clock.Now)
+
+		mine(clock, v, hashrate, time.Hour)
+
+		shareTime := v.Diff() / hashrate
+		if math.Abs(shareTime-10) > 10*testConfig.Variance {
+			t.Errorf("hashrate %g: share time %.2fs, expected about 10s", hashrate, shareTime)
+		}
+	}
+}
+
+func TestStable(t *testing.T) {
+	clock := &fakeClock{t: time.Unix(1_700_000_000, 0)}
+	v := New(testConfig, clock.Now)
+
+	// a share every 11s is within the variance
+	for range 100 {
+		clock.Advance(11 * time.Second)
+		if diff, changed := v.Share(v.Diff()); changed {
+			t.Fatalf("difficulty changed to %g", diff)
+		}
+	}
+}
+
+func TestRetargetInterval(t *testing.T) {
+	clock := &fakeClock{t: time.Unix(1_700_000_000, 0)}
+	v := New(testConfig, clock.Now)
+
+	// fast shares retarget once the window is full
+	for i := 1; i < testConfig.Window; i++ {
+		clock.Advance(time.Second)
+		if _, changed := v.Share(v.Diff()); changed {
+			t.Fatalf("retarget after %d shares", i)
+		}
+	}
+	clock.Advance(time.Second)
+	diff, changed := v.Share(v.Diff())
+	if !changed || diff != 1000*MAX_STEP {
+		t.Fatalf("difficulty %g, expected %d", diff, 1000*MAX_STEP)
+	}
+}
+
+func TestIdle(t *testing.T) {
+	clock := &fakeClock{t: time.Unix(1_700_000_000, 0)}
+	v := New(testConfig, clock.Now)
+
+	clock.Advance(20 * time.Second)
+	if _, changed := v.Idle(); changed {
+		t.Fatal("retarget before RetargetTime")
+	}
+
+	clock.Advance(20 * time.Second)
+	diff, changed := v.Idle()
+	if !changed || diff != 250 {
+		t.Fatalf("difficulty %g, expected 250", diff)
+	}
+
+	// the difficulty does not go below the minimum
+	clock.Advance(time.Hour)
+	if diff, _ := v.Idle(); diff != testConfig.Min {
+		t.Fatalf("difficulty %g, expected %g", diff, testConfig.Min)
+	}
+}
+
+func TestBounds(t *testing.T) {
+	clock := &fakeClock{t: time.Unix(1_700_000_000, 0)}
+	cfg := testConfig
+	cfg.Max = 5000
+	v := New(cfg, clock.Now)
+
+	v.SetDiff(1)
+	if v.Diff() != cfg.Min {
+		t.Errorf("difficulty %g, expected %g", v.Diff(), cfg.Min)
+	}
+
+	mine(clock, v, 1e6, time.Hour)
+	if v.Diff() != cfg.Max {
+		t.Errorf("difficulty %g, expected %g", v.Diff(), cfg.Max)
+	}
+}
+
+func TestFixed(t *testing.T) {
+	clock := &fakeClock{t: time.Unix(1_700_000_000, 0)}
+	v := NewFixed(5000)
+
+	mine(clock, v, 1e6, time.Hour)
+	if diff, changed := v.Idle(); changed || diff != 5000 {
+		t.Fatalf("difficulty %g, expected 5000", diff)
+	}
+}
@@ -24,9 +24,12 @@ import (
 	"time"
 	"xelis-pool/cfg"
 	"xelis-pool/log"
+	"xelis-pool/login"
 	"xelis-pool/pow"
+	"xelis-pool/proxyproto"
 	rate_limit "xelis-pool/rate_limit"
 	"xelis-pool/util"
+	"xelis-pool/vardiff"
 	"xelis-pool/xatum"
 )
 
@@ -48,22 +51,44 @@ type Connection struct {
 type CData struct {
 	Jobs []ConnJob
 
-	NextDiff  float64
-	LastShare time.Time // in unix milliseconds
+	VarDiff   vardiff.VarDiff
+	LastShare time.Time
 	Score     int32
 	Wallet    string
+	Worker    string
+	Login     login.Login // options of the miner login
 
 	sync.RWMutex
 }
 
-func NewCData() CData {
+func NewCData(protocol string) CData {
 	return CData{
 		LastShare: time.Now(),
-		NextDiff:  float64(cfg.Cfg.Slave.InitialDifficulty),
+		VarDiff:   vardiff.New(VardiffConfig(protocol), time.Now),
 		Jobs:      make([]ConnJob, 0, 5),
 	}
 }
 
+// VardiffConfig returns the difficulty retargeting configuration of a protocol
+func VardiffConfig(protocol string) vardiff.Config {
+	vcfg := cfg.Cfg.Slave.Vardiff
+
+	target, ok := vcfg.ShareTargets[protocol]
+	if !ok {
+		target = cfg.Cfg.Slave.ShareTarget
+	}
+
+	return vardiff.Config{
+		Initial:      float64(cfg.Cfg.Slave.InitialDifficulty),
+		Min:          float64(cfg.Cfg.Slave.MinDifficulty),
+		Max:          float64(cfg.Cfg.Slave.MaxDifficulty),
+		TargetTime:   time.Duration(target * float64(time.Second)),
+		RetargetTime: time.Duration(vcfg.RetargetTime * float64(time.Second)),
+		Variance:     vcfg.Variance,
+		Window:       vcfg.Window,
+	}
+}
+
 func (c *CData) LastJob() ConnJob {
 	if len(c.Jobs) == 0 {
 		return ConnJob{}
@@ -76,20 +101,10 @@ func (c *Connection) LastJob() ConnJob {
 	return c.CData.LastJob()
 }
 
+// GetNextDiff returns the difficulty of the next job, lowered if the miner did
+// not find shares recently
 func (c *CData) GetNextDiff() float64 {
-	d := c.NextDiff
-
-	seconds := time.Since(c.LastShare).Seconds()
-
-	if seconds > 1 {
-		// difficulty halves every 40 seconds
-		d /= 1 + (seconds / 40)
-	}
-
-	if d < float64(cfg.Cfg.Slave.MinDifficulty) {
-		return float64(cfg.Cfg.Slave.MinDifficulty)
-	}
-
+	d, _ := c.VarDiff.Idle()
 	return d
 }
 
@@ -122,35 +137,15 @@ func (c *Connection) SendJob(job xatum.S2C_Job) {
 	c.Send(xatum.PacketS2C_Job, job)
 }
 
-var Cert tls.Certificate
-
-func (s *Server) Start(port uint16) {
+// Start listens for Xatum connections, with the certificate of tlsConfig
+func (s *Server) Start(port uint16, tlsConfig *tls.Config) {
 	s.NewConnections = make(chan *Connection, 1)
 
-	var err error
-	Cert, err = tls.LoadX509KeyPair("cert.pem", "key.pem")
-	if err != nil {
-		log.Err("Invalid TLS certificate:", err, "generating a new one")
-
-		certPem, keyPem, err := GenCertificate()
-		if err != nil {
-			log.Fatal(err)
-		}
-
-		Cert, err = tls.X509KeyPair(certPem, keyPem)
-		if err != nil {
-			log.Fatal(err)
-		}
-	}
-
-	listener, err := tls.Listen("tcp", "0.0.0.0:"+strconv.FormatUint(uint64(port), 10), &tls.Config{
-		Certificates: []tls.Certificate{
-			Cert,
-		},
-	})
+	listener, err := proxyproto.Listen("0.0.0.0:"+strconv.FormatUint(uint64(port), 10), cfg.Cfg.Slave.ProxyProtocol)
 	if err != nil {
 		log.Fatal(err)
 	}
+	listener = tls.NewListener(listener, tlsConfig)
 
 	log.Info("Xatum server listening on port", port)
 
@@ -174,7 +169,7 @@ func (s *Server) Start(port uint16) {
 			Conn: c,
 			Id:   util.RandomUint64(),
 
-			CData: NewCData(),
+			CData: NewCData("xatum"),
 		}
 		go s.handleConnection(conn)
 	}